@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/rtapi"
+	"github.com/heroiclabs/nakama-common/runtime"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// One object per user holds their decayed activity score, so team scores only read one object per member.
+	storageCollectionPlayerActivity = "player_activity"
+	storageKeyPlayerActivity        = "score"
+
+	activitySignalSessionStart          = "session_start"
+	activitySignalGiftContribution      = "gift_contribution"
+	activitySignalEventLeaderboardScore = "event_leaderboard_score"
+	activitySignalChatMessage           = "chat_message"
+
+	activityAggregationSum    = "sum"
+	activityAggregationMedian = "median"
+	activityAggregationTopK   = "top_k"
+
+	activityWriteAttempts = 3
+)
+
+// TeamActivityConfig is the shape of definitions/<env>/team-activity.json.
+type TeamActivityConfig struct {
+	// HalfLifeSec is how long it takes a player's activity score to halve without new signals.
+	HalfLifeSec int64 `json:"half_life_sec"`
+	// Aggregation combines member scores into the team score, one of "sum", "median" or "top_k".
+	Aggregation string `json:"aggregation"`
+	// TopK is how many of the most active members are summed with the "top_k" aggregation.
+	TopK int `json:"top_k"`
+	// Scale multiplies the aggregated score before it is rounded to the integer activity Hiro sorts teams by.
+	Scale   float64                        `json:"scale"`
+	Signals map[string]*TeamActivitySignal `json:"signals"`
+}
+
+// TeamActivitySignal is how much one occurrence of a signal adds to the player's activity score.
+type TeamActivitySignal struct {
+	Weight float64 `json:"weight"`
+	// CooldownSec ignores repeats of the signal within this many seconds, e.g. to stop chat spam counting as activity.
+	CooldownSec int64 `json:"cooldown_sec"`
+}
+
+type PlayerActivity struct {
+	Score         float64          `json:"score"`
+	UpdateTimeSec int64            `json:"update_time_sec"`
+	LastSignalSec map[string]int64 `json:"last_signal_sec"`
+}
+
+func (c *TeamActivityConfig) Validate() error {
+	var errs []error
+	if c.HalfLifeSec <= 0 {
+		errs = append(errs, errors.New("half_life_sec must be positive"))
+	}
+	switch c.Aggregation {
+	case activityAggregationSum, activityAggregationMedian:
+	case activityAggregationTopK:
+		if c.TopK <= 0 {
+			errs = append(errs, errors.New("top_k must be positive with the top_k aggregation"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("aggregation must be one of sum, median, top_k, got %q", c.Aggregation))
+	}
+	if c.Scale <= 0 {
+		errs = append(errs, errors.New("scale must be positive"))
+	}
+	for name, signal := range c.Signals {
+		switch name {
+		case activitySignalSessionStart, activitySignalGiftContribution, activitySignalEventLeaderboardScore, activitySignalChatMessage:
+		default:
+			errs = append(errs, fmt.Errorf("unknown signal %q", name))
+		}
+		if signal.Weight < 0 || signal.CooldownSec < 0 {
+			errs = append(errs, fmt.Errorf("signal %q: weight and cooldown_sec must not be negative", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// decayed returns the score as of now.
+func (c *TeamActivityConfig) decayed(activity *PlayerActivity, now int64) float64 {
+	elapsed := now - activity.UpdateTimeSec
+	if elapsed <= 0 {
+		return activity.Score
+	}
+	return activity.Score * math.Exp2(-float64(elapsed)/float64(c.HalfLifeSec))
+}
+
+// Record adds a signal to the user's activity score. Failures are only logged, activity never fails the action that
+// produced it.
+func (c *TeamActivityConfig) Record(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID, signal string) {
+	config, found := c.Signals[signal]
+	if !found || config.Weight == 0 {
+		return
+	}
+
+	var writeErr error
+	for attempt := 0; attempt < activityWriteAttempts; attempt++ {
+		objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionPlayerActivity, Key: storageKeyPlayerActivity, UserID: userID}})
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read player activity")
+			return
+		}
+		activity := &PlayerActivity{}
+		version := "*"
+		if len(objects) > 0 {
+			if err := json.Unmarshal([]byte(objects[0].Value), activity); err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to unmarshal player activity")
+				return
+			}
+			version = objects[0].Version
+		}
+		if activity.LastSignalSec == nil {
+			activity.LastSignalSec = make(map[string]int64, 1)
+		}
+
+		now := time.Now().Unix()
+		if last, found := activity.LastSignalSec[signal]; found && now-last < config.CooldownSec {
+			return
+		}
+		activity.Score = c.decayed(activity, now) + config.Weight
+		activity.UpdateTimeSec = now
+		activity.LastSignalSec[signal] = now
+
+		value, err := json.Marshal(activity)
+		if err != nil {
+			return
+		}
+		if _, writeErr = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+			Collection:      storageCollectionPlayerActivity,
+			Key:             storageKeyPlayerActivity,
+			UserID:          userID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}}); writeErr == nil {
+			return
+		}
+	}
+	logger.WithFields(map[string]interface{}{"signal": signal, "error": writeErr.Error()}).Warn("Failed to record player activity")
+}
+
+// records reads the activity of the users with a single storage read. Users without any activity are left out.
+func (c *TeamActivityConfig) records(ctx context.Context, nk runtime.NakamaModule, userIDs []string) (map[string]*PlayerActivity, error) {
+	reads := make([]*runtime.StorageRead, 0, len(userIDs))
+	for _, userID := range userIDs {
+		reads = append(reads, &runtime.StorageRead{Collection: storageCollectionPlayerActivity, Key: storageKeyPlayerActivity, UserID: userID})
+	}
+	if len(reads) == 0 {
+		return map[string]*PlayerActivity{}, nil
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]*PlayerActivity, len(objects))
+	for _, object := range objects {
+		activity := &PlayerActivity{}
+		if err := json.Unmarshal([]byte(object.Value), activity); err != nil {
+			return nil, err
+		}
+		records[object.UserId] = activity
+	}
+	return records, nil
+}
+
+// scores returns the decayed activity scores of the users.
+func (c *TeamActivityConfig) scores(ctx context.Context, nk runtime.NakamaModule, userIDs []string) (map[string]float64, error) {
+	records, err := c.records(ctx, nk, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	scores := make(map[string]float64, len(records))
+	for userID, activity := range records {
+		scores[userID] = c.decayed(activity, now)
+	}
+	return scores, nil
+}
+
+// aggregate combines member scores into a team score. Members without any activity count as zero.
+func (c *TeamActivityConfig) aggregate(scores []float64) float64 {
+	if len(scores) == 0 {
+		return 0
+	}
+	switch c.Aggregation {
+	case activityAggregationMedian:
+		sort.Float64s(scores)
+		middle := len(scores) / 2
+		if len(scores)%2 == 0 {
+			return (scores[middle-1] + scores[middle]) / 2
+		}
+		return scores[middle]
+	case activityAggregationTopK:
+		sort.Sort(sort.Reverse(sort.Float64Slice(scores)))
+		if len(scores) > c.TopK {
+			scores = scores[:c.TopK]
+		}
+	}
+	var total float64
+	for _, score := range scores {
+		total += score
+	}
+	return total
+}
+
+// CalculatePlayerActivity reports each user's own decayed activity score to Hiro.
+func (c *TeamActivityConfig) CalculatePlayerActivity(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userIDs []string) map[string]int64 {
+	scores, err := c.scores(ctx, nk, userIDs)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read player activity")
+		return map[string]int64{}
+	}
+	activity := make(map[string]int64, len(scores))
+	for userID, score := range scores {
+		activity[userID] = int64(math.Round(score * c.Scale))
+	}
+	return activity
+}
+
+// CalculateTeamActivity aggregates the activity of the team's members, so teams of active players rank above large
+// but inactive ones.
+func (c *TeamActivityConfig) CalculateTeamActivity(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, team *hiro.Team) int64 {
+	if team == nil || len(team.Members) == 0 {
+		return 0
+	}
+
+	userIDs := make([]string, 0, len(team.Members))
+	for _, member := range team.Members {
+		userIDs = append(userIDs, member.GetId())
+	}
+	scores, err := c.scores(ctx, nk, userIDs)
+	if err != nil {
+		logger.WithFields(map[string]interface{}{"team_id": team.Id, "error": err.Error()}).Error("Failed to read team member activity")
+		return 0
+	}
+
+	memberScores := make([]float64, 0, len(userIDs))
+	for _, userID := range userIDs {
+		memberScores = append(memberScores, scores[userID])
+	}
+	return int64(math.Round(c.aggregate(memberScores) * c.Scale))
+}
+
+// Register wires the activity signals and calculators.
+func (c *TeamActivityConfig) Register(initializer runtime.Initializer, nk runtime.NakamaModule, systems hiro.Hiro) error {
+	systems.SetActivityCalculator(c.CalculatePlayerActivity)
+
+	if err := initializer.RegisterEventSessionStart(func(ctx context.Context, logger runtime.Logger, evt *api.Event) {
+		if userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string); ok {
+			c.Record(ctx, logger, nk, userID, activitySignalSessionStart)
+		}
+	}); err != nil {
+		return err
+	}
+
+	// Only messages in group channels, that is team chat, count. Messages sent through Hiro's team chat RPC are recorded
+	// by its replacement in chatmoderation.go.
+	if err := initializer.RegisterAfterRt("ChannelMessageSend", func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, out, in *rtapi.Envelope) error {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if ok && out.GetChannelMessageAck().GetGroupId() != "" {
+			c.Record(ctx, logger, nk, userID, activitySignalChatMessage)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	teamsSystem := systems.GetTeamsSystem()
+	if teamsSystem == nil {
+		return nil
+	}
+	teamsSystem.SetActivityCalculator(c.CalculateTeamActivity)
+
+	teamsSystem.SetOnGiftContributeReward(func(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID, teamID, sourceID string, source *hiro.TeamGift, rewardConfig *hiro.EconomyConfigReward, reward *hiro.Reward) (*hiro.Reward, error) {
+		c.Record(ctx, logger, nk, userID, activitySignalGiftContribution)
+		return reward, nil
+	})
+
+	// Hiro has no hook for team event leaderboard scores, so its RPC is replaced by one that records the signal.
+	if err := hiro.UnregisterRpc(initializer, hiro.RpcId_RPC_ID_TEAMS_EVENT_LEADERBOARD_UPDATE); err != nil {
+		return err
+	}
+	return initializer.RegisterRpc(hiro.RpcId_RPC_ID_TEAMS_EVENT_LEADERBOARD_UPDATE.String(), c.rpcTeamEventLeaderboardUpdate(teamsSystem))
+}
+
+func (c *TeamActivityConfig) rpcTeamEventLeaderboardUpdate(teamsSystem hiro.TeamsSystem) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		request := &hiro.TeamEventLeaderboardUpdate{}
+		if err := protojson.Unmarshal([]byte(payload), request); err != nil {
+			return "", err
+		}
+		var metadata map[string]interface{}
+		if request.Metadata != "" {
+			if err := json.Unmarshal([]byte(request.Metadata), &metadata); err != nil {
+				return "", runtime.NewError("invalid metadata", 3)
+			}
+		}
+
+		eventLeaderboard, err := teamsSystem.UpdateEventLeaderboard(ctx, logger, db, nk, userID, request.Id, request.EventLeaderboardId, request.Score, request.Subscore, metadata, request.ConditionalMetadataUpdate)
+		if err != nil {
+			return "", err
+		}
+		c.Record(ctx, logger, nk, userID, activitySignalEventLeaderboardScore)
+
+		response, err := protojson.Marshal(eventLeaderboard)
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
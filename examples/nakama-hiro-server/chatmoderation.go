@@ -0,0 +1,704 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/rtapi"
+	"github.com/heroiclabs/nakama-common/runtime"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// System-owned objects: the mute list of each team keyed by team ID, and the moderation queue of reported messages
+	// keyed by message and reporter, so a player can report each message once.
+	storageCollectionTeamChatMutes   = "team_chat_mutes"
+	storageCollectionTeamChatReports = "team_chat_reports"
+
+	chatFilterActionMask   = "mask"
+	chatFilterActionReject = "reject"
+
+	chatReportStatusOpen = "open"
+
+	teamAuditChatMute   = "chat_mute"
+	teamAuditChatUnmute = "chat_unmute"
+
+	// Group channel IDs are "3.<group ID>..".
+	groupChannelPrefix = "3."
+
+	chatMessagesPageSize = 100
+	// Sender states idle for longer than every window are dropped once this many are held.
+	chatSenderSweepSize   = 10000
+	chatMuteWriteAttempts = 3
+)
+
+var (
+	errChatMuted       = runtime.NewError("muted in team chat", 7)
+	errChatRateLimited = runtime.NewError("sending team chat messages too fast", 8)
+	errChatFlood       = runtime.NewError("repeated team chat message", 8)
+	errChatFiltered    = runtime.NewError("team chat message not allowed", 3)
+)
+
+// TeamChatModerationConfig is the shape of definitions/<env>/team-chat-moderation.json. Every stage is skipped when
+// its section is missing.
+type TeamChatModerationConfig struct {
+	Filter    *TeamChatFilter    `json:"filter"`
+	RateLimit *TeamChatRateLimit `json:"rate_limit"`
+	Flood     *TeamChatFlood     `json:"flood"`
+	Mutes     *TeamChatMutes     `json:"mutes"`
+	Reports   *TeamChatReports   `json:"reports"`
+
+	senders *chatSenders
+}
+
+type TeamChatFilter struct {
+	// Words are matched whole and case-insensitively, Patterns are regular expressions.
+	Words    []string `json:"words"`
+	Patterns []string `json:"patterns"`
+	// Action is "mask", which replaces every matched character with Mask, or "reject".
+	Action string `json:"action"`
+	Mask   string `json:"mask"`
+
+	expressions []*regexp.Regexp
+}
+
+type TeamChatRateLimit struct {
+	MaxMessages int   `json:"max_messages"`
+	WindowSec   int64 `json:"window_sec"`
+}
+
+// TeamChatFlood rejects a message sent MaxRepeats times within WindowSec, ignoring case and spacing, and mutes the
+// sender for MuteSec if set.
+type TeamChatFlood struct {
+	MaxRepeats int   `json:"max_repeats"`
+	WindowSec  int64 `json:"window_sec"`
+	MuteSec    int64 `json:"mute_sec"`
+}
+
+type TeamChatMutes struct {
+	MaxDurationSec int64 `json:"max_duration_sec"`
+}
+
+type TeamChatReports struct {
+	// ContextMessages is how many messages either side of the reported one are snapshotted with it.
+	ContextMessages int `json:"context_messages"`
+	// SearchMessages is how far back in the team's chat history a reported message is looked for.
+	SearchMessages  int `json:"search_messages"`
+	MaxReasonLength int `json:"max_reason_length"`
+}
+
+type TeamChatMute struct {
+	UntilSec int64 `json:"until_sec"`
+	// MutedBy is empty for mutes from flood detection.
+	MutedBy string `json:"muted_by"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type TeamChatMuteList struct {
+	Mutes map[string]*TeamChatMute `json:"mutes"`
+}
+
+type TeamChatReport struct {
+	TeamID     string                `json:"team_id"`
+	ReporterID string                `json:"reporter_id"`
+	Reason     string                `json:"reason"`
+	Status     string                `json:"status"`
+	Message    *api.ChannelMessage   `json:"message"`
+	Context    []*api.ChannelMessage `json:"context"`
+	CreateTime int64                 `json:"create_time"`
+}
+
+type teamChatMuteRequest struct {
+	TeamID      string `json:"team_id"`
+	UserID      string `json:"user_id"`
+	DurationSec int64  `json:"duration_sec"`
+	Reason      string `json:"reason"`
+}
+
+type teamChatReportRequest struct {
+	TeamID    string `json:"team_id"`
+	MessageID string `json:"message_id"`
+	Reason    string `json:"reason"`
+}
+
+// chatSenders holds recent message times and contents per sender and team. It is kept in memory, so limits apply per
+// server node.
+type chatSenders struct {
+	sync.Mutex
+	states map[string]*chatSenderState
+}
+
+type chatSenderState struct {
+	times    []int64
+	contents []string
+}
+
+func (c *TeamChatModerationConfig) Validate() error {
+	var errs []error
+	if filter := c.Filter; filter != nil {
+		if len(filter.Words) > 0 {
+			words := make([]string, 0, len(filter.Words))
+			for _, word := range filter.Words {
+				words = append(words, regexp.QuoteMeta(word))
+			}
+			filter.expressions = append(filter.expressions, regexp.MustCompile(`(?i)\b(`+strings.Join(words, "|")+`)\b`))
+		}
+		for _, pattern := range filter.Patterns {
+			expression, err := regexp.Compile(pattern)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("filter pattern %q: %w", pattern, err))
+				continue
+			}
+			filter.expressions = append(filter.expressions, expression)
+		}
+		switch filter.Action {
+		case chatFilterActionReject:
+		case chatFilterActionMask:
+			if filter.Mask == "" {
+				errs = append(errs, errors.New("filter mask is required with the mask action"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("filter action must be one of mask, reject, got %q", filter.Action))
+		}
+	}
+	if limit := c.RateLimit; limit != nil && (limit.MaxMessages <= 0 || limit.WindowSec <= 0) {
+		errs = append(errs, errors.New("rate_limit max_messages and window_sec must be positive"))
+	}
+	if flood := c.Flood; flood != nil && (flood.MaxRepeats <= 1 || flood.WindowSec <= 0 || flood.MuteSec < 0) {
+		errs = append(errs, errors.New("flood max_repeats must be above 1, window_sec positive and mute_sec not negative"))
+	}
+	if mutes := c.Mutes; mutes != nil && mutes.MaxDurationSec <= 0 {
+		errs = append(errs, errors.New("mutes max_duration_sec must be positive"))
+	}
+	if reports := c.Reports; reports != nil && (reports.ContextMessages < 0 || reports.SearchMessages <= 0 || reports.MaxReasonLength <= 0) {
+		errs = append(errs, errors.New("reports search_messages and max_reason_length must be positive, context_messages not negative"))
+	}
+	c.senders = &chatSenders{states: make(map[string]*chatSenderState)}
+	return errors.Join(errs...)
+}
+
+// Register replaces Hiro's team chat RPC with one that moderates messages first and records them as team activity,
+// moderates team chat sent over the realtime socket too, and registers the mute and report RPCs.
+func (c *TeamChatModerationConfig) Register(initializer runtime.Initializer, systems hiro.Hiro, maintenance *TeamMaintenanceConfig, activity *TeamActivityConfig) error {
+	teamsSystem := systems.GetTeamsSystem()
+	if teamsSystem == nil {
+		return nil
+	}
+
+	if err := hiro.UnregisterRpc(initializer, hiro.RpcId_RPC_ID_TEAMS_WRITE_CHAT_MESSAGE); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc(hiro.RpcId_RPC_ID_TEAMS_WRITE_CHAT_MESSAGE.String(), c.rpcTeamWriteChatMessage(teamsSystem, maintenance, activity)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterBeforeRt("ChannelMessageSend", c.beforeChannelMessageSend(maintenance)); err != nil {
+		return err
+	}
+
+	if c.Mutes != nil {
+		if err := initializer.RegisterRpc("rpc_team_chat_mute", c.rpcTeamChatMute(maintenance)); err != nil {
+			return err
+		}
+		if err := initializer.RegisterRpc("rpc_team_chat_unmute", c.rpcTeamChatUnmute(maintenance)); err != nil {
+			return err
+		}
+		if err := initializer.RegisterRpc("rpc_team_chat_mute_list", c.rpcTeamChatMuteList); err != nil {
+			return err
+		}
+	}
+	if c.Reports != nil {
+		if err := initializer.RegisterRpc("rpc_team_chat_report", c.rpcTeamChatReport); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moderate runs a message through every configured stage in order: mutes, rate limit, flood detection and filters.
+// It returns the content to send, masked if the filter masks.
+func (c *TeamChatModerationConfig) moderate(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, maintenance *TeamMaintenanceConfig, userID, teamID, content string) (string, error) {
+	if c.Mutes != nil || c.Flood != nil {
+		mutes, _, err := readTeamChatMutes(ctx, nk, teamID)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read team chat mutes")
+			return "", err
+		}
+		if mute, found := mutes.Mutes[userID]; found && mute.UntilSec > time.Now().Unix() {
+			return "", errChatMuted
+		}
+	}
+
+	if flooded, err := c.senders.check(c.RateLimit, c.Flood, userID, teamID, content); err != nil {
+		if flooded && c.Flood.MuteSec > 0 {
+			mute := &TeamChatMute{UntilSec: time.Now().Unix() + c.Flood.MuteSec, Reason: "flood"}
+			if err := updateTeamChatMutes(ctx, nk, teamID, func(mutes *TeamChatMuteList) { mutes.Mutes[userID] = mute }); err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to mute flooding team chat sender")
+			} else {
+				maintenance.audit(ctx, logger, nk, teamID, teamAuditChatMute, "", []string{userID})
+			}
+		}
+		return "", err
+	}
+
+	if c.Filter == nil || len(c.Filter.expressions) == 0 {
+		return content, nil
+	}
+	var message interface{}
+	if err := json.Unmarshal([]byte(content), &message); err != nil {
+		return "", runtime.NewError("message content must be JSON", 3)
+	}
+	message, matched := c.Filter.apply(message)
+	if !matched {
+		return content, nil
+	}
+	logger.WithFields(map[string]interface{}{"user_id": userID, "team_id": teamID}).Info("Filtered team chat message")
+	if c.Filter.Action == chatFilterActionReject {
+		return "", errChatFiltered
+	}
+	masked, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	return string(masked), nil
+}
+
+// apply masks every string in the message content, keys included.
+func (f *TeamChatFilter) apply(value interface{}) (interface{}, bool) {
+	switch value := value.(type) {
+	case string:
+		var matched bool
+		for _, expression := range f.expressions {
+			value = expression.ReplaceAllStringFunc(value, func(match string) string {
+				matched = true
+				return strings.Repeat(f.Mask, utf8.RuneCountInString(match))
+			})
+		}
+		return value, matched
+	case []interface{}:
+		var matched bool
+		for i, element := range value {
+			var elementMatched bool
+			value[i], elementMatched = f.apply(element)
+			matched = matched || elementMatched
+		}
+		return value, matched
+	case map[string]interface{}:
+		var matched bool
+		masked := make(map[string]interface{}, len(value))
+		for key, element := range value {
+			maskedKey, keyMatched := f.apply(key)
+			maskedElement, elementMatched := f.apply(element)
+			masked[maskedKey.(string)] = maskedElement
+			matched = matched || keyMatched || elementMatched
+		}
+		return masked, matched
+	default:
+		return value, false
+	}
+}
+
+// check records a message and reports whether it breaks the rate limit or flood rules. Rejected messages still count
+// towards the rate limit, so retrying in a loop does not help.
+func (s *chatSenders) check(limit *TeamChatRateLimit, flood *TeamChatFlood, userID, teamID, content string) (bool, error) {
+	if limit == nil && flood == nil {
+		return false, nil
+	}
+	now := time.Now().Unix()
+	var window int64
+	if limit != nil {
+		window = limit.WindowSec
+	}
+	if flood != nil {
+		window = max(window, flood.WindowSec)
+	}
+	normalized := strings.ToLower(strings.Join(strings.Fields(content), " "))
+
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.states) >= chatSenderSweepSize {
+		for key, state := range s.states {
+			if len(state.times) == 0 || now-state.times[len(state.times)-1] >= window {
+				delete(s.states, key)
+			}
+		}
+	}
+
+	key := userID + "." + teamID
+	state, found := s.states[key]
+	if !found {
+		state = &chatSenderState{}
+		s.states[key] = state
+	}
+	first := 0
+	for first < len(state.times) && now-state.times[first] >= window {
+		first++
+	}
+	state.times = append(state.times[first:], now)
+	state.contents = append(state.contents[first:], normalized)
+
+	if limit != nil {
+		var count int
+		for _, sent := range state.times {
+			if now-sent < limit.WindowSec {
+				count++
+			}
+		}
+		if count > limit.MaxMessages {
+			return false, errChatRateLimited
+		}
+	}
+	if flood != nil {
+		var repeats int
+		for i, sent := range state.times {
+			if now-sent < flood.WindowSec && state.contents[i] == normalized {
+				repeats++
+			}
+		}
+		if repeats >= flood.MaxRepeats {
+			return true, errChatFlood
+		}
+	}
+	return false, nil
+}
+
+func (c *TeamChatModerationConfig) rpcTeamWriteChatMessage(teamsSystem hiro.TeamsSystem, maintenance *TeamMaintenanceConfig, activity *TeamActivityConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		request := &hiro.TeamWriteChatMessageRequest{}
+		if err := protojson.Unmarshal([]byte(payload), request); err != nil {
+			return "", err
+		}
+		content, err := c.moderate(ctx, logger, nk, maintenance, userID, request.Id, request.Content)
+		if err != nil {
+			return "", err
+		}
+		request.Content = content
+
+		ack, err := teamsSystem.WriteChatMessage(ctx, logger, nk, userID, request)
+		if err != nil {
+			return "", err
+		}
+		activity.Record(ctx, logger, nk, userID, activitySignalChatMessage)
+		response, err := protojson.Marshal(ack)
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+func (c *TeamChatModerationConfig) beforeChannelMessageSend(maintenance *TeamMaintenanceConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, envelope *rtapi.Envelope) (*rtapi.Envelope, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, envelope *rtapi.Envelope) (*rtapi.Envelope, error) {
+		send := envelope.GetChannelMessageSend()
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok || send == nil || !strings.HasPrefix(send.ChannelId, groupChannelPrefix) {
+			return envelope, nil
+		}
+		teamID := strings.SplitN(strings.TrimPrefix(send.ChannelId, groupChannelPrefix), ".", 2)[0]
+
+		content, err := c.moderate(ctx, logger, nk, maintenance, userID, teamID, send.Content)
+		if err != nil {
+			return nil, err
+		}
+		send.Content = content
+		return envelope, nil
+	}
+}
+
+// rpcTeamChatMute mutes a member in team chat. Superadmins may mute admins and members, admins only members.
+func (c *TeamChatModerationConfig) rpcTeamChatMute(maintenance *TeamMaintenanceConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		var req teamChatMuteRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request payload", 3)
+		}
+		if req.TeamID == "" || req.UserID == "" {
+			return "", runtime.NewError("team_id and user_id are required", 3)
+		}
+		if req.DurationSec <= 0 || req.DurationSec > c.Mutes.MaxDurationSec {
+			return "", runtime.NewError(fmt.Sprintf("duration_sec must be between 1 and %d", c.Mutes.MaxDurationSec), 3)
+		}
+		if err := checkTeamChatModerator(ctx, nk, userID, req.TeamID, req.UserID); err != nil {
+			return "", err
+		}
+
+		mute := &TeamChatMute{UntilSec: time.Now().Unix() + req.DurationSec, MutedBy: userID, Reason: req.Reason}
+		if err := updateTeamChatMutes(ctx, nk, req.TeamID, func(mutes *TeamChatMuteList) { mutes.Mutes[req.UserID] = mute }); err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to write team chat mutes")
+			return "", err
+		}
+		maintenance.audit(ctx, logger, nk, req.TeamID, teamAuditChatMute, userID, []string{req.UserID})
+
+		response, err := json.Marshal(mute)
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+func (c *TeamChatModerationConfig) rpcTeamChatUnmute(maintenance *TeamMaintenanceConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		var req teamChatMuteRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request payload", 3)
+		}
+		if req.TeamID == "" || req.UserID == "" {
+			return "", runtime.NewError("team_id and user_id are required", 3)
+		}
+		if err := checkTeamChatModerator(ctx, nk, userID, req.TeamID, req.UserID); err != nil {
+			return "", err
+		}
+
+		if err := updateTeamChatMutes(ctx, nk, req.TeamID, func(mutes *TeamChatMuteList) { delete(mutes.Mutes, req.UserID) }); err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to write team chat mutes")
+			return "", err
+		}
+		maintenance.audit(ctx, logger, nk, req.TeamID, teamAuditChatUnmute, userID, []string{req.UserID})
+		return "{}", nil
+	}
+}
+
+// rpcTeamChatMuteList returns the team's active mutes. Only the team's admins may read it.
+func (c *TeamChatModerationConfig) rpcTeamChatMuteList(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok {
+		return "", errors.New("no user ID in context")
+	}
+
+	var req teamChatMuteRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid request payload", 3)
+	}
+	if req.TeamID == "" {
+		return "", runtime.NewError("team_id is required", 3)
+	}
+	role, member, err := teamRole(ctx, nk, userID, req.TeamID)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to list user teams")
+		return "", err
+	}
+	if !member || role > teamStateAdmin {
+		return "", runtime.NewError("only team admins can list team chat mutes", 7)
+	}
+
+	mutes, _, err := readTeamChatMutes(ctx, nk, req.TeamID)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read team chat mutes")
+		return "", err
+	}
+	response, err := json.Marshal(mutes)
+	if err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
+
+// checkTeamChatModerator allows the caller to moderate the target only when they rank above them in the team.
+func checkTeamChatModerator(ctx context.Context, nk runtime.NakamaModule, userID, teamID, targetID string) error {
+	role, member, err := teamRole(ctx, nk, userID, teamID)
+	if err != nil {
+		return err
+	}
+	if !member || role > teamStateAdmin {
+		return runtime.NewError("only team admins can mute team chat", 7)
+	}
+	targetRole, targetMember, err := teamRole(ctx, nk, targetID, teamID)
+	if err != nil {
+		return err
+	}
+	if !targetMember {
+		return runtime.NewError("user is not a team member", 5)
+	}
+	if targetRole <= role {
+		return runtime.NewError("cannot mute a team member of the same or higher role", 7)
+	}
+	return nil
+}
+
+// readTeamChatMutes returns the team's mute list without expired mutes.
+func readTeamChatMutes(ctx context.Context, nk runtime.NakamaModule, teamID string) (*TeamChatMuteList, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionTeamChatMutes, Key: teamID}})
+	if err != nil {
+		return nil, "", err
+	}
+	mutes := &TeamChatMuteList{}
+	version := "*"
+	if len(objects) > 0 {
+		if err := json.Unmarshal([]byte(objects[0].Value), mutes); err != nil {
+			return nil, "", err
+		}
+		version = objects[0].Version
+	}
+	if mutes.Mutes == nil {
+		mutes.Mutes = make(map[string]*TeamChatMute)
+	}
+	now := time.Now().Unix()
+	for userID, mute := range mutes.Mutes {
+		if mute.UntilSec <= now {
+			delete(mutes.Mutes, userID)
+		}
+	}
+	return mutes, version, nil
+}
+
+func updateTeamChatMutes(ctx context.Context, nk runtime.NakamaModule, teamID string, update func(mutes *TeamChatMuteList)) error {
+	var writeErr error
+	for attempt := 0; attempt < chatMuteWriteAttempts; attempt++ {
+		mutes, version, err := readTeamChatMutes(ctx, nk, teamID)
+		if err != nil {
+			return err
+		}
+		update(mutes)
+
+		value, err := json.Marshal(mutes)
+		if err != nil {
+			return err
+		}
+		if _, writeErr = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+			Collection:      storageCollectionTeamChatMutes,
+			Key:             teamID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}}); writeErr == nil {
+			return nil
+		}
+	}
+	return writeErr
+}
+
+// rpcTeamChatReport queues a team chat message for moderation, with a snapshot of the messages around it so the
+// report still has its context if messages are later removed.
+func (c *TeamChatModerationConfig) rpcTeamChatReport(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok {
+		return "", errors.New("no user ID in context")
+	}
+
+	var req teamChatReportRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid request payload", 3)
+	}
+	if req.TeamID == "" || req.MessageID == "" {
+		return "", runtime.NewError("team_id and message_id are required", 3)
+	}
+	if utf8.RuneCountInString(req.Reason) > c.Reports.MaxReasonLength {
+		return "", runtime.NewError(fmt.Sprintf("reason must be at most %d characters", c.Reports.MaxReasonLength), 3)
+	}
+	if _, member, err := teamRole(ctx, nk, userID, req.TeamID); err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to list user teams")
+		return "", err
+	} else if !member {
+		return "", runtime.NewError("only team members can report team chat messages", 7)
+	}
+
+	key := req.MessageID + "_" + userID
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionTeamChatReports, Key: key}})
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read team chat report")
+		return "", err
+	}
+	if len(objects) > 0 {
+		return "", runtime.NewError("message already reported", 6)
+	}
+
+	report, err := c.snapshotReport(ctx, nk, req.TeamID, req.MessageID)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to list team chat messages")
+		return "", err
+	}
+	if report == nil {
+		return "", runtime.NewError("message not found", 5)
+	}
+	report.ReporterID = userID
+	report.Reason = req.Reason
+
+	value, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionTeamChatReports,
+		Key:             key,
+		Value:           string(value),
+		Version:         "*",
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to write team chat report")
+		return "", err
+	}
+	logger.WithFields(map[string]interface{}{"team_id": req.TeamID, "message_id": req.MessageID, "reporter_id": userID}).Info("Team chat message reported")
+	return "{}", nil
+}
+
+// snapshotReport looks back through the team's chat history for the message. It returns nil if the message is not
+// within SearchMessages of the newest.
+func (c *TeamChatModerationConfig) snapshotReport(ctx context.Context, nk runtime.NakamaModule, teamID, messageID string) (*TeamChatReport, error) {
+	channelID, err := nk.ChannelIdBuild(ctx, "", teamID, runtime.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest first.
+	var messages []*api.ChannelMessage
+	cursor := ""
+	for len(messages) < c.Reports.SearchMessages {
+		page, nextCursor, _, err := nk.ChannelMessagesList(ctx, channelID, chatMessagesPageSize, false, cursor)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, page...)
+		for i := len(messages) - len(page); i < len(messages); i++ {
+			if messages[i].MessageId != messageID {
+				continue
+			}
+			// Load one more page if the older context runs past this one.
+			if i+c.Reports.ContextMessages >= len(messages) && nextCursor != "" {
+				if older, _, _, err := nk.ChannelMessagesList(ctx, channelID, chatMessagesPageSize, false, nextCursor); err == nil {
+					messages = append(messages, older...)
+				}
+			}
+			from := max(i-c.Reports.ContextMessages, 0)
+			to := min(i+c.Reports.ContextMessages+1, len(messages))
+			return &TeamChatReport{
+				TeamID:     teamID,
+				Status:     chatReportStatusOpen,
+				Message:    messages[i],
+				Context:    messages[from:to],
+				CreateTime: time.Now().Unix(),
+			}, nil
+		}
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestCheckCron(t *testing.T) {
+	for _, test := range []struct {
+		expr string
+		// err is the error checkCron returns, or "" if expr is valid.
+		err string
+	}{
+		{expr: "0 0 * * 1"},
+		{expr: "*/15 9-17 1,15 jan-jun MON-FRI"},
+		{expr: "0 0 * * 7"},
+		{expr: "@daily"},
+		{expr: "@every 1h", err: `unknown descriptor "@every 1h"`},
+		{expr: "0 0 * *", err: "want 5 fields, got 4"},
+		{expr: "60 0 * * *", err: `minute "60": 60 is outside 0-59`},
+		{expr: "0 0 0 * *", err: `day of month "0": 0 is outside 1-31`},
+		{expr: "0 0 * * 5-1", err: `day of week "5-1": range "5-1" ends before it starts`},
+		{expr: "*/0 * * * *", err: `minute "*/0": step "0" must be a positive number`},
+		{expr: "0 0 * foo *", err: `month "foo": "foo" is not a number`},
+		{expr: "0 0 1, * *", err: `day of month "1,": empty value`},
+	} {
+		err := checkCron(test.expr)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("checkCron(%q) = %q, want no error", test.expr, err.Error())
+		case test.err != "" && (err == nil || err.Error() != test.err):
+			t.Errorf("checkCron(%q) = %v, want %q", test.expr, err, test.err)
+		}
+	}
+}
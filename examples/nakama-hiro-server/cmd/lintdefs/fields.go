@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// checkFields reports every key in value that t has no field for. encoding/json silently drops them, so a misspelled
+// field is only noticed when the feature it configures doesn't work.
+func checkFields(r *reporter, path string, value any, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if reflect.PointerTo(t).Implements(jsonUnmarshalerType) {
+		return
+	}
+
+	// Values of the wrong type are reported when the file is decoded into its config type.
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return
+		}
+		fields := jsonFields(t)
+		for _, key := range sortedKeys(object) {
+			if strings.HasPrefix(key, "//") {
+				continue
+			}
+			field, found := fields[key]
+			if !found {
+				r.report(path+pathKey(key), "unknown field %q in %s", key, t.Name())
+				continue
+			}
+			checkFields(r, path+pathKey(key), object[key], field)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return
+		}
+		for _, key := range sortedKeys(object) {
+			checkFields(r, path+pathKey(key), object[key], t.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		array, ok := value.([]any)
+		if !ok {
+			return
+		}
+		for i, element := range array {
+			checkFields(r, path+"["+strconv.Itoa(i)+"]", element, t.Elem())
+		}
+	}
+}
+
+// jsonFields returns the types of the fields of struct type t by their JSON name, including the fields of embedded
+// structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && !strings.Contains(string(field.Tag), "json:") {
+			for embeddedName, embeddedType := range jsonFields(field.Type) {
+				fields[embeddedName] = embeddedType
+			}
+			continue
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// jsonName is the name encoding/json uses for field, and false if it skips the field.
+func jsonName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() && !field.Anonymous {
+		return "", false
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name, true
+	}
+	return field.Name, true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+type fieldsTestEmbedded struct {
+	Shared string `json:"shared"`
+}
+
+// fieldsTestRaw decodes itself, so its contents are not checked.
+type fieldsTestRaw struct{}
+
+func (*fieldsTestRaw) UnmarshalJSON([]byte) error { return nil }
+
+type fieldsTestConfig struct {
+	fieldsTestEmbedded
+	Name     string                       `json:"name"`
+	Children map[string]*fieldsTestConfig `json:"children"`
+	List     []*fieldsTestConfig          `json:"list"`
+	Raw      *fieldsTestRaw               `json:"raw"`
+	Skipped  string                       `json:"-"`
+	Untagged int
+}
+
+func TestCheckFields(t *testing.T) {
+	var problems []*problem
+	r := &reporter{file: "test.json", problems: &problems}
+	value, ok := decodeJSON(r, []byte(`{
+		"//name": "Comment keys are ignored.",
+		"name": "a",
+		"shared": "b",
+		"Untagged": 1,
+		"Skipped": "c",
+		"nmae": "d",
+		"children": {"e": {"name": "e", "bad": 1}},
+		"list": [{"name": "f"}, {"oops": true}],
+		"raw": {"anything": 1}
+	}`))
+	if !ok {
+		t.Fatal(problems)
+	}
+	checkFields(r, "$", value, reflect.TypeOf(&fieldsTestConfig{}))
+
+	checkProblems(t, problems, []string{
+		`test.json: $.Skipped: unknown field "Skipped" in fieldsTestConfig`,
+		`test.json: $.children.e.bad: unknown field "bad" in fieldsTestConfig`,
+		`test.json: $.list[1].oops: unknown field "oops" in fieldsTestConfig`,
+		`test.json: $.nmae: unknown field "nmae" in fieldsTestConfig`,
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strconv"
+
+	"github.com/heroiclabs/hiro"
+)
+
+// gachaTier is a rarity gacha.go's pity rolls from its own item set, such as "gacha_ticket_six_star".
+type gachaTier struct {
+	rarity    string
+	setSuffix string
+	pity      string
+}
+
+var gachaTiers = []*gachaTier{
+	{rarity: "rarityFiveStar", setSuffix: "itemSetSuffixFiveStar", pity: "propFiveStarPity"},
+	{rarity: "raritySixStar", setSuffix: "itemSetSuffixSixStar", pity: "propSixStarPity"},
+}
+
+// checkGacha checks the gacha tickets in the inventory against the constants in the gacha.go next to the definitions,
+// if there is one: the item set each pity tier rolls from has items of that rarity, pity thresholds are in order, and
+// every item a ticket can roll has a star rarity and the token its duplicates are replaced by.
+func checkGacha(file string, r *reporter, problems *[]*problem, c *catalog, inventory *hiro.InventoryConfig) {
+	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	constants, err := goConstants(file)
+	if err != nil {
+		(&reporter{file: file, problems: problems}).report("", "%s", err.Error())
+		return
+	}
+	for _, name := range []string{"categoryGachaTicket", "propStarRarity", "tokenSuffix", "rarityFiveStar", "raritySixStar", "itemSetSuffixFiveStar", "itemSetSuffixSixStar", "propFiveStarPity", "propSixStarPity"} {
+		if _, found := constants[name]; !found {
+			(&reporter{file: file, problems: problems}).report("", "constant %s not found", name)
+			return
+		}
+	}
+	starRarity := constants["propStarRarity"]
+	highestRarity, _ := strconv.ParseFloat(constants["raritySixStar"], 64)
+
+	for _, id := range sortedKeys(inventory.Items) {
+		ticket := inventory.Items[id]
+		if ticket.Category != constants["categoryGachaTicket"] {
+			continue
+		}
+		path := "$.items" + pathKey(id)
+		if ticket.ConsumeReward == nil {
+			r.report(path, "gacha ticket has no consume_reward")
+			continue
+		}
+
+		var pities []float64
+		for _, tier := range gachaTiers {
+			rarity, _ := strconv.ParseFloat(constants[tier.rarity], 64)
+			set := id + constants[tier.setSuffix]
+			if len(c.itemSets[set]) == 0 {
+				r.report(path, "item set %q, rolled by %v-star pity, has no items", set, rarity)
+			}
+			for _, itemID := range c.itemSets[set] {
+				if got := c.items[itemID].NumericProperties[starRarity]; got != rarity {
+					r.report("$.items"+pathKey(itemID)+".numeric_properties"+pathKey(starRarity), "item in %q has star rarity %v, want %v", set, got, rarity)
+				}
+			}
+			if pity, found := ticket.NumericProperties[constants[tier.pity]]; found {
+				if pity < 1 {
+					r.report(path+".numeric_properties"+pathKey(constants[tier.pity]), "pity must be at least 1, got %v", pity)
+				}
+				pities = append(pities, pity)
+			}
+		}
+		if len(pities) == len(gachaTiers) && pities[0] >= pities[1] {
+			r.report(path+".numeric_properties", "%s must be less than %s", constants["propFiveStarPity"], constants["propSixStarPity"])
+		}
+
+		// The items a pull can land on: listed directly, or in an item set.
+		pool := make(map[string]bool)
+		contents := append([]*hiro.EconomyConfigRewardContents{ticket.ConsumeReward.Guaranteed}, ticket.ConsumeReward.Weighted...)
+		for _, content := range contents {
+			if content == nil {
+				continue
+			}
+			for itemID := range content.Items {
+				pool[itemID] = true
+			}
+			for _, itemSet := range content.ItemSets {
+				for _, set := range itemSet.Set {
+					for _, itemID := range c.itemSets[set] {
+						pool[itemID] = true
+					}
+				}
+			}
+		}
+		for _, itemID := range sortedKeys(pool) {
+			item, found := c.items[itemID]
+			if !found {
+				continue
+			}
+			itemPath := "$.items" + pathKey(itemID)
+			if rarity, found := item.NumericProperties[starRarity]; !found {
+				r.report(itemPath+".numeric_properties", "%q can be pulled from %q but has no %s", itemID, id, starRarity)
+			} else if rarity > highestRarity {
+				r.report(itemPath+".numeric_properties"+pathKey(starRarity), "star rarity %v is above the highest tier %v", rarity, highestRarity)
+			}
+			if token := itemID + constants["tokenSuffix"]; c.items[token] == nil {
+				r.report(itemPath, "duplicates are replaced by %q, which is not defined", token)
+			}
+		}
+	}
+}
+
+// goConstants returns the string and number constants declared in a Go file, as their unquoted literal text.
+func goConstants(file string) (map[string]string, error) {
+	parsed, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	constants := make(map[string]string)
+	for _, decl := range parsed.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value, ok := spec.(*ast.ValueSpec)
+			if !ok || len(value.Names) != len(value.Values) {
+				continue
+			}
+			for i, name := range value.Names {
+				literal, ok := value.Values[i].(*ast.BasicLit)
+				if !ok {
+					continue
+				}
+				switch literal.Kind {
+				case token.STRING:
+					if unquoted, err := strconv.Unquote(literal.Value); err == nil {
+						constants[name.Name] = unquoted
+					}
+				case token.INT, token.FLOAT:
+					constants[name.Name] = literal.Value
+				}
+			}
+		}
+	}
+	return constants, nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/heroiclabs/hiro"
+)
+
+// hiroFiles are the Hiro definitions files and the config type each is loaded into, as hiro.Init does.
+var hiroFiles = map[string]func() any{
+	"base-achievements.json":       func() any { return &hiro.AchievementsConfig{} },
+	"base-auctions.json":           func() any { return &hiro.AuctionsConfig{} },
+	"base-challenges.json":         func() any { return &hiro.ChallengesConfig{} },
+	"base-economy.json":            func() any { return &hiro.EconomyConfig{} },
+	"base-energy.json":             func() any { return &hiro.EnergyConfig{} },
+	"base-event-leaderboards.json": func() any { return &hiro.EventLeaderboardsConfig{} },
+	"base-incentives.json":         func() any { return &hiro.IncentivesConfig{} },
+	"base-inventory.json":          func() any { return &hiro.InventoryConfig{} },
+	"base-leaderboards.json":       func() any { return &hiro.LeaderboardsConfig{} },
+	"base-progression.json":        func() any { return &hiro.ProgressionConfig{} },
+	"base-reward-mailbox.json":     func() any { return &hiro.RewardMailboxConfig{} },
+	"base-stats.json":              func() any { return &hiro.StatsConfig{} },
+	"base-streaks.json":            func() any { return &hiro.StreaksConfig{} },
+	"base-system.json":             func() any { return &hiro.BaseSystemConfig{} },
+	"base-teams.json":              func() any { return &hiro.TeamsConfig{} },
+	"base-tutorials.json":          func() any { return &hiro.TutorialsConfig{} },
+	"base-unlockables.json":        func() any { return &hiro.UnlockablesConfig{} },
+}
+
+var levelIDPattern = regexp.MustCompile(`^level_(\d+)$`)
+
+// catalog is what a definitions folder defines, for the references between its files to be checked against.
+type catalog struct {
+	currencies map[string]bool
+	items      map[string]*hiro.InventoryConfigItem
+	itemSets   map[string][]string
+}
+
+// lintFolder loads and checks every definitions file in one definitions/<env> folder.
+func lintFolder(folder string) []*problem {
+	var problems []*problem
+
+	names, err := filepath.Glob(filepath.Join(folder, "*.json"))
+	if err != nil {
+		return []*problem{{file: folder, message: err.Error()}}
+	}
+	sort.Strings(names)
+
+	configs := make(map[string]any)
+	custom := make(map[string]any)
+	for _, name := range names {
+		r := &reporter{file: name, problems: &problems}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			r.report("", "%s", err.Error())
+			continue
+		}
+		value, ok := decodeJSON(r, data)
+		if !ok {
+			continue
+		}
+
+		base := filepath.Base(name)
+		if !strings.HasPrefix(base, "base-") {
+			custom[name] = value
+			continue
+		}
+		newConfig, found := hiroFiles[base]
+		if !found {
+			r.report("", "not a Hiro definitions file, expected one of base-achievements.json, base-economy.json, ...")
+			continue
+		}
+		config := newConfig()
+		checkFields(r, "$", value, reflect.TypeOf(config))
+		if !decodeTyped(r, "$", data, config) {
+			continue
+		}
+		configs[name] = config
+	}
+
+	c := newCatalog(configs)
+	_, hasEconomy := configs[filepath.Join(folder, "base-economy.json")]
+	for _, name := range sortedKeys(configs) {
+		r := &reporter{file: name, problems: &problems}
+		c.walk(r, "$", reflect.ValueOf(configs[name]))
+		if achievements, ok := configs[name].(*hiro.AchievementsConfig); ok {
+			checkAchievements(r, achievements)
+		}
+	}
+	for _, name := range sortedKeys(custom) {
+		// Outside a Hiro server, "reward" means whatever that server's own code makes of it.
+		c.walkCustom(&reporter{file: name, problems: &problems}, "$", custom[name], hasEconomy)
+	}
+
+	server := filepath.Dir(filepath.Dir(folder))
+	if inventory, ok := configs[filepath.Join(folder, "base-inventory.json")].(*hiro.InventoryConfig); ok {
+		checkGacha(filepath.Join(server, "gacha.go"), &reporter{file: filepath.Join(folder, "base-inventory.json"), problems: &problems}, &problems, c, inventory)
+	}
+
+	return problems
+}
+
+// decodeJSON parses data into generic values, keeping numbers as written so they can be re-encoded exactly.
+func decodeJSON(r *reporter, data []byte) (any, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, column := position(data, syntaxErr.Offset)
+			r.report("", "invalid JSON at line %d column %d: %s", line, column, err.Error())
+		} else {
+			r.report("", "invalid JSON: %s", err.Error())
+		}
+		return nil, false
+	}
+	return value, true
+}
+
+// decodeTyped loads data into config, reporting a value of the wrong type at its path under root.
+func decodeTyped(r *reporter, root string, data []byte, config any) bool {
+	err := json.Unmarshal(data, config)
+	if err == nil {
+		return true
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		path := root
+		if typeErr.Field != "" {
+			path += "." + typeErr.Field
+		}
+		r.report(path, "cannot use JSON %s as %s", typeErr.Value, typeErr.Type)
+	} else {
+		r.report(root, "%s", err.Error())
+	}
+	return false
+}
+
+// position is the line and column of the byte a json.SyntaxError was found at, the last of the Offset bytes read.
+func position(data []byte, offset int64) (line, column int) {
+	line, column = 1, 1
+	for _, b := range data[:max(0, min(int(offset)-1, len(data)))] {
+		if b == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return line, column
+}
+
+// newCatalog collects the currencies, items and item sets the folder's Hiro files define. Team wallets and inventories
+// count too, since team rewards are granted from the same reward definitions.
+func newCatalog(configs map[string]any) *catalog {
+	c := &catalog{
+		currencies: make(map[string]bool),
+		items:      make(map[string]*hiro.InventoryConfigItem),
+		itemSets:   make(map[string][]string),
+	}
+	addItems := func(items map[string]*hiro.InventoryConfigItem) {
+		for id, item := range items {
+			c.items[id] = item
+		}
+	}
+	for _, config := range configs {
+		switch config := config.(type) {
+		case *hiro.EconomyConfig:
+			if config.InitializeUser != nil {
+				for id := range config.InitializeUser.Currencies {
+					c.currencies[id] = true
+				}
+			}
+		case *hiro.InventoryConfig:
+			addItems(config.Items)
+		case *hiro.TeamsConfig:
+			if config.Wallet != nil {
+				for id := range config.Wallet.Currencies {
+					c.currencies[id] = true
+				}
+			}
+			if config.Inventory != nil {
+				addItems(config.Inventory.Items)
+			}
+		}
+	}
+	for _, id := range sortedKeys(c.items) {
+		for _, set := range c.items[id].ItemSets {
+			c.itemSets[set] = append(c.itemSets[set], id)
+		}
+	}
+	return c
+}
+
+// walk checks every value inside v that refers to the rest of the folder or has rules of its own.
+func (c *catalog) walk(r *reporter, path string, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			c.walk(r, path, v.Elem())
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			c.walk(r, path+pathKey(key.String()), v.MapIndex(key))
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			c.walk(r, path+"["+strconv.Itoa(i)+"]", v.Index(i))
+		}
+	case reflect.Struct:
+		c.check(r, path, v.Interface())
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, ok := jsonName(field)
+			if !ok {
+				continue
+			}
+			if field.Anonymous && field.Type.Kind() == reflect.Struct && !strings.Contains(string(field.Tag), "json:") {
+				c.walk(r, path, v.Field(i))
+				continue
+			}
+			fieldPath := path + "." + name
+			if value := v.Field(i); value.Kind() == reflect.String {
+				if isScheduleKey(name) && value.String() != "" {
+					if err := checkCron(value.String()); err != nil {
+						r.report(fieldPath, "invalid cron expression %q: %s", value.String(), err.Error())
+					}
+				}
+				continue
+			}
+			c.walk(r, fieldPath, v.Field(i))
+		}
+	}
+}
+
+// check applies the rules of the Hiro types that have them.
+func (c *catalog) check(r *reporter, path string, value any) {
+	switch value := value.(type) {
+	case hiro.EconomyConfigReward:
+		weights := make([]int64, 0, len(value.Weighted))
+		for _, contents := range value.Weighted {
+			weights = append(weights, contents.Weight)
+		}
+		checkWeights(r, path, weights, value.TotalWeight)
+	case hiro.EconomyConfigTeamReward:
+		weights := make([]int64, 0, len(value.Weighted))
+		for _, contents := range value.Weighted {
+			weights = append(weights, contents.Weight)
+		}
+		checkWeights(r, path, weights, value.TotalWeight)
+	case hiro.EconomyConfigRewardContents:
+		c.checkContents(r, path, sortedKeys(value.Items), sortedKeys(value.Currencies), value.ItemSets)
+	case hiro.EconomyConfigTeamRewardContents:
+		c.checkContents(r, path, sortedKeys(value.Items), sortedKeys(value.Currencies), value.ItemSets)
+	case hiro.EconomyConfigRewardRangeInt64:
+		if value.Max != 0 && value.Max < value.Min {
+			r.report(path, "max %d is less than min %d", value.Max, value.Min)
+		}
+	case hiro.EconomyConfigRewardRangeInt32:
+		if value.Max != 0 && value.Max < value.Min {
+			r.report(path, "max %d is less than min %d", value.Max, value.Min)
+		}
+	case hiro.EconomyConfigStoreItemCost:
+		for _, id := range sortedKeys(value.Currencies) {
+			c.checkCurrency(r, path+".currencies"+pathKey(id), id)
+		}
+	case hiro.EconomyConfigInitializeUser:
+		for _, id := range sortedKeys(value.Items) {
+			c.checkItem(r, path+".items"+pathKey(id), id)
+		}
+	}
+}
+
+func (c *catalog) checkContents(r *reporter, path string, items, currencies []string, itemSets []*hiro.EconomyConfigRewardItemSet) {
+	for _, id := range items {
+		c.checkItem(r, path+".items"+pathKey(id), id)
+	}
+	for _, id := range currencies {
+		c.checkCurrency(r, path+".currencies"+pathKey(id), id)
+	}
+	for i, itemSet := range itemSets {
+		for j, set := range itemSet.Set {
+			if len(c.itemSets[set]) == 0 {
+				r.report(path+".item_sets["+strconv.Itoa(i)+"].set["+strconv.Itoa(j)+"]", "item set %q has no items", set)
+			}
+		}
+	}
+}
+
+func (c *catalog) checkCurrency(r *reporter, path, id string) {
+	if !c.currencies[id] {
+		r.report(path, "currency %q is not defined in the economy initialize_user or team wallet currencies", id)
+	}
+}
+
+func (c *catalog) checkItem(r *reporter, path, id string) {
+	if _, found := c.items[id]; !found {
+		r.report(path, "item %q is not defined in the inventory", id)
+	}
+}
+
+// checkWeights reports weighted contents that can never roll.
+func checkWeights(r *reporter, path string, weights []int64, totalWeight int64) {
+	var sum int64
+	for i, weight := range weights {
+		if weight <= 0 {
+			r.report(path+".weighted["+strconv.Itoa(i)+"].weight", "weight must be positive, got %d", weight)
+		}
+		sum += weight
+	}
+	if totalWeight != 0 && totalWeight < sum {
+		r.report(path+".total_weight", "total_weight %d is less than the sum of the weights %d", totalWeight, sum)
+	}
+}
+
+// checkAchievements reports preconditions on achievements that don't exist, and gaps in "level_N" sub-achievements,
+// which are advanced in order and stop at the first missing level.
+func checkAchievements(r *reporter, config *hiro.AchievementsConfig) {
+	for _, id := range sortedKeys(config.Achievements) {
+		achievement := config.Achievements[id]
+		path := "$.achievements" + pathKey(id)
+		for i, precondition := range achievement.PreconditionIDs {
+			if _, found := config.Achievements[precondition]; !found {
+				r.report(path+".precondition_ids["+strconv.Itoa(i)+"]", "achievement %q is not defined", precondition)
+			}
+		}
+
+		levels := make(map[int]bool)
+		maxLevel := 0
+		for _, subID := range sortedKeys(achievement.SubAchievements) {
+			for i, precondition := range achievement.SubAchievements[subID].PreconditionIDs {
+				if _, found := achievement.SubAchievements[precondition]; !found {
+					r.report(path+".sub_achievements"+pathKey(subID)+".precondition_ids["+strconv.Itoa(i)+"]", "sub-achievement %q is not defined in %q", precondition, id)
+				}
+			}
+			if match := levelIDPattern.FindStringSubmatch(subID); match != nil {
+				level, _ := strconv.Atoi(match[1])
+				levels[level] = true
+				maxLevel = max(maxLevel, level)
+			}
+		}
+		for level := 1; level < maxLevel; level++ {
+			if !levels[level] {
+				r.report(path+".sub_achievements", "level_%d is missing, so levels after it are never reached", level)
+			}
+		}
+	}
+}
+
+// walkCustom checks the server's own definitions files, which have no Hiro type: reward fields are loaded as Hiro
+// rewards when the folder has an economy, and schedule fields must be cron expressions.
+func (c *catalog) walkCustom(r *reporter, path string, value any, rewards bool) {
+	switch value := value.(type) {
+	case map[string]any:
+		for _, key := range sortedKeys(value) {
+			if strings.HasPrefix(key, "//") {
+				continue
+			}
+			child, childPath := value[key], path+pathKey(key)
+			if object, ok := child.(map[string]any); ok && rewards && (key == "reward" || strings.HasSuffix(key, "_reward")) {
+				c.checkCustomReward(r, childPath, object)
+				continue
+			}
+			if schedule, ok := child.(string); ok && isScheduleKey(key) && schedule != "" {
+				if err := checkCron(schedule); err != nil {
+					r.report(childPath, "invalid cron expression %q: %s", schedule, err.Error())
+				}
+				continue
+			}
+			c.walkCustom(r, childPath, child, rewards)
+		}
+	case []any:
+		for i, child := range value {
+			c.walkCustom(r, path+"["+strconv.Itoa(i)+"]", child, rewards)
+		}
+	}
+}
+
+func (c *catalog) checkCustomReward(r *reporter, path string, object map[string]any) {
+	reward := &hiro.EconomyConfigReward{}
+	checkFields(r, path, object, reflect.TypeOf(reward))
+	data, err := json.Marshal(object)
+	if err != nil {
+		r.report(path, "%s", err.Error())
+		return
+	}
+	if decodeTyped(r, path, data, reward) {
+		c.walk(r, path, reflect.ValueOf(reward))
+	}
+}
+
+func isScheduleKey(key string) bool {
+	return strings.HasSuffix(key, "schedule") || strings.HasSuffix(key, "cronexpr")
+}
+
+var plainKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// pathKey is the JSON path step to a key, quoted if it isn't a plain identifier.
+func pathKey(key string) string {
+	if plainKeyPattern.MatchString(key) {
+		return "." + key
+	}
+	return "[" + strconv.Quote(key) + "]"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/heroiclabs/hiro"
+)
+
+// checkProblems compares problems to want, in any order.
+func checkProblems(t *testing.T, problems []*problem, want []string) {
+	t.Helper()
+	got := make([]string, 0, len(problems))
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("got %d problems, want %d:\n%q\nwant:\n%q", len(got), len(want), got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("got %q, want %q", got[i], want[i])
+		}
+	}
+}
+
+func TestPathKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"shield":     ".shield",
+		"level_10":   ".level_10",
+		"daily-dash": `["daily-dash"]`,
+		"":           `[""]`,
+	} {
+		if got := pathKey(key); got != want {
+			t.Errorf("pathKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestCheckWeights(t *testing.T) {
+	var problems []*problem
+	checkWeights(&reporter{file: "test.json", problems: &problems}, "$.reward", []int64{10, 0, -1}, 5)
+
+	checkProblems(t, problems, []string{
+		"test.json: $.reward.weighted[1].weight: weight must be positive, got 0",
+		"test.json: $.reward.weighted[2].weight: weight must be positive, got -1",
+		"test.json: $.reward.total_weight: total_weight 5 is less than the sum of the weights 9",
+	})
+}
+
+func TestCheckAchievements(t *testing.T) {
+	var problems []*problem
+	checkAchievements(&reporter{file: "test.json", problems: &problems}, &hiro.AchievementsConfig{
+		Achievements: map[string]*hiro.AchievementsConfigAchievement{
+			"first": {},
+			"second": {
+				PreconditionIDs: []string{"first", "missing"},
+				SubAchievements: map[string]*hiro.AchievementsConfigSubAchievement{
+					"level_1": {},
+					"level_3": {PreconditionIDs: []string{"level_1", "level_9"}},
+					"level_4": {},
+				},
+			},
+		},
+	})
+
+	checkProblems(t, problems, []string{
+		`test.json: $.achievements.second.precondition_ids[1]: achievement "missing" is not defined`,
+		`test.json: $.achievements.second.sub_achievements.level_3.precondition_ids[1]: sub-achievement "level_9" is not defined in "second"`,
+		"test.json: $.achievements.second.sub_achievements: level_2 is missing, so levels after it are never reached",
+	})
+}
+
+func TestLintFolder(t *testing.T) {
+	folder := filepath.Join(t.TempDir(), "definitions", "dev1")
+	if err := os.MkdirAll(folder, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"base-economy.json": `{
+			"initialize_user": {"currencies": {"coins": 100}, "items": {"sword": 1, "ghost": 1}}
+		}`,
+		"base-inventory.json": `{
+			"items": {"sword": {"category": "weapon", "catgory": "weapon", "item_sets": ["weapons"]}}
+		}`,
+		"base-unknown.json": `{}`,
+		"rewards.json": `{
+			"//daily_reward": "Custom files are checked too.",
+			"daily_reward": {"guaranteed": {
+				"currencies": {"coins": {"min": 1}, "gems": {"min": 1}},
+				"item_sets": [{"set": ["weapons"], "min": 1}, {"set": ["armour"], "min": 1}]
+			}},
+			"reset_schedule": "0 25 * * *"
+		}`,
+		"broken.json": "{\n\t\"a\": 1,\n}",
+	} {
+		if err := os.WriteFile(filepath.Join(folder, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file := func(name string) string {
+		return filepath.Join(folder, name)
+	}
+	checkProblems(t, lintFolder(folder), []string{
+		file("base-economy.json") + `: $.initialize_user.items.ghost: item "ghost" is not defined in the inventory`,
+		file("base-inventory.json") + `: $.items.sword.catgory: unknown field "catgory" in InventoryConfigItem`,
+		file("base-unknown.json") + ": not a Hiro definitions file, expected one of base-achievements.json, base-economy.json, ...",
+		file("broken.json") + ": invalid JSON at line 3 column 1: invalid character '}' looking for beginning of object key string",
+		file("rewards.json") + `: $.daily_reward.guaranteed.currencies.gems: currency "gems" is not defined in the economy initialize_user or team wallet currencies`,
+		file("rewards.json") + `: $.daily_reward.guaranteed.item_sets[1].set[0]: item set "armour" has no items`,
+		file("rewards.json") + `: $.reset_schedule: invalid cron expression "0 25 * * *": hour "25": 25 is outside 0-23`,
+	})
+}
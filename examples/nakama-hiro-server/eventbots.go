@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// System-owned objects: the bots of each cohort keyed by cohort ID, and the final real scores of finished cohorts
+	// keyed by event leaderboard and tier, which new bots calibrate their scores from.
+	storageCollectionEventBots         = "event_leaderboard_bots"
+	storageCollectionEventScoreSamples = "event_leaderboard_score_samples"
+
+	botCurveLinear  = "linear"
+	botCurveEaseIn  = "ease_in"
+	botCurveEaseOut = "ease_out"
+	botCurveSCurve  = "s_curve"
+
+	eventBotsWriteAttempts = 3
+)
+
+// EventBotsConfig is the shape of definitions/<env>/event-leaderboard-bots.json.
+//
+// Bots never enter Hiro's cohorts. They are added to the cohort as players see it, so rewards and tier changes are
+// always decided by the ranks among real players only. Only descending event leaderboards are filled.
+type EventBotsConfig struct {
+	EventLeaderboards map[string]*EventBotsConfigLeaderboard `json:"event_leaderboards"`
+}
+
+type EventBotsConfigLeaderboard struct {
+	// Bots are added once no new player has joined the cohort for IdleSec, if it has at least MinRealPlayers.
+	IdleSec        int64 `json:"idle_sec"`
+	MinRealPlayers int   `json:"min_real_players"`
+	// FillTo is how many entrants the cohort is filled up to, never more than the cohort's maximum size.
+	FillTo int `json:"fill_to"`
+	// Curves are weighted, one is picked per bot. Each shapes how the bot's score grows from zero at the start of the
+	// event to its target at the end: "linear", "ease_in", "ease_out" or "s_curve".
+	Curves map[string]int `json:"curves"`
+	// UpdateIntervalSec is how often bot scores appear to change, each bot at its own offset.
+	UpdateIntervalSec int64 `json:"update_interval_sec"`
+	// OutrankTopPlayer lets bots score above the best real player in the cohort.
+	OutrankTopPlayer bool `json:"outrank_top_player"`
+	// Targets are drawn from the final real scores of finished cohorts of the same tier, varied by up to
+	// ScoreVariance either way. Until MinSamples are recorded, DefaultScores is used instead.
+	ScoreVariance float64          `json:"score_variance"`
+	MinSamples    int              `json:"min_samples"`
+	MaxSamples    int              `json:"max_samples"`
+	DefaultScores *EventBotsScores `json:"default_scores"`
+	Usernames     []string         `json:"usernames"`
+}
+
+type EventBotsScores struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+}
+
+type EventBot struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Target   int64  `json:"target"`
+	Curve    string `json:"curve"`
+	// OffsetSec staggers the bot's score updates against the others.
+	OffsetSec int64 `json:"offset_sec"`
+}
+
+type EventCohortBots struct {
+	EventLeaderboardID string `json:"event_leaderboard_id"`
+	// RealCount is the number of real players last seen in the cohort, and LastJoinSec when it last changed.
+	RealCount   int64       `json:"real_count"`
+	LastJoinSec int64       `json:"last_join_sec"`
+	Bots        []*EventBot `json:"bots"`
+	// Sampled is set once the cohort's final real scores are recorded.
+	Sampled bool `json:"sampled"`
+}
+
+type EventScoreSamples struct {
+	Scores []int64 `json:"scores"`
+}
+
+func (c *EventBotsConfig) Validate() error {
+	var errs []error
+	for id, leaderboard := range c.EventLeaderboards {
+		if leaderboard.IdleSec <= 0 || leaderboard.FillTo <= 0 || leaderboard.UpdateIntervalSec <= 0 {
+			errs = append(errs, fmt.Errorf("event leaderboard %q: idle_sec, fill_to and update_interval_sec must be positive", id))
+		}
+		if len(leaderboard.Curves) == 0 {
+			errs = append(errs, fmt.Errorf("event leaderboard %q: at least one curve is required", id))
+		}
+		for curve, weight := range leaderboard.Curves {
+			switch curve {
+			case botCurveLinear, botCurveEaseIn, botCurveEaseOut, botCurveSCurve:
+			default:
+				errs = append(errs, fmt.Errorf("event leaderboard %q: curve must be one of linear, ease_in, ease_out, s_curve, got %q", id, curve))
+			}
+			if weight <= 0 {
+				errs = append(errs, fmt.Errorf("event leaderboard %q: curve %q weight must be positive", id, curve))
+			}
+		}
+		if leaderboard.ScoreVariance < 0 || leaderboard.ScoreVariance >= 1 {
+			errs = append(errs, fmt.Errorf("event leaderboard %q: score_variance must be at least 0 and below 1", id))
+		}
+		if leaderboard.MinSamples < 0 || leaderboard.MaxSamples < leaderboard.MinSamples {
+			errs = append(errs, fmt.Errorf("event leaderboard %q: max_samples must be at least min_samples", id))
+		}
+		if scores := leaderboard.DefaultScores; scores == nil || scores.Min < 0 || scores.Max < scores.Min {
+			errs = append(errs, fmt.Errorf("event leaderboard %q: default_scores must have 0 <= min <= max", id))
+		}
+		if len(leaderboard.Usernames) == 0 {
+			errs = append(errs, fmt.Errorf("event leaderboard %q: at least one username is required", id))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Register replaces Hiro's event leaderboard list, get, update and claim RPCs with ones that add bots to the cohort in
+// their responses.
+func (c *EventBotsConfig) Register(initializer runtime.Initializer, systems hiro.Hiro) error {
+	eventLeaderboardsSystem := systems.GetEventLeaderboardsSystem()
+	if eventLeaderboardsSystem == nil || len(c.EventLeaderboards) == 0 {
+		return nil
+	}
+
+	rpcs := map[hiro.RpcId]func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error){
+		hiro.RpcId_RPC_ID_EVENT_LEADERBOARD_LIST:   c.rpcEventLeaderboardList(eventLeaderboardsSystem),
+		hiro.RpcId_RPC_ID_EVENT_LEADERBOARD_GET:    c.rpcEventLeaderboardGet(eventLeaderboardsSystem),
+		hiro.RpcId_RPC_ID_EVENT_LEADERBOARD_UPDATE: c.rpcEventLeaderboardUpdate(eventLeaderboardsSystem),
+		hiro.RpcId_RPC_ID_EVENT_LEADERBOARD_CLAIM:  c.rpcEventLeaderboardClaim(eventLeaderboardsSystem),
+	}
+	for id, fn := range rpcs {
+		if err := hiro.UnregisterRpc(initializer, id); err != nil {
+			return err
+		}
+		if err := initializer.RegisterRpc(id.String(), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fill adds the cohort's bots to the event leaderboard in place. Failures are logged and leave the cohort as Hiro
+// returned it.
+func (c *EventBotsConfig) fill(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, eventLeaderboard *hiro.EventLeaderboard, claimed bool) {
+	config, found := c.EventLeaderboards[eventLeaderboard.GetId()]
+	if !found || eventLeaderboard.GetCohortId() == "" || eventLeaderboard.GetAscending() {
+		return
+	}
+	logger = logger.WithFields(map[string]interface{}{"event_leaderboard": eventLeaderboard.Id, "cohort_id": eventLeaderboard.CohortId})
+
+	cohort, err := c.updateCohortBots(ctx, nk, config, eventLeaderboard)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to update event leaderboard bots")
+		return
+	}
+	if claimed && !cohort.Sampled {
+		if err := c.sample(ctx, nk, config, eventLeaderboard); err != nil {
+			logger.WithField("error", err.Error()).Warn("Failed to record event leaderboard score samples")
+		}
+	}
+	if len(cohort.Bots) == 0 {
+		return
+	}
+
+	var topReal int64
+	for _, score := range eventLeaderboard.Scores {
+		topReal = max(topReal, score.Score)
+	}
+	now := min(time.Now().Unix(), eventLeaderboard.EndTimeSec)
+	for _, bot := range cohort.Bots {
+		score := bot.score(config, eventLeaderboard.StartTimeSec, eventLeaderboard.EndTimeSec, now)
+		if !config.OutrankTopPlayer {
+			score = min(score, topReal)
+		}
+		eventLeaderboard.Scores = append(eventLeaderboard.Scores, &hiro.EventLeaderboardScore{
+			Id:            bot.ID,
+			Username:      bot.Username,
+			CreateTimeSec: eventLeaderboard.StartTimeSec + bot.OffsetSec,
+			UpdateTimeSec: now,
+			Score:         score,
+			NumScores:     max((now-eventLeaderboard.StartTimeSec-bot.OffsetSec)/config.UpdateIntervalSec, 1),
+		})
+	}
+	eventLeaderboard.Count += int64(len(cohort.Bots))
+
+	// Real players win ties, so bots capped at the top real score still rank below them.
+	bots := make(map[string]bool, len(cohort.Bots))
+	for _, bot := range cohort.Bots {
+		bots[bot.ID] = true
+	}
+	sort.SliceStable(eventLeaderboard.Scores, func(i, j int) bool {
+		a, b := eventLeaderboard.Scores[i], eventLeaderboard.Scores[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return !bots[a.Id] && bots[b.Id]
+	})
+	for i, score := range eventLeaderboard.Scores {
+		score.Rank = int64(i + 1)
+	}
+}
+
+// updateCohortBots records when real players last joined the cohort, and adds bots once it has been idle long enough.
+func (c *EventBotsConfig) updateCohortBots(ctx context.Context, nk runtime.NakamaModule, config *EventBotsConfigLeaderboard, eventLeaderboard *hiro.EventLeaderboard) (*EventCohortBots, error) {
+	var writeErr error
+	for attempt := 0; attempt < eventBotsWriteAttempts; attempt++ {
+		objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionEventBots, Key: eventLeaderboard.CohortId}})
+		if err != nil {
+			return nil, err
+		}
+		cohort := &EventCohortBots{EventLeaderboardID: eventLeaderboard.Id}
+		version := "*"
+		if len(objects) > 0 {
+			if err := json.Unmarshal([]byte(objects[0].Value), cohort); err != nil {
+				return nil, err
+			}
+			version = objects[0].Version
+		}
+
+		now := time.Now().Unix()
+		changed := false
+		if cohort.RealCount != eventLeaderboard.Count {
+			cohort.RealCount = eventLeaderboard.Count
+			cohort.LastJoinSec = now
+			changed = true
+		}
+		fillTo := int64(config.FillTo)
+		if eventLeaderboard.MaxCount > 0 {
+			fillTo = min(fillTo, eventLeaderboard.MaxCount)
+		}
+		if len(cohort.Bots) == 0 && now < eventLeaderboard.EndTimeSec && now-cohort.LastJoinSec >= config.IdleSec &&
+			cohort.RealCount >= int64(config.MinRealPlayers) && cohort.RealCount < fillTo {
+			if cohort.Bots, err = c.newBots(ctx, nk, config, eventLeaderboard, int(fillTo-cohort.RealCount)); err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+		if !changed {
+			return cohort, nil
+		}
+
+		value, err := json.Marshal(cohort)
+		if err != nil {
+			return nil, err
+		}
+		if _, writeErr = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+			Collection:      storageCollectionEventBots,
+			Key:             eventLeaderboard.CohortId,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}}); writeErr == nil {
+			return cohort, nil
+		}
+	}
+	return nil, writeErr
+}
+
+func (c *EventBotsConfig) newBots(ctx context.Context, nk runtime.NakamaModule, config *EventBotsConfigLeaderboard, eventLeaderboard *hiro.EventLeaderboard, count int) ([]*EventBot, error) {
+	samples, _, err := readEventScoreSamples(ctx, nk, eventLeaderboard.Id, eventLeaderboard.Tier)
+	if err != nil {
+		return nil, err
+	}
+
+	var curves []string
+	var totalWeight int
+	for curve, weight := range config.Curves {
+		curves = append(curves, curve)
+		totalWeight += weight
+	}
+	sort.Strings(curves)
+
+	usernames := rand.Perm(len(config.Usernames))
+	bots := make([]*EventBot, 0, count)
+	for i := 0; i < count; i++ {
+		id, err := newRandomID()
+		if err != nil {
+			return nil, err
+		}
+
+		var target int64
+		if len(samples.Scores) >= config.MinSamples && len(samples.Scores) > 0 {
+			target = samples.Scores[rand.Intn(len(samples.Scores))]
+		} else {
+			target = config.DefaultScores.Min + rand.Int63n(config.DefaultScores.Max-config.DefaultScores.Min+1)
+		}
+		target = int64(math.Round(float64(target) * (1 + config.ScoreVariance*(2*rand.Float64()-1))))
+
+		var curve string
+		roll := rand.Intn(totalWeight)
+		for _, curve = range curves {
+			if roll -= config.Curves[curve]; roll < 0 {
+				break
+			}
+		}
+
+		// Usernames repeat with a number once every one is taken.
+		username := config.Usernames[usernames[i%len(usernames)]]
+		if i >= len(usernames) {
+			username = fmt.Sprintf("%s%d", username, 10+rand.Intn(90))
+		}
+
+		bots = append(bots, &EventBot{
+			// Shaped like a user ID so bots are not told apart from players by it.
+			ID:        fmt.Sprintf("%s-%s-%s-%s-%s", id[0:8], id[8:12], id[12:16], id[16:20], id[20:32]),
+			Username:  username,
+			Target:    max(target, 0),
+			Curve:     curve,
+			OffsetSec: rand.Int63n(config.UpdateIntervalSec),
+		})
+	}
+	return bots, nil
+}
+
+// score is the bot's score at now, on its curve from zero at the start of the event to its target at the end, changing
+// only every update interval.
+func (b *EventBot) score(config *EventBotsConfigLeaderboard, startSec, endSec, now int64) int64 {
+	if endSec <= startSec {
+		return b.Target
+	}
+	elapsed := now - startSec - b.OffsetSec
+	if elapsed < 0 {
+		return 0
+	}
+	elapsed -= elapsed % config.UpdateIntervalSec
+	progress := math.Min(float64(elapsed+b.OffsetSec)/float64(endSec-startSec), 1)
+
+	switch b.Curve {
+	case botCurveEaseIn:
+		progress = progress * progress
+	case botCurveEaseOut:
+		progress = 1 - (1-progress)*(1-progress)
+	case botCurveSCurve:
+		progress = progress * progress * (3 - 2*progress)
+	}
+	return int64(math.Round(float64(b.Target) * progress))
+}
+
+// sample records the real players' final scores of a finished cohort, once per cohort, keeping the newest MaxSamples
+// per tier.
+func (c *EventBotsConfig) sample(ctx context.Context, nk runtime.NakamaModule, config *EventBotsConfigLeaderboard, eventLeaderboard *hiro.EventLeaderboard) error {
+	var scores []int64
+	for _, score := range eventLeaderboard.Scores {
+		if score.Score > 0 {
+			scores = append(scores, score.Score)
+		}
+	}
+
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionEventBots, Key: eventLeaderboard.CohortId}})
+	if err != nil || len(objects) == 0 {
+		return err
+	}
+	cohort := &EventCohortBots{}
+	if err := json.Unmarshal([]byte(objects[0].Value), cohort); err != nil {
+		return err
+	}
+	if cohort.Sampled {
+		return nil
+	}
+	cohort.Sampled = true
+	cohortValue, err := json.Marshal(cohort)
+	if err != nil {
+		return err
+	}
+
+	samples, version, err := readEventScoreSamples(ctx, nk, eventLeaderboard.Id, eventLeaderboard.Tier)
+	if err != nil {
+		return err
+	}
+	samples.Scores = append(samples.Scores, scores...)
+	if len(samples.Scores) > config.MaxSamples {
+		samples.Scores = samples.Scores[len(samples.Scores)-config.MaxSamples:]
+	}
+	samplesValue, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+
+	// Both or neither, so a cohort is never sampled twice.
+	_, err = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionEventBots,
+		Key:             eventLeaderboard.CohortId,
+		Value:           string(cohortValue),
+		Version:         objects[0].Version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}, {
+		Collection:      storageCollectionEventScoreSamples,
+		Key:             fmt.Sprintf("%s_%d", eventLeaderboard.Id, eventLeaderboard.Tier),
+		Value:           string(samplesValue),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+func readEventScoreSamples(ctx context.Context, nk runtime.NakamaModule, eventLeaderboardID string, tier int32) (*EventScoreSamples, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionEventScoreSamples, Key: fmt.Sprintf("%s_%d", eventLeaderboardID, tier)}})
+	if err != nil {
+		return nil, "", err
+	}
+	samples := &EventScoreSamples{}
+	if len(objects) == 0 {
+		return samples, "*", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), samples); err != nil {
+		return nil, "", err
+	}
+	return samples, objects[0].Version, nil
+}
+
+func (c *EventBotsConfig) rpcEventLeaderboardList(system hiro.EventLeaderboardsSystem) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		request := &hiro.EventLeaderboardList{}
+		if err := protojson.Unmarshal([]byte(payload), request); err != nil {
+			return "", err
+		}
+		eventLeaderboards, err := system.ListEventLeaderboard(ctx, logger, nk, userID, request.WithScores, request.Categories)
+		if err != nil {
+			return "", err
+		}
+		if request.WithScores {
+			for _, eventLeaderboard := range eventLeaderboards {
+				c.fill(ctx, logger, nk, eventLeaderboard, false)
+			}
+		}
+
+		response, err := protojson.Marshal(&hiro.EventLeaderboards{EventLeaderboards: eventLeaderboards})
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+func (c *EventBotsConfig) rpcEventLeaderboardGet(system hiro.EventLeaderboardsSystem) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		request := &hiro.EventLeaderboardGet{}
+		if err := protojson.Unmarshal([]byte(payload), request); err != nil {
+			return "", err
+		}
+		eventLeaderboard, err := system.GetEventLeaderboard(ctx, logger, nk, userID, request.Id)
+		if err != nil {
+			return "", err
+		}
+		c.fill(ctx, logger, nk, eventLeaderboard, false)
+
+		response, err := protojson.Marshal(eventLeaderboard)
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+func (c *EventBotsConfig) rpcEventLeaderboardUpdate(system hiro.EventLeaderboardsSystem) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+		username, _ := ctx.Value(runtime.RUNTIME_CTX_USERNAME).(string)
+
+		request := &hiro.EventLeaderboardUpdate{}
+		if err := protojson.Unmarshal([]byte(payload), request); err != nil {
+			return "", err
+		}
+		var metadata map[string]interface{}
+		if request.Metadata != "" {
+			if err := json.Unmarshal([]byte(request.Metadata), &metadata); err != nil {
+				return "", runtime.NewError("invalid metadata", 3)
+			}
+		}
+		eventLeaderboard, err := system.UpdateEventLeaderboard(ctx, logger, db, nk, userID, username, request.Id, request.Score, request.Subscore, metadata, request.ConditionalMetadataUpdate)
+		if err != nil {
+			return "", err
+		}
+		c.fill(ctx, logger, nk, eventLeaderboard, false)
+
+		response, err := protojson.Marshal(eventLeaderboard)
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+func (c *EventBotsConfig) rpcEventLeaderboardClaim(system hiro.EventLeaderboardsSystem) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		request := &hiro.EventLeaderboardClaim{}
+		if err := protojson.Unmarshal([]byte(payload), request); err != nil {
+			return "", err
+		}
+		eventLeaderboard, err := system.ClaimEventLeaderboard(ctx, logger, nk, userID, request.Id)
+		if err != nil {
+			return "", err
+		}
+		// The claimed cohort has finished, so its real scores calibrate future bots of the same tier.
+		c.fill(ctx, logger, nk, eventLeaderboard, true)
+
+		response, err := protojson.Marshal(eventLeaderboard)
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
@@ -18,12 +18,12 @@ import (
 func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, initializer runtime.Initializer) error {
 	err := createTournament(ctx, logger, nk, "daily-dash", "0 12 * * *", "Daily Dash", "Dash past your opponents for high scores and big rewards!", 86400, 0, 1, false)
 	if err != nil {
-		// Handle error.
+		return err
 	}
 
 	err = createTournament(ctx, logger, nk, "limited-dash", "0 * * * *", "Limited Dash", "Limited spaces available, join now!", 3600, 10000, 3, true)
 	if err != nil {
-		// Handle error.
+		return err
 	}
 
 	initStart := time.Now()
@@ -64,57 +64,195 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
 		hiro.WithBaseSystem(fmt.Sprintf("definitions/%s/base-system.json", env), true),
 		hiro.WithLeaderboardsSystem(fmt.Sprintf("definitions/%s/base-leaderboards.json", env), true),
 		hiro.WithChallengesSystem(fmt.Sprintf("definitions/%s/base-challenges.json", env), true),
+		hiro.WithStatsSystem(fmt.Sprintf("definitions/%s/base-stats.json", env), true),
 		hiro.WithEconomySystem(fmt.Sprintf("definitions/%s/base-economy.json", env), true),
 		hiro.WithEventLeaderboardsSystem(fmt.Sprintf("definitions/%s/base-event-leaderboards.json", env), true),
 		hiro.WithTeamsSystem(fmt.Sprintf("definitions/%s/base-teams.json", env), true),
 		hiro.WithAchievementsSystem(fmt.Sprintf("definitions/%s/base-achievements.json", env), true),
-		hiro.WithInventorySystem(fmt.Sprintf("definitions/%s/base-inventory.json", env), true))
+		hiro.WithInventorySystem(fmt.Sprintf("definitions/%s/base-inventory.json", env), true),
+		hiro.WithRewardMailboxSystem(fmt.Sprintf("definitions/%s/base-reward-mailbox.json", env), true))
 	if err != nil {
 		return err
 	}
 
-	// Activity calculator for Teams
-	// For simplicity, member count is a proxy for team activity - more members = more active team
+	// Definitions uploaded by a server are previewed as a diff, then applied over the files above without a restart.
+	reloadConfig := &DefinitionsReloadConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/definitions-reload.json", env), reloadConfig); err != nil {
+		return err
+	}
+	if err := reloadConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid definitions reload: %w", err)
+	}
+	if err := reloadConfig.Register(logger, initializer, systems); err != nil {
+		return err
+	}
+
+	// Team activity is aggregated from decaying per-player scores, fed by sessions, gifts, event scores and team chat.
+	activityConfig := &TeamActivityConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/team-activity.json", env), activityConfig); err != nil {
+		return err
+	}
+	if err := activityConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid team activity: %w", err)
+	}
+	if err := activityConfig.Register(initializer, nk, systems); err != nil {
+		return err
+	}
+	logger.Info("Teams activity calculator registered")
+
+	// Inactive members are warned then kicked, and inactive owners replaced, by a job that checks every team.
+	maintenanceConfig := &TeamMaintenanceConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/team-maintenance.json", env), maintenanceConfig); err != nil {
+		return err
+	}
+	if err := maintenanceConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid team maintenance: %w", err)
+	}
+	if err := maintenanceConfig.Register(logger, nk, initializer, activityConfig); err != nil {
+		return err
+	}
+
+	// Team chat is filtered, rate limited and checked against mutes before it is sent, and can be reported.
+	chatModerationConfig := &TeamChatModerationConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/team-chat-moderation.json", env), chatModerationConfig); err != nil {
+		return err
+	}
+	if err := chatModerationConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid team chat moderation: %w", err)
+	}
+	if err := chatModerationConfig.Register(initializer, systems, maintenanceConfig, activityConfig); err != nil {
+		return err
+	}
+
+	// Team milestone rewards are granted once per team when a stat update first reaches them.
+	milestonesConfig := &TeamMilestonesConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/team-milestones.json", env), milestonesConfig); err != nil {
+		return err
+	}
+	if err := milestonesConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid team milestones: %w", err)
+	}
+
+	// Clients may only update team stats within these rules, server-only stats are updated from game events.
+	statRulesConfig := &TeamStatRulesConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/team-stat-rules.json", env), statRulesConfig); err != nil {
+		return err
+	}
+	if err := statRulesConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid team stat rules: %w", err)
+	}
 	if teamsSystem := systems.GetTeamsSystem(); teamsSystem != nil {
-		teamsSystem.SetActivityCalculator(calculateTeamActivity)
-		logger.Info("Teams activity calculator registered")
+		teamsSystem.SetOnEventLeaderboardsReward(statRulesConfig.onEventLeaderboardReward(systems, milestonesConfig))
 	}
 
-	// Unregister the default team stats update RPC and replace with custom version that triggers achievements
+	// Unregister the default team stats update RPC and replace with custom version that validates updates and grants
+	// milestone rewards
 	if err := hiro.UnregisterRpc(initializer, hiro.RpcId_RPC_ID_TEAMS_STATS_UPDATE); err != nil {
 		return err
 	}
 	if err := initializer.RegisterRpc(
 		hiro.RpcId_RPC_ID_TEAMS_STATS_UPDATE.String(),
-		rpcTeamStatsUpdateWithMailboxRewardGrant(systems),
+		rpcTeamStatsUpdateWithMilestoneRewards(systems, statRulesConfig, milestonesConfig),
 	); err != nil {
 		return err
 	}
-	logger.Info("Custom team stats update RPC registered with achievement triggers")
+	logger.Info("Custom team stats update RPC registered with stat rules and milestone rewards")
 
-	logger.Info("Module loaded in %dms", time.Since(initStart).Milliseconds())
+	// Grant tournament prizes into the reward mailbox when each tournament window closes.
+	prizesConfig := &TournamentPrizesConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/tournament-prizes.json", env), prizesConfig); err != nil {
+		return err
+	}
+	if err := prizesConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid tournament prizes: %w", err)
+	}
+	if err := initializer.RegisterTournamentEnd(tournamentPrizeHandler(systems, prizesConfig)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterTournamentReset(tournamentPrizeHandler(systems, prizesConfig)); err != nil {
+		return err
+	}
+	// Operators settle prize claims left pending by a node stopping between the claim and the grant.
+	if err := initializer.RegisterRpc("rpc_tournament_payouts_pending", rpcTournamentPayoutsPending()); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_tournament_payouts_resolve", rpcTournamentPayoutsResolve(systems, prizesConfig)); err != nil {
+		return err
+	}
 
-	return nil
-}
+	// Idle event leaderboard cohorts are filled with bots, which players see but rewards and tier changes ignore.
+	eventBotsConfig := &EventBotsConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/event-leaderboard-bots.json", env), eventBotsConfig); err != nil {
+		return err
+	}
+	if err := eventBotsConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid event leaderboard bots: %w", err)
+	}
+	if err := eventBotsConfig.Register(initializer, systems); err != nil {
+		return err
+	}
 
-func calculateTeamActivity(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, team *hiro.Team) int64 {
-	if team == nil {
-		return 0
+	// Quick match finds or creates an open challenge for the player's skill band.
+	quickMatchConfig := &ChallengeQuickMatchConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/challenge-quick-match.json", env), quickMatchConfig); err != nil {
+		return err
+	}
+	if err := quickMatchConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid challenge quick match: %w", err)
+	}
+	if err := initializer.RegisterRpc("rpc_challenge_quick_match", quickMatchConfig.rpcChallengeQuickMatch(systems)); err != nil {
+		return err
 	}
 
-	return int64(len(team.Members))
+	// Authoritative leaderboards and tournaments only accept scores through these RPCs, which validate them first.
+	scoreRulesConfig := &ScoreRulesConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/score-rules.json", env), scoreRulesConfig); err != nil {
+		return err
+	}
+	if err := scoreRulesConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid score rules: %w", err)
+	}
+	if err := scoreRulesConfig.checkAuthoritative(ctx, nk); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_score_run_start", rpcScoreRunStart(scoreRulesConfig)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_score_submit", rpcScoreSubmit(scoreRulesConfig)); err != nil {
+		return err
+	}
+
+	logger.Info("Module loaded in %dms", time.Since(initStart).Milliseconds())
+
+	return nil
 }
 
+// createTournament creates the tournament if it doesn't exist. Creating an existing tournament does nothing, so one
+// left over from before scores were validated, and not authoritative, is deleted and recreated. Its current records are
+// lost, which for these short repeating tournaments costs at most one round.
 func createTournament(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, id, resetSchedule, title, description string, duration, maxSize, maxNumScore int, joinRequired bool) error {
-	authoritative := false // true by default
-	sortOrder := "desc"    // one of: "desc", "asc"
-	operator := "best"     // one of: "best", "set", "incr"
+	existing, err := nk.TournamentsGetId(ctx, []string{id})
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to get tournament")
+		return err
+	}
+	if len(existing) > 0 && !existing[0].Authoritative {
+		logger.Warn("Recreating tournament %q as authoritative", id)
+		if err := nk.TournamentDelete(ctx, id); err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to delete tournament")
+			return err
+		}
+	}
+
+	authoritative := true // scores are submitted through rpc_score_submit
+	sortOrder := "desc"   // one of: "desc", "asc"
+	operator := "best"    // one of: "best", "set", "incr"
 	metadata := map[string]interface{}{}
 	category := 1
 	startTime := int(time.Now().UTC().Unix()) // start now
 	endTime := 0                              // never end, repeat the tournament forever
 	enableRanks := true                       // ranks are enabled
-	err := nk.TournamentCreate(ctx, id, authoritative, sortOrder, operator, resetSchedule, metadata, title, description, category, startTime, endTime, duration, maxSize, maxNumScore, joinRequired, enableRanks)
+	err = nk.TournamentCreate(ctx, id, authoritative, sortOrder, operator, resetSchedule, metadata, title, description, category, startTime, endTime, duration, maxSize, maxNumScore, joinRequired, enableRanks)
 	if err != nil {
 		logger.Debug("unable to create tournament: %q", err.Error())
 		return runtime.NewError("failed to create tournament", 3)
@@ -122,7 +260,7 @@ func createTournament(ctx context.Context, logger runtime.Logger, nk runtime.Nak
 	return nil
 }
 
-func rpcTeamStatsUpdateWithMailboxRewardGrant(systems hiro.Hiro) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+func rpcTeamStatsUpdateWithMilestoneRewards(systems hiro.Hiro, rules *TeamStatRulesConfig, milestones *TeamMilestonesConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
 		if !ok {
@@ -134,6 +272,11 @@ func rpcTeamStatsUpdateWithMailboxRewardGrant(systems hiro.Hiro) func(ctx contex
 			return "", err
 		}
 
+		// Reject the whole update if any of it breaks the stat rules.
+		if err := rules.checkTeamStatsUpdate(ctx, logger, nk, systems, userID, request); err != nil {
+			return "", err
+		}
+
 		teamsSystem := systems.GetTeamsSystem()
 
 		// Call the actual stats update
@@ -142,25 +285,10 @@ func rpcTeamStatsUpdateWithMailboxRewardGrant(systems hiro.Hiro) func(ctx contex
 			return "", err
 		}
 
-		// Grant rewards to mailbox when level milestones are hit
-		if levelStat, ok := statList.Public["level"]; ok {
-			var reward *hiro.Reward
-
-			switch levelStat.Value {
-			case 2:
-				reward = &hiro.Reward{Currencies: map[string]int64{"team_coins": 50}}
-			case 5:
-				reward = &hiro.Reward{Currencies: map[string]int64{"team_coins": 100}}
-			case 10:
-				reward = &hiro.Reward{Currencies: map[string]int64{"team_coins": 200}}
-			}
-
-			if reward != nil {
-				_, err := teamsSystem.RewardMailboxGrant(ctx, logger, nk, userID, request.Id, reward)
-				if err != nil {
-					logger.Warn("Failed to grant level milestone reward: %v", err)
-				}
-			}
+		// Grant rewards for any milestones the update reached. The stats are already saved, so a failed grant is logged
+		// rather than failing the update; what was not granted is retried on a later update.
+		if err := milestones.Grant(ctx, logger, nk, systems, userID, request.Id, statList); err != nil {
+			logger.WithField("error", err.Error()).Warn("Failed to grant team milestone rewards")
 		}
 
 		response, err := protojson.Marshal(statList)
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// System-owned objects keyed by team ID: the team's audit log, and the members warned about inactivity.
+	storageCollectionTeamAudit       = "team_audit"
+	storageCollectionTeamMaintenance = "team_maintenance"
+
+	teamAuditInactiveWarning   = "inactive_warning"
+	teamAuditInactiveKick      = "inactive_kick"
+	teamAuditSuccessionWarning = "owner_succession_warning"
+	teamAuditSuccession        = "owner_succession"
+
+	teamStateSuperadmin = 0
+	teamStateAdmin      = 1
+
+	teamAuditDefaultLimit = 50
+	teamsListPageSize     = 100
+	// Audit entries are appended with optimistic concurrency, retried when another action lands at the same time.
+	teamAuditWriteAttempts = 3
+)
+
+// TeamMaintenanceConfig is the shape of definitions/<env>/team-maintenance.json.
+type TeamMaintenanceConfig struct {
+	// IntervalSec is how often every team is checked.
+	IntervalSec int64 `json:"interval_sec"`
+	// Members inactive for InactiveSec are warned, then kicked if they are still inactive GraceSec after the warning.
+	InactiveSec int64 `json:"inactive_sec"`
+	GraceSec    int64 `json:"grace_sec"`
+	// When every superadmin has been inactive for OwnerInactiveSec they are warned, and if they are still inactive
+	// GraceSec after the warning the most active admin, or member if no admin is active, becomes superadmin and the
+	// inactive superadmins are demoted to admin.
+	OwnerInactiveSec        int64 `json:"owner_inactive_sec"`
+	WarningNotificationCode int   `json:"warning_notification_code"`
+	AuditMaxEntries         int   `json:"audit_max_entries"`
+}
+
+type TeamAuditEntry struct {
+	Action string `json:"action"`
+	// ActorID is empty for actions taken by the maintenance job.
+	ActorID string   `json:"actor_id"`
+	UserIDs []string `json:"user_ids,omitempty"`
+	// CreateTime is in unix seconds.
+	CreateTime int64 `json:"create_time"`
+}
+
+type TeamAudit struct {
+	TeamID  string            `json:"team_id"`
+	Entries []*TeamAuditEntry `json:"entries"`
+}
+
+// TeamMaintenance records when each member was warned about inactivity, in unix seconds.
+type TeamMaintenance struct {
+	Warnings map[string]int64 `json:"warnings"`
+	// SuccessionWarningSec is when the team's superadmins were warned that they will be replaced, or 0.
+	SuccessionWarningSec int64 `json:"succession_warning_sec,omitempty"`
+	// SinceSec is when the team was first maintained. Members without any recorded activity count as active then, so
+	// nobody is warned before activity has been recorded for long enough to tell.
+	SinceSec int64 `json:"since_sec"`
+	// RunSec is when a node last started maintaining the team. Writing it with the object's version is the lease that
+	// keeps two nodes from maintaining the team in the same interval.
+	RunSec int64 `json:"run_sec"`
+}
+
+type teamAuditListRequest struct {
+	TeamID string `json:"team_id"`
+	Limit  int    `json:"limit"`
+	// Offset skips that many of the newest entries.
+	Offset int `json:"offset"`
+}
+
+type teamMemberActivity struct {
+	userID        string
+	state         int32
+	lastActiveSec int64
+	score         float64
+}
+
+func (c *TeamMaintenanceConfig) Validate() error {
+	var errs []error
+	if c.IntervalSec <= 0 {
+		errs = append(errs, errors.New("interval_sec must be positive"))
+	}
+	if c.InactiveSec <= 0 || c.GraceSec < 0 || c.OwnerInactiveSec <= 0 {
+		errs = append(errs, errors.New("inactive_sec and owner_inactive_sec must be positive, grace_sec must not be negative"))
+	}
+	if c.WarningNotificationCode <= 0 {
+		errs = append(errs, errors.New("warning_notification_code must be positive"))
+	}
+	if c.AuditMaxEntries <= 0 {
+		errs = append(errs, errors.New("audit_max_entries must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// Register starts the maintenance job and registers the team audit log RPC. The job runs on every node, and each team is
+// maintained by whichever node takes its lease first in an interval.
+func (c *TeamMaintenanceConfig) Register(logger runtime.Logger, nk runtime.NakamaModule, initializer runtime.Initializer, activity *TeamActivityConfig) error {
+	go func() {
+		ticker := time.NewTicker(time.Duration(c.IntervalSec) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.run(context.Background(), logger, nk, activity)
+		}
+	}()
+
+	return initializer.RegisterRpc("rpc_team_audit_list", c.rpcTeamAuditList)
+}
+
+// run checks every team once. A failing team is logged and skipped so it cannot block maintenance of the others.
+func (c *TeamMaintenanceConfig) run(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, activity *TeamActivityConfig) {
+	start := time.Now()
+	var count int
+	cursor := ""
+	for {
+		teams, nextCursor, err := nk.GroupsList(ctx, "", "", nil, nil, teamsListPageSize, cursor)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to list teams for maintenance")
+			return
+		}
+		for _, team := range teams {
+			if err := c.maintain(ctx, logger, nk, activity, team.Id); err != nil {
+				logger.WithFields(map[string]interface{}{"team_id": team.Id, "error": err.Error()}).Error("Failed to maintain team")
+			}
+		}
+		count += len(teams)
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+	logger.WithField("teams", count).Info("Team maintenance finished in %dms", time.Since(start).Milliseconds())
+}
+
+func (c *TeamMaintenanceConfig) maintain(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, activity *TeamActivityConfig, teamID string) error {
+	logger = logger.WithField("team_id", teamID)
+	now := time.Now().Unix()
+
+	maintenance, version, err := readTeamMaintenance(ctx, nk, teamID)
+	if err != nil {
+		return err
+	}
+	// Tickers on different nodes drift apart, so a team maintained within half an interval is left for the next one.
+	if now-maintenance.RunSec < c.IntervalSec/2 {
+		return nil
+	}
+	maintenance.RunSec = now
+	if maintenance.SinceSec == 0 {
+		maintenance.SinceSec = now
+	}
+	if version, err = writeTeamMaintenance(ctx, nk, teamID, maintenance, version); err != nil {
+		if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			// Another node took the lease.
+			return nil
+		}
+		return err
+	}
+
+	members, err := teamMembersActivity(ctx, nk, activity, teamID, maintenance.SinceSec)
+	if err != nil {
+		return err
+	}
+
+	if err := c.succeed(ctx, logger, nk, teamID, maintenance, members, now); err != nil {
+		return err
+	}
+
+	warnings := make(map[string]int64, len(maintenance.Warnings))
+	for _, member := range members {
+		// Superadmins are only ever demoted by succession, never kicked while they own the team.
+		if member.state == teamStateSuperadmin || now-member.lastActiveSec < c.InactiveSec {
+			continue
+		}
+		warned, found := maintenance.Warnings[member.userID]
+		switch {
+		case !found || member.lastActiveSec > warned:
+			// Members active again since an earlier warning start over.
+			if err := nk.NotificationSend(ctx, member.userID, "You will be removed from your team for inactivity", map[string]interface{}{
+				"team_id":  teamID,
+				"kick_sec": now + c.GraceSec,
+			}, c.WarningNotificationCode, "", true); err != nil {
+				logger.WithFields(map[string]interface{}{"user_id": member.userID, "error": err.Error()}).Warn("Failed to send team inactivity warning")
+				continue
+			}
+			warnings[member.userID] = now
+			c.audit(ctx, logger, nk, teamID, teamAuditInactiveWarning, "", []string{member.userID})
+		case now-warned >= c.GraceSec:
+			if err := nk.GroupUsersKick(ctx, "", teamID, []string{member.userID}); err != nil {
+				logger.WithFields(map[string]interface{}{"user_id": member.userID, "error": err.Error()}).Warn("Failed to kick inactive team member")
+				warnings[member.userID] = warned
+				continue
+			}
+			c.audit(ctx, logger, nk, teamID, teamAuditInactiveKick, "", []string{member.userID})
+		default:
+			warnings[member.userID] = warned
+		}
+	}
+
+	// Warnings of members who left, were kicked or became active again are dropped.
+	maintenance.Warnings = warnings
+	_, err = writeTeamMaintenance(ctx, nk, teamID, maintenance, version)
+	return err
+}
+
+// succeed promotes a new superadmin when every superadmin has been inactive too long and was warned at least GraceSec
+// ago. Admins are preferred over members, then the higher activity score, and only members who are still active
+// themselves are candidates.
+func (c *TeamMaintenanceConfig) succeed(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, teamID string, maintenance *TeamMaintenance, members []*teamMemberActivity, now int64) error {
+	var owners []string
+	var ownersActiveSec int64
+	var successor *teamMemberActivity
+	for _, member := range members {
+		if member.state == teamStateSuperadmin {
+			owners = append(owners, member.userID)
+			ownersActiveSec = max(ownersActiveSec, member.lastActiveSec)
+			continue
+		}
+		if now-member.lastActiveSec >= c.InactiveSec {
+			continue
+		}
+		if successor == nil || member.state < successor.state || (member.state == successor.state && member.score > successor.score) {
+			successor = member
+		}
+	}
+	// Owners active again since an earlier warning start over.
+	if len(owners) == 0 || now-ownersActiveSec < c.OwnerInactiveSec || ownersActiveSec > maintenance.SuccessionWarningSec {
+		maintenance.SuccessionWarningSec = 0
+	}
+	if len(owners) == 0 || successor == nil || now-ownersActiveSec < c.OwnerInactiveSec {
+		return nil
+	}
+
+	if maintenance.SuccessionWarningSec == 0 {
+		for _, owner := range owners {
+			if err := nk.NotificationSend(ctx, owner, "You will lose ownership of your team for inactivity", map[string]interface{}{
+				"team_id":        teamID,
+				"succession_sec": now + c.GraceSec,
+			}, c.WarningNotificationCode, "", true); err != nil {
+				logger.WithFields(map[string]interface{}{"user_id": owner, "error": err.Error()}).Warn("Failed to send team succession warning")
+			}
+		}
+		maintenance.SuccessionWarningSec = now
+		c.audit(ctx, logger, nk, teamID, teamAuditSuccessionWarning, "", owners)
+		if c.GraceSec > 0 {
+			return nil
+		}
+	}
+	if now-maintenance.SuccessionWarningSec < c.GraceSec {
+		return nil
+	}
+
+	// Each promotion moves one step, from member to admin and from admin to superadmin.
+	for state := successor.state; state > teamStateSuperadmin; state-- {
+		if err := nk.GroupUsersPromote(ctx, "", teamID, []string{successor.userID}); err != nil {
+			return err
+		}
+	}
+	successor.state = teamStateSuperadmin
+	if err := nk.GroupUsersDemote(ctx, "", teamID, owners); err != nil {
+		return err
+	}
+	for _, member := range members {
+		for _, owner := range owners {
+			if member.userID == owner {
+				member.state = teamStateAdmin
+			}
+		}
+	}
+
+	maintenance.SuccessionWarningSec = 0
+
+	logger.WithFields(map[string]interface{}{"successor": successor.userID, "owners": owners}).Info("Promoted team successor")
+	c.audit(ctx, logger, nk, teamID, teamAuditSuccession, "", append([]string{successor.userID}, owners...))
+	return nil
+}
+
+// teamMembersActivity lists the team's members with when they were last active and their activity score. Members
+// without any recorded activity count as last active at sinceSec, when the team was first maintained.
+func teamMembersActivity(ctx context.Context, nk runtime.NakamaModule, activity *TeamActivityConfig, teamID string, sinceSec int64) ([]*teamMemberActivity, error) {
+	var members []*teamMemberActivity
+	var userIDs []string
+	cursor := ""
+	for {
+		groupUsers, nextCursor, err := nk.GroupUsersList(ctx, teamID, teamMembersPageSize, nil, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for _, groupUser := range groupUsers {
+			if state := groupUser.GetState().GetValue(); state <= teamStateMember {
+				user := groupUser.GetUser()
+				member := &teamMemberActivity{userID: user.GetId(), state: state, lastActiveSec: sinceSec}
+				if user.GetOnline() {
+					member.lastActiveSec = time.Now().Unix()
+				}
+				members = append(members, member)
+				userIDs = append(userIDs, member.userID)
+			}
+		}
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+
+	records, err := activity.records(ctx, nk, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	for _, member := range members {
+		if record, found := records[member.userID]; found {
+			member.lastActiveSec = max(member.lastActiveSec, record.UpdateTimeSec)
+			member.score = activity.decayed(record, now)
+		}
+	}
+	return members, nil
+}
+
+func readTeamMaintenance(ctx context.Context, nk runtime.NakamaModule, teamID string) (*TeamMaintenance, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionTeamMaintenance, Key: teamID}})
+	if err != nil {
+		return nil, "", err
+	}
+	maintenance := &TeamMaintenance{}
+	if len(objects) == 0 {
+		return maintenance, "*", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), maintenance); err != nil {
+		return nil, "", err
+	}
+	return maintenance, objects[0].Version, nil
+}
+
+func writeTeamMaintenance(ctx context.Context, nk runtime.NakamaModule, teamID string, maintenance *TeamMaintenance, version string) (string, error) {
+	value, err := json.Marshal(maintenance)
+	if err != nil {
+		return "", err
+	}
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionTeamMaintenance,
+		Key:             teamID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	if err != nil {
+		return "", err
+	}
+	return acks[0].Version, nil
+}
+
+// audit appends an entry to the team's audit log. Failures are logged rather than returned, since the action itself
+// has already happened.
+func (c *TeamMaintenanceConfig) audit(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, teamID, action, actorID string, userIDs []string) {
+	entry := &TeamAuditEntry{Action: action, ActorID: actorID, UserIDs: userIDs, CreateTime: time.Now().Unix()}
+
+	var err error
+	for attempt := 0; attempt < teamAuditWriteAttempts; attempt++ {
+		if err = c.appendAudit(ctx, nk, teamID, entry); err == nil {
+			return
+		}
+	}
+	logger.WithFields(map[string]interface{}{"team_id": teamID, "action": action, "error": err.Error()}).Error("Failed to write team audit entry")
+}
+
+func (c *TeamMaintenanceConfig) appendAudit(ctx context.Context, nk runtime.NakamaModule, teamID string, entry *TeamAuditEntry) error {
+	audit, version, err := readTeamAudit(ctx, nk, teamID)
+	if err != nil {
+		return err
+	}
+	audit.Entries = append([]*TeamAuditEntry{entry}, audit.Entries...)
+	if len(audit.Entries) > c.AuditMaxEntries {
+		audit.Entries = audit.Entries[:c.AuditMaxEntries]
+	}
+
+	value, err := json.Marshal(audit)
+	if err != nil {
+		return err
+	}
+	_, err = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionTeamAudit,
+		Key:             teamID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+func readTeamAudit(ctx context.Context, nk runtime.NakamaModule, teamID string) (*TeamAudit, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionTeamAudit, Key: teamID}})
+	if err != nil {
+		return nil, "", err
+	}
+	audit := &TeamAudit{TeamID: teamID, Entries: []*TeamAuditEntry{}}
+	if len(objects) == 0 {
+		return audit, "*", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), audit); err != nil {
+		return nil, "", err
+	}
+	return audit, objects[0].Version, nil
+}
+
+// rpcTeamAuditList returns a page of a team's audit log, newest first. Any member of the team may read it.
+func (c *TeamMaintenanceConfig) rpcTeamAuditList(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok {
+		return "", errors.New("no user ID in context")
+	}
+
+	var req teamAuditListRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid request payload", 3)
+	}
+	if req.TeamID == "" {
+		return "", runtime.NewError("team_id is required", 3)
+	}
+	if req.Limit <= 0 || req.Limit > teamsListPageSize {
+		req.Limit = teamAuditDefaultLimit
+	}
+	if req.Offset < 0 {
+		req.Offset = 0
+	}
+
+	_, member, err := teamRole(ctx, nk, userID, req.TeamID)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to list user teams")
+		return "", err
+	}
+	if !member {
+		return "", runtime.NewError("only team members can read the team audit log", 7)
+	}
+
+	audit, _, err := readTeamAudit(ctx, nk, req.TeamID)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read team audit log")
+		return "", err
+	}
+	if req.Offset > len(audit.Entries) {
+		req.Offset = len(audit.Entries)
+	}
+	audit.Entries = audit.Entries[req.Offset:]
+	if len(audit.Entries) > req.Limit {
+		audit.Entries = audit.Entries[:req.Limit]
+	}
+
+	response, err := json.Marshal(audit)
+	if err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
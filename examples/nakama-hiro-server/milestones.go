@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// One system-owned object per team records every milestone it has claimed. A claim is written before its reward
+	// is granted, so concurrent stat updates cannot both grant the same milestone.
+	storageCollectionTeamMilestones = "team_milestones"
+
+	milestoneRecipientsTeamWallet = "team_wallet"
+	milestoneRecipientsMembers    = "members"
+	milestoneRecipientsBoth       = "both"
+
+	milestoneStatusPending = "pending"
+	// A partial claim has granted some of its recipients, and is claimed again by a later update to grant the rest.
+	milestoneStatusPartial = "partial"
+	milestoneStatusGranted = "granted"
+	// Seeded claims mark milestones the team had already passed when its claims were first written, which the
+	// hard-coded level rewards these milestones replace may already have paid.
+	milestoneStatusSeeded = "seeded"
+
+	// Claims are written with optimistic concurrency, retried when another update to the same team lands first.
+	milestoneWriteAttempts = 3
+
+	// Group membership states above this are join requests.
+	teamStateMember     = 2
+	teamMembersPageSize = 100
+)
+
+// TeamMilestonesConfig is the shape of definitions/<env>/team-milestones.json.
+type TeamMilestonesConfig struct {
+	Milestones map[string]*TeamMilestone `json:"milestones"`
+}
+
+// TeamMilestone grants Reward once per team, the first time the stat reaches Threshold.
+type TeamMilestone struct {
+	Stat string `json:"stat"`
+	// Private milestones read the team's private stat of that name instead of the public one.
+	Private   bool                      `json:"private"`
+	Threshold int64                     `json:"threshold"`
+	Reward    *hiro.EconomyConfigReward `json:"reward"`
+	// MemberReward is granted to members instead of Reward when set, e.g. when the team wallet and members should
+	// receive different currencies.
+	MemberReward *hiro.EconomyConfigReward `json:"member_reward"`
+	// Recipients is one of "team_wallet", which adds the rolled currencies to the team wallet, "members", which
+	// grants the reward into every member's own reward mailbox, or "both".
+	Recipients string `json:"recipients"`
+}
+
+type TeamMilestoneClaim struct {
+	Status       string `json:"status"`
+	Value        int64  `json:"value"`
+	UserID       string `json:"user_id"`
+	ClaimTimeSec int64  `json:"claim_time_sec"`
+	// TeamWalletGranted and GrantedUserIDs record what has been granted so far, so a retry only grants the rest.
+	TeamWalletGranted bool     `json:"team_wallet_granted,omitempty"`
+	GrantedUserIDs    []string `json:"granted_user_ids,omitempty"`
+}
+
+type TeamMilestoneClaims struct {
+	Milestones map[string]*TeamMilestoneClaim `json:"milestones"`
+	// SeedTimeSec is when milestones the team had already passed were seeded, on its first evaluation.
+	SeedTimeSec int64 `json:"seed_time_sec"`
+}
+
+func (c *TeamMilestonesConfig) Validate() error {
+	var errs []error
+	for id, milestone := range c.Milestones {
+		if milestone.Stat == "" {
+			errs = append(errs, fmt.Errorf("milestone %q: missing stat", id))
+		}
+		if milestone.Reward == nil {
+			errs = append(errs, fmt.Errorf("milestone %q: missing reward", id))
+		}
+		switch milestone.Recipients {
+		case milestoneRecipientsTeamWallet, milestoneRecipientsMembers, milestoneRecipientsBoth:
+		default:
+			errs = append(errs, fmt.Errorf("milestone %q: recipients must be one of team_wallet, members, both, got %q", id, milestone.Recipients))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// due returns the IDs of milestones the stats have reached, lowest threshold first, and of partial claims still to be
+// finished. Every milestone crossed by a single update is included, not just the highest.
+func (c *TeamMilestonesConfig) due(stats *hiro.StatList, claims *TeamMilestoneClaims) []string {
+	var ids []string
+	for id, milestone := range c.Milestones {
+		if claim, claimed := claims.Milestones[id]; claimed {
+			if claim.Status == milestoneStatusPartial {
+				ids = append(ids, id)
+			}
+			continue
+		}
+		if stat, found := milestone.statList(stats)[milestone.Stat]; found && stat.Value >= milestone.Threshold {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := c.Milestones[ids[i]], c.Milestones[ids[j]]
+		if a.Threshold != b.Threshold {
+			return a.Threshold < b.Threshold
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// seed marks every milestone whose threshold the stats are already past as claimed, without granting it. Teams that
+// reached a level under the hard-coded level rewards were paid then, so on a team's first evaluation only milestones
+// reached exactly by its current stats are left to be granted.
+func (c *TeamMilestonesConfig) seed(stats *hiro.StatList, claims *TeamMilestoneClaims, now int64) {
+	for id, milestone := range c.Milestones {
+		if _, claimed := claims.Milestones[id]; claimed {
+			continue
+		}
+		if stat, found := milestone.statList(stats)[milestone.Stat]; found && stat.Value > milestone.Threshold {
+			claims.Milestones[id] = &TeamMilestoneClaim{Status: milestoneStatusSeeded, Value: stat.Value, ClaimTimeSec: now}
+		}
+	}
+	claims.SeedTimeSec = now
+}
+
+func (m *TeamMilestone) statList(stats *hiro.StatList) map[string]*hiro.Stat {
+	if m.Private {
+		return stats.GetPrivate()
+	}
+	return stats.GetPublic()
+}
+
+// Grant claims and grants every milestone the team's stats have newly reached. Claims that grant nothing are released
+// so a later stat update can retry them. Claims that grant some of their recipients are kept as partial with what was
+// granted, and a later stat update grants the rest.
+func (c *TeamMilestonesConfig) Grant(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, systems hiro.Hiro, userID, teamID string, stats *hiro.StatList) error {
+	logger = logger.WithFields(map[string]interface{}{"team_id": teamID, "user_id": userID})
+
+	var claimed []string
+	var claimedClaims map[string]*TeamMilestoneClaim
+	err := updateTeamMilestoneClaims(ctx, nk, teamID, func(claims *TeamMilestoneClaims) bool {
+		now := time.Now().Unix()
+		seeded := claims.SeedTimeSec == 0
+		if seeded {
+			c.seed(stats, claims, now)
+		}
+		claimed = c.due(stats, claims)
+		claimedClaims = make(map[string]*TeamMilestoneClaim, len(claimed))
+		for _, id := range claimed {
+			claim, found := claims.Milestones[id]
+			if !found {
+				milestone := c.Milestones[id]
+				claim = &TeamMilestoneClaim{Value: milestone.statList(stats)[milestone.Stat].GetValue()}
+				claims.Milestones[id] = claim
+			}
+			// A partial claim is claimed again as pending, so only one update finishes it.
+			claim.Status = milestoneStatusPending
+			claim.UserID = userID
+			claim.ClaimTimeSec = now
+			claimedClaims[id] = claim
+		}
+		return seeded || len(claimed) > 0
+	})
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to claim team milestones")
+		return err
+	}
+
+	var errs []error
+	for _, id := range claimed {
+		claim := claimedClaims[id]
+		if err := c.grant(ctx, logger, nk, systems, userID, teamID, c.Milestones[id], claim); err != nil {
+			logger.WithFields(map[string]interface{}{"milestone": id, "error": err.Error()}).Error("Failed to grant team milestone")
+			errs = append(errs, err)
+			if claim.TeamWalletGranted || len(claim.GrantedUserIDs) > 0 {
+				claim.Status = milestoneStatusPartial
+			}
+			continue
+		}
+		claim.Status = milestoneStatusGranted
+		logger.WithField("milestone", id).Info("Granted team milestone")
+	}
+
+	if len(claimed) > 0 {
+		if err := updateTeamMilestoneClaims(ctx, nk, teamID, func(claims *TeamMilestoneClaims) bool {
+			for _, id := range claimed {
+				if claim := claimedClaims[id]; claim.Status == milestoneStatusPending {
+					delete(claims.Milestones, id)
+				} else {
+					claims.Milestones[id] = claim
+				}
+			}
+			return true
+		}); err != nil {
+			// Claims stay pending either way, so nothing is granted twice, but what they granted or their release is lost.
+			logger.WithField("error", err.Error()).Warn("Failed to update team milestone claims")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// grant grants the milestone to the recipients the claim has not granted yet, recording each one in the claim as it is
+// granted.
+func (c *TeamMilestonesConfig) grant(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, systems hiro.Hiro, userID, teamID string, milestone *TeamMilestone, claim *TeamMilestoneClaim) error {
+	if (milestone.Recipients == milestoneRecipientsTeamWallet || milestone.Recipients == milestoneRecipientsBoth) && !claim.TeamWalletGranted {
+		reward, err := systems.GetEconomySystem().RewardRoll(ctx, logger, nk, userID, milestone.Reward)
+		if err != nil {
+			return err
+		}
+		if _, err := systems.GetTeamsSystem().WalletGrant(ctx, logger, nk, userID, teamID, reward.GetCurrencies()); err != nil {
+			return err
+		}
+		claim.TeamWalletGranted = true
+	}
+
+	if milestone.Recipients == milestoneRecipientsMembers || milestone.Recipients == milestoneRecipientsBoth {
+		memberReward := milestone.Reward
+		if milestone.MemberReward != nil {
+			memberReward = milestone.MemberReward
+		}
+		granted := make(map[string]bool, len(claim.GrantedUserIDs))
+		for _, memberID := range claim.GrantedUserIDs {
+			granted[memberID] = true
+		}
+		var errs []error
+		cursor := ""
+		for {
+			members, nextCursor, err := nk.GroupUsersList(ctx, teamID, teamMembersPageSize, nil, cursor)
+			if err != nil {
+				return err
+			}
+			for _, member := range members {
+				if member.GetState().GetValue() > teamStateMember {
+					continue
+				}
+				memberID := member.GetUser().GetId()
+				if granted[memberID] {
+					continue
+				}
+				// Each member gets their own roll of the reward.
+				reward, err := systems.GetEconomySystem().RewardRoll(ctx, logger, nk, memberID, memberReward)
+				if err == nil {
+					_, err = systems.GetRewardMailboxSystem().Grant(ctx, logger, nk, memberID, reward)
+				}
+				if err != nil {
+					errs = append(errs, fmt.Errorf("member %q: %w", memberID, err))
+					continue
+				}
+				claim.GrantedUserIDs = append(claim.GrantedUserIDs, memberID)
+			}
+			if cursor = nextCursor; cursor == "" {
+				break
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
+
+// updateTeamMilestoneClaims applies update to the team's claims and writes them back if it returns true, retrying
+// from a fresh read when another update wrote them first.
+func updateTeamMilestoneClaims(ctx context.Context, nk runtime.NakamaModule, teamID string, update func(claims *TeamMilestoneClaims) bool) error {
+	var writeErr error
+	for attempt := 0; attempt < milestoneWriteAttempts; attempt++ {
+		objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionTeamMilestones, Key: teamID}})
+		if err != nil {
+			return err
+		}
+		claims := &TeamMilestoneClaims{}
+		version := "*"
+		if len(objects) > 0 {
+			if err := json.Unmarshal([]byte(objects[0].Value), claims); err != nil {
+				return err
+			}
+			version = objects[0].Version
+		}
+		if claims.Milestones == nil {
+			claims.Milestones = make(map[string]*TeamMilestoneClaim)
+		}
+
+		if !update(claims) {
+			return nil
+		}
+
+		value, err := json.Marshal(claims)
+		if err != nil {
+			return err
+		}
+		if _, writeErr = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+			Collection:      storageCollectionTeamMilestones,
+			Key:             teamID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}}); writeErr == nil {
+			return nil
+		}
+	}
+	return writeErr
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// Each prize is claimed in the ledger before it is granted. A claim left "pending" means the node stopped between
+	// the claim and the grant, so it is not known whether the grant landed. It is logged, not granted again, and an
+	// operator resolves it with rpc_tournament_payouts_resolve after checking the player's reward mailbox. A claim left
+	// "granting" is the same, for a node that stopped while resolving a claim.
+	storageCollectionTournamentPayouts = "tournament_payouts"
+
+	payoutStatusPending  = "pending"
+	payoutStatusGranting = "granting"
+	payoutStatusPaid     = "paid"
+
+	tournamentRecordsPageSize = 100
+)
+
+// TournamentPrizesConfig is the shape of definitions/<env>/tournament-prizes.json.
+type TournamentPrizesConfig struct {
+	Tournaments map[string]*TournamentPrizesConfigTournament `json:"tournaments"`
+}
+
+type TournamentPrizesConfigTournament struct {
+	Prizes []*TournamentPrize `json:"prizes"`
+}
+
+// TournamentPrize grants Reward to every player ranked between MinRank and MaxRank inclusive.
+type TournamentPrize struct {
+	MinRank int64                     `json:"min_rank"`
+	MaxRank int64                     `json:"max_rank"`
+	Reward  *hiro.EconomyConfigReward `json:"reward"`
+}
+
+// TournamentPayout is the ledger entry stored for each prize.
+type TournamentPayout struct {
+	TournamentID string `json:"tournament_id"`
+	End          int64  `json:"end"`
+	Rank         int64  `json:"rank"`
+	Score        int64  `json:"score"`
+	Status       string `json:"status"`
+	MailboxID    string `json:"mailbox_id,omitempty"`
+}
+
+// Validate sorts each tournament's prizes by rank and checks that the ranges are well formed.
+func (c *TournamentPrizesConfig) Validate() error {
+	var errs []error
+	for id, tournament := range c.Tournaments {
+		prizes := tournament.Prizes
+		sort.Slice(prizes, func(i, j int) bool {
+			return prizes[i].MinRank < prizes[j].MinRank
+		})
+		for i, prize := range prizes {
+			if prize.MinRank < 1 || prize.MaxRank < prize.MinRank {
+				errs = append(errs, fmt.Errorf("tournament %q: invalid rank range %d-%d", id, prize.MinRank, prize.MaxRank))
+			}
+			if i > 0 && prize.MinRank <= prizes[i-1].MaxRank {
+				errs = append(errs, fmt.Errorf("tournament %q: rank range %d-%d overlaps %d-%d", id, prize.MinRank, prize.MaxRank, prizes[i-1].MinRank, prizes[i-1].MaxRank))
+			}
+			if prize.Reward == nil {
+				errs = append(errs, fmt.Errorf("tournament %q: rank range %d-%d has no reward", id, prize.MinRank, prize.MaxRank))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t *TournamentPrizesConfigTournament) prizeForRank(rank int64) *TournamentPrize {
+	for _, prize := range t.Prizes {
+		if rank >= prize.MinRank && rank <= prize.MaxRank {
+			return prize
+		}
+	}
+	return nil
+}
+
+// tournamentPrizeHandler grants prizes into each winner's reward mailbox when a tournament window closes. It is
+// registered for both tournament end and reset, since either may be the last callback for a window; the payout ledger
+// keeps the second call from granting again.
+func tournamentPrizeHandler(systems hiro.Hiro, config *TournamentPrizesConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, tournament *api.Tournament, end, reset int64) error {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, tournament *api.Tournament, end, reset int64) error {
+		prizes, found := config.Tournaments[tournament.Id]
+		if !found || len(prizes.Prizes) == 0 {
+			return nil
+		}
+		logger = logger.WithFields(map[string]interface{}{"tournament": tournament.Id, "end": end})
+
+		maxRank := prizes.Prizes[len(prizes.Prizes)-1].MaxRank
+		key := fmt.Sprintf("%s_%d", tournament.Id, end)
+
+		var paid, skipped int
+		var errs []error
+		cursor := ""
+		for {
+			// Records from the window that just ended have expired, so list them as of its end time.
+			records, _, _, nextCursor, err := nk.TournamentRecordsList(ctx, tournament.Id, nil, tournamentRecordsPageSize, cursor, end)
+			if err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to list tournament records")
+				return err
+			}
+
+			for _, record := range records {
+				prize := prizes.prizeForRank(record.Rank)
+				if prize == nil {
+					continue
+				}
+				granted, err := grantTournamentPrize(ctx, logger, nk, systems, tournament.Id, key, end, record, prize)
+				if err != nil {
+					logger.WithFields(map[string]interface{}{"user_id": record.OwnerId, "error": err.Error()}).Error("Failed to grant tournament prize")
+					errs = append(errs, err)
+					continue
+				}
+				if granted {
+					paid++
+				} else {
+					skipped++
+				}
+			}
+
+			if nextCursor == "" || len(records) == 0 || records[len(records)-1].Rank >= maxRank {
+				break
+			}
+			cursor = nextCursor
+		}
+
+		logger.Info("Tournament prizes granted to %d players, %d already claimed", paid, skipped)
+		return errors.Join(errs...)
+	}
+}
+
+// grantTournamentPrize claims the ledger entry for a winner and grants their prize. It returns false without error when
+// the prize has already been claimed.
+func grantTournamentPrize(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, systems hiro.Hiro, tournamentID, key string, end int64, record *api.LeaderboardRecord, prize *TournamentPrize) (bool, error) {
+	payout := &TournamentPayout{
+		TournamentID: tournamentID,
+		End:          end,
+		Rank:         record.Rank,
+		Score:        record.Score,
+		Status:       payoutStatusPending,
+	}
+
+	existing, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionTournamentPayouts, Key: key, UserID: record.OwnerId}})
+	if err != nil {
+		return false, err
+	}
+	if len(existing) > 0 {
+		var previous TournamentPayout
+		if err := json.Unmarshal([]byte(existing[0].Value), &previous); err == nil && previous.Status != payoutStatusPaid {
+			logger.WithField("user_id", record.OwnerId).Warn("Tournament prize claim left pending, resolve it with rpc_tournament_payouts_resolve")
+		}
+		return false, nil
+	}
+
+	// Version "*" only writes the claim if no other node has claimed this prize first. Any other failure leaves no
+	// claim, and is returned so the prize isn't silently skipped.
+	acks, err := writeTournamentPayout(ctx, nk, key, record.OwnerId, payout, "*")
+	if err != nil {
+		claimed, readErr := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionTournamentPayouts, Key: key, UserID: record.OwnerId}})
+		if readErr == nil && len(claimed) > 0 {
+			logger.WithFields(map[string]interface{}{"user_id": record.OwnerId, "error": err.Error()}).Debug("Tournament prize claimed concurrently")
+			return false, nil
+		}
+		return false, err
+	}
+
+	if err := grantTournamentPayout(ctx, logger, nk, systems, record.OwnerId, payout, prize); err != nil {
+		// Release the claim so a later callback can retry the grant.
+		if deleteErr := nk.StorageDelete(ctx, []*runtime.StorageDelete{{Collection: storageCollectionTournamentPayouts, Key: key, UserID: record.OwnerId, Version: acks[0].Version}}); deleteErr != nil {
+			logger.WithField("error", deleteErr.Error()).Error("Failed to release tournament prize claim")
+		}
+		return false, err
+	}
+
+	if _, err := writeTournamentPayout(ctx, nk, key, record.OwnerId, payout, acks[0].Version); err != nil {
+		// The prize has been granted, only the ledger status is stale.
+		logger.WithFields(map[string]interface{}{"user_id": record.OwnerId, "error": err.Error()}).Warn("Failed to mark tournament prize paid")
+	}
+
+	return true, nil
+}
+
+// grantTournamentPayout rolls the prize into the player's reward mailbox and marks the payout paid, without saving it.
+func grantTournamentPayout(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, systems hiro.Hiro, userID string, payout *TournamentPayout, prize *TournamentPrize) error {
+	reward, err := systems.GetEconomySystem().RewardRoll(ctx, logger, nk, userID, prize.Reward)
+	if err != nil {
+		return err
+	}
+	entry, err := systems.GetRewardMailboxSystem().Grant(ctx, logger, nk, userID, reward)
+	if err != nil {
+		return err
+	}
+	payout.MailboxID = entry.GetId()
+	payout.Status = payoutStatusPaid
+	return nil
+}
+
+func writeTournamentPayout(ctx context.Context, nk runtime.NakamaModule, key, userID string, payout *TournamentPayout, version string) ([]*api.StorageObjectAck, error) {
+	value, err := json.Marshal(payout)
+	if err != nil {
+		return nil, err
+	}
+	return nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionTournamentPayouts,
+		Key:             key,
+		UserID:          userID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}})
+}
+
+type tournamentPayoutsPendingRequest struct {
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+type tournamentPayoutsPendingResponse struct {
+	Payouts []*pendingTournamentPayout `json:"payouts"`
+	Cursor  string                     `json:"cursor,omitempty"`
+}
+
+type pendingTournamentPayout struct {
+	*TournamentPayout
+	UserID string `json:"user_id"`
+	Key    string `json:"key"`
+}
+
+type tournamentPayoutsResolveRequest struct {
+	UserID string `json:"user_id"`
+	Key    string `json:"key"`
+	// Action is "grant" if the prize never reached the player's reward mailbox, or "paid" if it did.
+	Action string `json:"action"`
+}
+
+// rpcTournamentPayoutsPending lists claims left pending or granting across all players. It can only be called server to
+// server.
+func rpcTournamentPayoutsPending() func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		if _, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string); ok {
+			return "", runtime.NewError("tournament payouts can only be read server to server", 7)
+		}
+		request := &tournamentPayoutsPendingRequest{Limit: tournamentRecordsPageSize}
+		if payload != "" {
+			if err := json.Unmarshal([]byte(payload), request); err != nil {
+				return "", runtime.NewError("invalid request", 3)
+			}
+		}
+		if request.Limit < 1 || request.Limit > tournamentRecordsPageSize {
+			return "", runtime.NewError("limit must be between 1 and 100", 3)
+		}
+
+		objects, cursor, err := nk.StorageList(ctx, "", "", storageCollectionTournamentPayouts, request.Limit, request.Cursor)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to list tournament payouts")
+			return "", err
+		}
+		response := &tournamentPayoutsPendingResponse{Payouts: make([]*pendingTournamentPayout, 0), Cursor: cursor}
+		for _, object := range objects {
+			payout := &TournamentPayout{}
+			if err := json.Unmarshal([]byte(object.Value), payout); err != nil || payout.Status == payoutStatusPaid {
+				continue
+			}
+			response.Payouts = append(response.Payouts, &pendingTournamentPayout{TournamentPayout: payout, UserID: object.UserId, Key: object.Key})
+		}
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
+
+// rpcTournamentPayoutsResolve settles a pending or granting claim once an operator has checked the player's reward
+// mailbox: "grant" grants the prize for the claimed rank now, and "paid" only marks the claim paid. A grant first moves
+// the claim to granting with the version it was read at, so of two concurrent resolves only one grants. It can only be
+// called server to server.
+func rpcTournamentPayoutsResolve(systems hiro.Hiro, config *TournamentPrizesConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		if _, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string); ok {
+			return "", runtime.NewError("tournament payouts can only be resolved server to server", 7)
+		}
+		request := &tournamentPayoutsResolveRequest{}
+		if err := json.Unmarshal([]byte(payload), request); err != nil {
+			return "", runtime.NewError("invalid request", 3)
+		}
+		if request.UserID == "" || request.Key == "" {
+			return "", runtime.NewError("user_id and key are required", 3)
+		}
+		if request.Action != "grant" && request.Action != "paid" {
+			return "", runtime.NewError(`action must be "grant" or "paid"`, 3)
+		}
+		logger = logger.WithFields(map[string]interface{}{"user_id": request.UserID, "key": request.Key})
+
+		objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionTournamentPayouts, Key: request.Key, UserID: request.UserID}})
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read tournament payout")
+			return "", err
+		}
+		if len(objects) == 0 {
+			return "", runtime.NewError("tournament payout not found", 5)
+		}
+		payout := &TournamentPayout{}
+		if err := json.Unmarshal([]byte(objects[0].Value), payout); err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to unmarshal tournament payout")
+			return "", err
+		}
+		if payout.Status == payoutStatusPaid {
+			return "", runtime.NewError("tournament payout is already paid", 9)
+		}
+
+		version := objects[0].Version
+		if request.Action == "grant" {
+			prizes, found := config.Tournaments[payout.TournamentID]
+			if !found || prizes.prizeForRank(payout.Rank) == nil {
+				return "", runtime.NewError("no prize defined for the claimed rank", 9)
+			}
+
+			// Only the resolve that moves the claim from the version it read gets to grant.
+			status := payout.Status
+			payout.Status = payoutStatusGranting
+			acks, err := writeTournamentPayout(ctx, nk, request.Key, request.UserID, payout, version)
+			if err != nil {
+				if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+					return "", runtime.NewError("tournament payout changed while resolving, list it again", 10)
+				}
+				logger.WithField("error", err.Error()).Error("Failed to write tournament payout")
+				return "", err
+			}
+			version = acks[0].Version
+
+			if err := grantTournamentPayout(ctx, logger, nk, systems, request.UserID, payout, prizes.prizeForRank(payout.Rank)); err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to grant tournament prize")
+				// Put the claim back as it was so the resolve can be retried.
+				payout.Status = status
+				if _, writeErr := writeTournamentPayout(ctx, nk, request.Key, request.UserID, payout, version); writeErr != nil {
+					logger.WithField("error", writeErr.Error()).Error("Failed to restore tournament payout")
+				}
+				return "", err
+			}
+		} else {
+			payout.Status = payoutStatusPaid
+		}
+
+		if _, err := writeTournamentPayout(ctx, nk, request.Key, request.UserID, payout, version); err != nil {
+			if errors.Is(err, runtime.ErrStorageRejectedVersion) && request.Action == "paid" {
+				return "", runtime.NewError("tournament payout changed while resolving, list it again", 10)
+			}
+			logger.WithField("error", err.Error()).Error("Failed to mark tournament prize paid")
+			return "", err
+		}
+		logger.Info("Resolved pending tournament prize claim with %q", request.Action)
+
+		data, err := json.Marshal(payout)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
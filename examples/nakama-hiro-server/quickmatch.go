@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// One system-owned object per template, category and skill band points at the challenge quick match is filling,
+	// so concurrent callers join the same challenge instead of each creating their own.
+	storageCollectionChallengeQuickMatch = "challenge_quick_match"
+
+	quickMatchMetadataTemplate  = "quick_match_template"
+	quickMatchMetadataSkillBand = "quick_match_skill_band"
+
+	quickMatchAttempts = 5
+	quickMatchBackoff  = 100 * time.Millisecond
+)
+
+var errQuickMatchBusy = runtime.NewError("quick match busy, try again", 10)
+
+// ChallengeQuickMatchConfig is the shape of definitions/<env>/challenge-quick-match.json.
+type ChallengeQuickMatchConfig struct {
+	Templates map[string]*ChallengeQuickMatchTemplate `json:"templates"`
+	Skill     *ChallengeQuickMatchSkill               `json:"skill"`
+	// SearchLimit is how many open challenges are looked at before a new one is created.
+	SearchLimit int `json:"search_limit"`
+	// CreateLockSec is how long other callers wait on a challenge being created before they may create their own.
+	CreateLockSec int64 `json:"create_lock_sec"`
+}
+
+// ChallengeQuickMatchTemplate is how challenges created by quick match are set up. Zero values fall back to the
+// template: its longest start delay, shortest duration and most players.
+type ChallengeQuickMatchTemplate struct {
+	StartDelaySec int64 `json:"start_delay_sec"`
+	DurationSec   int64 `json:"duration_sec"`
+	MaxPlayers    int64 `json:"max_players"`
+	// MinRemainingSec skips challenges ending sooner than this.
+	MinRemainingSec int64 `json:"min_remaining_sec"`
+}
+
+// ChallengeQuickMatchSkill places players in skill bands by a player stat. Band 0 is below the first threshold, band 1
+// from the first to below the second, and so on. Players only match challenges of their own band.
+type ChallengeQuickMatchSkill struct {
+	Stat       string  `json:"stat"`
+	Private    bool    `json:"private"`
+	Thresholds []int64 `json:"thresholds"`
+}
+
+type ChallengeQuickMatchSlot struct {
+	ChallengeID string `json:"challenge_id"`
+	// CreatingUntil is set, in unix seconds, while a caller is creating the next challenge.
+	CreatingUntil int64 `json:"creating_until"`
+}
+
+type challengeQuickMatchRequest struct {
+	TemplateID string `json:"template_id"`
+	Category   string `json:"category"`
+}
+
+func (c *ChallengeQuickMatchConfig) Validate() error {
+	var errs []error
+	for id, template := range c.Templates {
+		if template.StartDelaySec < 0 || template.DurationSec < 0 || template.MaxPlayers < 0 || template.MinRemainingSec < 0 {
+			errs = append(errs, fmt.Errorf("template %q: values must not be negative", id))
+		}
+	}
+	if skill := c.Skill; skill != nil {
+		if skill.Stat == "" {
+			errs = append(errs, errors.New("skill stat is required"))
+		}
+		if !sort.SliceIsSorted(skill.Thresholds, func(i, j int) bool { return skill.Thresholds[i] < skill.Thresholds[j] }) {
+			errs = append(errs, errors.New("skill thresholds must be in ascending order"))
+		}
+	}
+	if c.SearchLimit <= 0 || c.CreateLockSec <= 0 {
+		errs = append(errs, errors.New("search_limit and create_lock_sec must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// skillBand returns the caller's skill band, 0 when skill bands are off or the player has no such stat.
+func (c *ChallengeQuickMatchConfig) skillBand(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, systems hiro.Hiro, userID string) (int, error) {
+	statsSystem := systems.GetStatsSystem()
+	if c.Skill == nil || statsSystem == nil {
+		return 0, nil
+	}
+	stats, err := statsSystem.List(ctx, logger, nk, userID, []string{userID})
+	if err != nil {
+		return 0, err
+	}
+	list := stats[userID].GetPublic()
+	if c.Skill.Private {
+		list = stats[userID].GetPrivate()
+	}
+	value := list[c.Skill.Stat].GetValue()
+	return sort.Search(len(c.Skill.Thresholds), func(i int) bool { return c.Skill.Thresholds[i] > value }), nil
+}
+
+// rpcChallengeQuickMatch puts the caller in an open challenge of the template and their skill band. It tries, in
+// order, the challenge quick match is currently filling, any other open challenge found by search, the fullest
+// first, and finally creates a new open challenge.
+func (c *ChallengeQuickMatchConfig) rpcChallengeQuickMatch(systems hiro.Hiro) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		var req challengeQuickMatchRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request payload", 3)
+		}
+		quickMatch, found := c.Templates[req.TemplateID]
+		if !found {
+			return "", runtime.NewError("challenge template not available for quick match", 5)
+		}
+		challengesSystem := systems.GetChallengesSystem()
+		templates, err := challengesSystem.GetTemplates(ctx, logger, nk, userID)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to get challenge templates")
+			return "", err
+		}
+		template, found := templates.GetTemplates()[req.TemplateID]
+		if !found {
+			return "", runtime.NewError("challenge template not found", 5)
+		}
+		if req.Category == "" {
+			req.Category = template.AdditionalProperties["category"]
+		}
+
+		band, err := c.skillBand(ctx, logger, nk, systems, userID)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to list player stats")
+			return "", err
+		}
+		logger = logger.WithFields(map[string]interface{}{"template_id": req.TemplateID, "category": req.Category, "skill_band": band})
+
+		challenge, err := c.quickMatch(ctx, logger, nk, challengesSystem, userID, req.TemplateID, req.Category, band, template, quickMatch)
+		if err != nil {
+			return "", err
+		}
+		response, err := protojson.Marshal(challenge)
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+func (c *ChallengeQuickMatchConfig) quickMatch(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, challengesSystem hiro.ChallengesSystem, userID, templateID, category string, band int, template *hiro.ChallengeTemplate, quickMatch *ChallengeQuickMatchTemplate) (*hiro.Challenge, error) {
+	key := fmt.Sprintf("%s_%s_%d", templateID, category, band)
+	name := template.AdditionalProperties["display_name"]
+	if name == "" {
+		name = templateID
+	}
+
+	for attempt := 0; attempt < quickMatchAttempts; attempt++ {
+		slot, version, err := readChallengeQuickMatchSlot(ctx, nk, key)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read challenge quick match slot")
+			return nil, err
+		}
+
+		if slot.ChallengeID != "" {
+			if challenge := c.tryJoin(ctx, logger, nk, challengesSystem, userID, slot.ChallengeID, quickMatch); challenge != nil {
+				return challenge, nil
+			}
+		}
+
+		now := time.Now().Unix()
+		if slot.CreatingUntil > now {
+			// Another caller is creating the next challenge, wait for it rather than creating a second one.
+			time.Sleep(quickMatchBackoff * time.Duration(attempt+1))
+			continue
+		}
+
+		found, err := challengesSystem.Search(ctx, logger, nk, name, category, c.SearchLimit)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to search challenges")
+			return nil, err
+		}
+		// Fullest first, so concurrent callers converge on the same challenges.
+		sort.SliceStable(found, func(i, j int) bool {
+			if found[i].Size != found[j].Size {
+				return found[i].Size > found[j].Size
+			}
+			return found[i].Id < found[j].Id
+		})
+		for _, candidate := range found {
+			if candidate.Id == slot.ChallengeID || candidate.Metadata[quickMatchMetadataTemplate] != templateID ||
+				candidate.Metadata[quickMatchMetadataSkillBand] != strconv.Itoa(band) {
+				continue
+			}
+			if challenge := c.tryJoin(ctx, logger, nk, challengesSystem, userID, candidate.Id, quickMatch); challenge != nil {
+				return challenge, nil
+			}
+		}
+
+		// Claim the slot before creating, so only one caller creates at a time.
+		if version, err = writeChallengeQuickMatchSlot(ctx, nk, key, version, &ChallengeQuickMatchSlot{CreatingUntil: now + c.CreateLockSec}); err != nil {
+			continue
+		}
+
+		startDelaySec := quickMatch.StartDelaySec
+		if startDelaySec == 0 {
+			startDelaySec = template.StartDelayMax
+		}
+		durationSec := quickMatch.DurationSec
+		if durationSec == 0 {
+			durationSec = template.GetDuration().GetMinSec()
+		}
+		maxPlayers := quickMatch.MaxPlayers
+		if maxPlayers == 0 {
+			maxPlayers = template.GetPlayers().GetMax()
+		}
+		challenge, err := challengesSystem.Create(ctx, logger, nk, userID, templateID, name, template.AdditionalProperties["description"], category, true, startDelaySec, durationSec, nil, maxPlayers, map[string]string{
+			quickMatchMetadataTemplate:  templateID,
+			quickMatchMetadataSkillBand: strconv.Itoa(band),
+		})
+		if err != nil {
+			// Release the slot so the next caller can try.
+			if _, writeErr := writeChallengeQuickMatchSlot(ctx, nk, key, version, &ChallengeQuickMatchSlot{}); writeErr != nil {
+				logger.WithField("error", writeErr.Error()).Warn("Failed to release challenge quick match slot")
+			}
+			logger.WithField("error", err.Error()).Error("Failed to create challenge")
+			return nil, err
+		}
+		if _, err := writeChallengeQuickMatchSlot(ctx, nk, key, version, &ChallengeQuickMatchSlot{ChallengeID: challenge.Id}); err != nil {
+			// The challenge exists either way, others find it by search once the create lock expires.
+			logger.WithField("error", err.Error()).Warn("Failed to write challenge quick match slot")
+		}
+		logger.WithField("challenge_id", challenge.Id).Info("Created quick match challenge")
+		return challenge, nil
+	}
+	return nil, errQuickMatchBusy
+}
+
+// tryJoin joins the challenge if it is open, not full, and has enough time left. The caller is returned the challenge
+// as is if they already joined it.
+func (c *ChallengeQuickMatchConfig) tryJoin(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, challengesSystem hiro.ChallengesSystem, userID, challengeID string, quickMatch *ChallengeQuickMatchTemplate) *hiro.Challenge {
+	challenge, err := challengesSystem.Get(ctx, logger, nk, challengeID, userID, false)
+	if err != nil {
+		return nil
+	}
+	if challenge.State == hiro.ChallengeState_CHALLENGE_STATE_JOINED {
+		return challenge
+	}
+	if !challenge.Open || challenge.Size >= challenge.MaxSize || challenge.EndTimeSec-time.Now().Unix() < quickMatch.MinRemainingSec {
+		return nil
+	}
+	challenge, err = challengesSystem.Join(ctx, logger, nk, userID, challengeID)
+	if err != nil {
+		// Most likely filled up by another caller in the meantime.
+		logger.WithFields(map[string]interface{}{"challenge_id": challengeID, "error": err.Error()}).Debug("Failed to join quick match challenge")
+		return nil
+	}
+	return challenge
+}
+
+func readChallengeQuickMatchSlot(ctx context.Context, nk runtime.NakamaModule, key string) (*ChallengeQuickMatchSlot, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionChallengeQuickMatch, Key: key}})
+	if err != nil {
+		return nil, "", err
+	}
+	slot := &ChallengeQuickMatchSlot{}
+	if len(objects) == 0 {
+		return slot, "*", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), slot); err != nil {
+		return nil, "", err
+	}
+	return slot, objects[0].Version, nil
+}
+
+// writeChallengeQuickMatchSlot writes the slot only if it is still at version, and returns its new version.
+func writeChallengeQuickMatchSlot(ctx context.Context, nk runtime.NakamaModule, key, version string, slot *ChallengeQuickMatchSlot) (string, error) {
+	value, err := json.Marshal(slot)
+	if err != nil {
+		return "", err
+	}
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionChallengeQuickMatch,
+		Key:             key,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	if err != nil {
+		return "", err
+	}
+	return acks[0].Version, nil
+}
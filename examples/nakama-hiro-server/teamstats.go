@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// System-owned log of rejected team stat updates for moderation.
+	storageCollectionTeamStatViolations = "team_stat_violations"
+
+	statViolationUnknownStat   = "unknown_stat"
+	statViolationServerOnly    = "server_only"
+	statViolationOperator      = "operator_not_allowed"
+	statViolationMaxDelta      = "max_delta_exceeded"
+	statViolationMonotonic     = "not_monotonic"
+	statViolationRole          = "role_not_allowed"
+	statViolationDuplicate     = "duplicate_stat"
+	statViolationNotTeamMember = "not_team_member"
+)
+
+var (
+	statOperatorValues = map[string]hiro.StatUpdateOperator{
+		"set":   hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET,
+		"delta": hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_DELTA,
+		"min":   hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_MIN,
+		"max":   hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_MAX,
+	}
+	teamRoleValues = map[string]int32{"superadmin": 0, "admin": 1, "member": 2}
+)
+
+// TeamStatRulesConfig is the shape of definitions/<env>/team-stat-rules.json.
+type TeamStatRulesConfig struct {
+	// AllowUnknown lets clients write stats that have no rule. By default they are rejected.
+	AllowUnknown bool                     `json:"allow_unknown"`
+	Public       map[string]*TeamStatRule `json:"public"`
+	Private      map[string]*TeamStatRule `json:"private"`
+	// EventLeaderboardWins increments a stat on the server whenever a team claims a team event leaderboard it
+	// finished in the top MaxRank of.
+	EventLeaderboardWins *TeamStatEventLeaderboardWins `json:"event_leaderboard_wins"`
+}
+
+// TeamStatRule restricts how clients may update one stat. Zero values disable a check.
+type TeamStatRule struct {
+	// ServerOnly stats can only be changed by server code, never through the stats update RPC.
+	ServerOnly bool `json:"server_only"`
+	// Operators are any of "set", "delta", "min" and "max". An update without an operator counts as "set".
+	Operators []string `json:"operators"`
+	// MaxDelta caps how far one update may move the stat in either direction.
+	MaxDelta int64 `json:"max_delta"`
+	// Monotonic stats may only increase.
+	Monotonic bool `json:"monotonic"`
+	// Roles are any of "superadmin", "admin" and "member". Any team member may write the stat when empty.
+	Roles []string `json:"roles"`
+
+	operators map[hiro.StatUpdateOperator]bool
+	roles     map[int32]bool
+}
+
+type TeamStatEventLeaderboardWins struct {
+	Stat    string `json:"stat"`
+	Private bool   `json:"private"`
+	MaxRank int64  `json:"max_rank"`
+}
+
+// TeamStatViolation is one reason a stats update was rejected, returned to the client and logged for moderation.
+type TeamStatViolation struct {
+	Stat    string `json:"stat"`
+	Private bool   `json:"private"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+type TeamStatRejection struct {
+	UserID     string               `json:"user_id"`
+	TeamID     string               `json:"team_id"`
+	Violations []*TeamStatViolation `json:"violations"`
+	Time       int64                `json:"time"`
+}
+
+type teamStatRejectedError struct {
+	Violations []*TeamStatViolation `json:"violations"`
+}
+
+func (c *TeamStatRulesConfig) Validate() error {
+	var errs []error
+	for kind, rules := range map[string]map[string]*TeamStatRule{"public": c.Public, "private": c.Private} {
+		for name, rule := range rules {
+			rule.operators = make(map[hiro.StatUpdateOperator]bool, len(rule.Operators))
+			for _, operator := range rule.Operators {
+				value, found := statOperatorValues[operator]
+				if !found {
+					errs = append(errs, fmt.Errorf("%s stat %q: operator must be one of set, delta, min, max, got %q", kind, name, operator))
+				}
+				rule.operators[value] = true
+			}
+			rule.roles = make(map[int32]bool, len(rule.Roles))
+			for _, role := range rule.Roles {
+				value, found := teamRoleValues[role]
+				if !found {
+					errs = append(errs, fmt.Errorf("%s stat %q: role must be one of superadmin, admin, member, got %q", kind, name, role))
+				}
+				rule.roles[value] = true
+			}
+			if rule.MaxDelta < 0 {
+				errs = append(errs, fmt.Errorf("%s stat %q: max_delta must not be negative", kind, name))
+			}
+		}
+	}
+	if wins := c.EventLeaderboardWins; wins != nil {
+		rules := c.Public
+		if wins.Private {
+			rules = c.Private
+		}
+		if rule, found := rules[wins.Stat]; !found || !rule.ServerOnly {
+			errs = append(errs, fmt.Errorf("event_leaderboard_wins: stat %q must have a server_only rule", wins.Stat))
+		}
+		if wins.MaxRank < 1 {
+			errs = append(errs, errors.New("event_leaderboard_wins: max_rank must be at least 1"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Check returns every rule the updates break, given the team's current stats and the caller's role in the team. Each
+// stat may only be updated once per request, so max_delta and monotonic are checked against the value the stat had
+// before the request, and cannot be bypassed by splitting a change across several updates.
+func (c *TeamStatRulesConfig) Check(current *hiro.StatList, role int32, public, private []*hiro.StatUpdate) []*TeamStatViolation {
+	var violations []*TeamStatViolation
+	for _, group := range []struct {
+		private bool
+		rules   map[string]*TeamStatRule
+		stats   map[string]*hiro.Stat
+		updates []*hiro.StatUpdate
+	}{
+		{false, c.Public, current.GetPublic(), public},
+		{true, c.Private, current.GetPrivate(), private},
+	} {
+		updated := make(map[string]bool, len(group.updates))
+		for _, update := range group.updates {
+			violate := func(reason, format string, args ...interface{}) {
+				violations = append(violations, &TeamStatViolation{Stat: update.Name, Private: group.private, Reason: reason, Message: fmt.Sprintf(format, args...)})
+			}
+
+			if updated[update.Name] {
+				violate(statViolationDuplicate, "stat %q may only be updated once per request", update.Name)
+				continue
+			}
+			updated[update.Name] = true
+
+			rule, found := group.rules[update.Name]
+			if !found {
+				if !c.AllowUnknown {
+					violate(statViolationUnknownStat, "stat %q cannot be updated", update.Name)
+				}
+				continue
+			}
+			if rule.ServerOnly {
+				violate(statViolationServerOnly, "stat %q is only updated by the server", update.Name)
+				continue
+			}
+
+			operator := update.Operator
+			if operator == hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_UNSPECIFIED {
+				operator = hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET
+			}
+			if len(rule.operators) > 0 && !rule.operators[operator] {
+				violate(statViolationOperator, "stat %q does not allow operator %s", update.Name, operator)
+			}
+			if len(rule.roles) > 0 && !rule.roles[role] {
+				violate(statViolationRole, "stat %q cannot be updated by this team role", update.Name)
+			}
+
+			before := group.stats[update.Name].GetValue()
+			after := applyStatOperator(operator, before, update.Value)
+			if delta := after - before; rule.MaxDelta > 0 && (delta > rule.MaxDelta || -delta > rule.MaxDelta) {
+				violate(statViolationMaxDelta, "stat %q may change by at most %d per update, got %d", update.Name, rule.MaxDelta, delta)
+			}
+			if rule.Monotonic && after < before {
+				violate(statViolationMonotonic, "stat %q may not decrease from %d to %d", update.Name, before, after)
+			}
+		}
+	}
+	return violations
+}
+
+func applyStatOperator(operator hiro.StatUpdateOperator, current, value int64) int64 {
+	switch operator {
+	case hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_DELTA:
+		return current + value
+	case hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_MIN:
+		return min(current, value)
+	case hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_MAX:
+		return max(current, value)
+	default:
+		return value
+	}
+}
+
+// checkTeamStatsUpdate loads what the rules need and checks the update. It returns a structured error listing every
+// violation, after logging and recording them for moderation.
+func (c *TeamStatRulesConfig) checkTeamStatsUpdate(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, systems hiro.Hiro, userID string, request *hiro.TeamStatUpdateRequest) error {
+	role, member, err := teamRole(ctx, nk, userID, request.Id)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to list user teams")
+		return err
+	}
+
+	var violations []*TeamStatViolation
+	if !member {
+		violations = append(violations, &TeamStatViolation{Reason: statViolationNotTeamMember, Message: "only team members can update team stats"})
+	} else {
+		stats, err := systems.GetTeamsSystem().StatsList(ctx, logger, nk, userID, []string{request.Id})
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to list team stats")
+			return err
+		}
+		violations = c.Check(stats[request.Id], role, request.Public, request.Private)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	recordTeamStatRejection(ctx, logger, nk, &TeamStatRejection{UserID: userID, TeamID: request.Id, Violations: violations, Time: time.Now().Unix()})
+
+	message, err := json.Marshal(&teamStatRejectedError{Violations: violations})
+	if err != nil {
+		return err
+	}
+	return runtime.NewError(string(message), 3)
+}
+
+func teamRole(ctx context.Context, nk runtime.NakamaModule, userID, teamID string) (int32, bool, error) {
+	cursor := ""
+	for {
+		groups, nextCursor, err := nk.UserGroupsList(ctx, userID, teamMembersPageSize, nil, cursor)
+		if err != nil {
+			return 0, false, err
+		}
+		for _, group := range groups {
+			if group.GetGroup().GetId() == teamID {
+				state := group.GetState().GetValue()
+				return state, state <= teamStateMember, nil
+			}
+		}
+		if cursor = nextCursor; cursor == "" {
+			return 0, false, nil
+		}
+	}
+}
+
+func recordTeamStatRejection(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, rejection *TeamStatRejection) {
+	logger.WithFields(map[string]interface{}{
+		"user_id":    rejection.UserID,
+		"team_id":    rejection.TeamID,
+		"violations": rejection.Violations,
+	}).Warn("Team stats update rejected")
+
+	value, err := json.Marshal(rejection)
+	if err != nil {
+		return
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return
+	}
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionTeamStatViolations,
+		Key:             fmt.Sprintf("%d_%s", rejection.Time, id),
+		Value:           string(value),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to record team stat rejection")
+	}
+}
+
+// onEventLeaderboardReward counts a win for the team when it claims a team event leaderboard it finished near the top
+// of. The win is a server-only stat, so milestone rewards are evaluated here too.
+func (c *TeamStatRulesConfig) onEventLeaderboardReward(systems hiro.Hiro, milestones *TeamMilestonesConfig) hiro.OnTeamReward[*hiro.EventLeaderboardsConfigLeaderboard] {
+	return func(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID, teamID, sourceID string, source *hiro.EventLeaderboardsConfigLeaderboard, rewardConfig *hiro.EconomyConfigReward, reward *hiro.Reward) (*hiro.Reward, error) {
+		wins := c.EventLeaderboardWins
+		if wins == nil {
+			return reward, nil
+		}
+		logger = logger.WithFields(map[string]interface{}{"team_id": teamID, "event_leaderboard": sourceID})
+
+		teamsSystem := systems.GetTeamsSystem()
+		eventLeaderboard, err := teamsSystem.GetEventLeaderboard(ctx, logger, nk, userID, teamID, sourceID)
+		if err != nil {
+			// The reward itself is still granted.
+			logger.WithField("error", err.Error()).Error("Failed to get team event leaderboard")
+			return reward, nil
+		}
+		var rank int64
+		for _, score := range eventLeaderboard.GetScores() {
+			if score.GetId() == teamID {
+				rank = score.GetRank()
+				break
+			}
+		}
+		if rank < 1 || rank > wins.MaxRank {
+			return reward, nil
+		}
+
+		update := []*hiro.StatUpdate{{Name: wins.Stat, Value: 1, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_DELTA}}
+		var public, private []*hiro.StatUpdate
+		if wins.Private {
+			private = update
+		} else {
+			public = update
+		}
+		stats, err := teamsSystem.StatsUpdate(ctx, logger, nk, userID, teamID, public, private)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to count team event leaderboard win")
+			return reward, nil
+		}
+		if err := milestones.Grant(ctx, logger, nk, systems, userID, teamID, stats); err != nil {
+			logger.WithField("error", err.Error()).Warn("Failed to grant team milestone rewards")
+		}
+		return reward, nil
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// The current contents of each slot, keyed by slot name. The storage object version is the slot version clients
+	// send back to detect conflicting writes.
+	storageCollectionSaveSlots = "save_slots"
+	// The previous contents of each slot, newest first, keyed by slot name.
+	storageCollectionSaveSlotRevisions = "save_slot_revisions"
+
+	saveSlotsDefaultMaxSlots     = 5
+	saveSlotsDefaultMaxRevisions = 10
+	saveSlotsDefaultMaxDataBytes = 256 * 1024
+)
+
+var saveSlotNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// CloudSaveConfig is the shape of definitions/<env>/cloud-save.json.
+type CloudSaveConfig struct {
+	MaxSlots     int `json:"max_slots"`
+	MaxRevisions int `json:"max_revisions"`
+	MaxDataBytes int `json:"max_data_bytes"`
+}
+
+type SaveSlot struct {
+	Slot     string          `json:"slot"`
+	Version  string          `json:"version"`
+	Revision int64           `json:"revision"`
+	Data     json.RawMessage `json:"data"`
+	DeviceID string          `json:"device_id,omitempty"`
+	// UpdateTime is in unix seconds.
+	UpdateTime int64 `json:"update_time"`
+}
+
+type SaveSlotRevisions struct {
+	Revisions []*SaveSlot `json:"revisions"`
+}
+
+// SaveSlotConflict is returned instead of an error when the client's version is stale, so the client can pick which
+// payload to keep and write it again against the server's version.
+type SaveSlotConflict struct {
+	Server *SaveSlot       `json:"server"`
+	Client json.RawMessage `json:"client"`
+}
+
+type saveSlotWriteRequest struct {
+	Slot string `json:"slot"`
+	// Version is the version last read by the client, or empty when creating the slot.
+	Version  string          `json:"version"`
+	Data     json.RawMessage `json:"data"`
+	DeviceID string          `json:"device_id"`
+}
+
+type saveSlotWriteResponse struct {
+	Slot     *SaveSlot         `json:"slot,omitempty"`
+	Conflict *SaveSlotConflict `json:"conflict,omitempty"`
+}
+
+type saveSlotRequest struct {
+	Slot string `json:"slot"`
+}
+
+type saveSlotRollbackRequest struct {
+	Slot     string `json:"slot"`
+	Revision int64  `json:"revision"`
+	DeviceID string `json:"device_id"`
+}
+
+type saveSlotListResponse struct {
+	Slots []*SaveSlot `json:"slots"`
+}
+
+func loadCloudSaveConfig(nk runtime.NakamaModule, path string) (*CloudSaveConfig, error) {
+	config := &CloudSaveConfig{}
+	if err := loadDefinitions(nk, path, config); err != nil {
+		return nil, err
+	}
+	if config.MaxSlots <= 0 {
+		config.MaxSlots = saveSlotsDefaultMaxSlots
+	}
+	if config.MaxRevisions <= 0 {
+		config.MaxRevisions = saveSlotsDefaultMaxRevisions
+	}
+	if config.MaxDataBytes <= 0 {
+		config.MaxDataBytes = saveSlotsDefaultMaxDataBytes
+	}
+	return config, nil
+}
+
+// readSaveSlot returns the slot and its revisions, or nil for either that does not exist yet.
+func readSaveSlot(ctx context.Context, nk runtime.NakamaModule, userID, slot string) (*SaveSlot, *api.StorageObject, *api.StorageObject, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{
+		{Collection: storageCollectionSaveSlots, Key: slot, UserID: userID},
+		{Collection: storageCollectionSaveSlotRevisions, Key: slot, UserID: userID},
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var slotObject, revisionsObject *api.StorageObject
+	for _, object := range objects {
+		switch object.Collection {
+		case storageCollectionSaveSlots:
+			slotObject = object
+		case storageCollectionSaveSlotRevisions:
+			revisionsObject = object
+		}
+	}
+	if slotObject == nil {
+		return nil, nil, revisionsObject, nil
+	}
+
+	saveSlot, err := unmarshalSaveSlot(slotObject)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return saveSlot, slotObject, revisionsObject, nil
+}
+
+func unmarshalSaveSlot(object *api.StorageObject) (*SaveSlot, error) {
+	saveSlot := &SaveSlot{}
+	if err := json.Unmarshal([]byte(object.Value), saveSlot); err != nil {
+		return nil, fmt.Errorf("invalid save slot %q: %w", object.Key, err)
+	}
+	saveSlot.Slot = object.Key
+	saveSlot.Version = object.Version
+	return saveSlot, nil
+}
+
+// writeSaveSlot replaces the slot with data, pushing the current contents onto the slot's revisions. Both objects are
+// written in one transaction against the versions that were read, so a concurrent write fails rather than being lost.
+func (c *CloudSaveConfig) writeSaveSlot(ctx context.Context, nk runtime.NakamaModule, userID, slot string, current *SaveSlot, currentObject, revisionsObject *api.StorageObject, data json.RawMessage, deviceID string) (*SaveSlot, error) {
+	next := &SaveSlot{
+		Slot:       slot,
+		Revision:   1,
+		Data:       data,
+		DeviceID:   deviceID,
+		UpdateTime: time.Now().UTC().Unix(),
+	}
+	slotVersion := "*"
+	if current != nil {
+		next.Revision = current.Revision + 1
+		slotVersion = currentObject.Version
+	}
+
+	writes := make([]*runtime.StorageWrite, 0, 2)
+	if current != nil {
+		revisions := &SaveSlotRevisions{}
+		revisionsVersion := "*"
+		if revisionsObject != nil {
+			if err := json.Unmarshal([]byte(revisionsObject.Value), revisions); err != nil {
+				return nil, err
+			}
+			revisionsVersion = revisionsObject.Version
+		}
+		previous := *current
+		previous.Version = ""
+		revisions.Revisions = append([]*SaveSlot{&previous}, revisions.Revisions...)
+		if len(revisions.Revisions) > c.MaxRevisions {
+			revisions.Revisions = revisions.Revisions[:c.MaxRevisions]
+		}
+
+		value, err := json.Marshal(revisions)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, &runtime.StorageWrite{
+			Collection:      storageCollectionSaveSlotRevisions,
+			Key:             slot,
+			UserID:          userID,
+			Value:           string(value),
+			Version:         revisionsVersion,
+			PermissionRead:  1,
+			PermissionWrite: 0,
+		})
+	}
+
+	stored := *next
+	stored.Slot = ""
+	value, err := json.Marshal(&stored)
+	if err != nil {
+		return nil, err
+	}
+	writes = append(writes, &runtime.StorageWrite{
+		Collection:      storageCollectionSaveSlots,
+		Key:             slot,
+		UserID:          userID,
+		Value:           string(value),
+		Version:         slotVersion,
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	})
+
+	acks, _, err := nk.MultiUpdate(ctx, nil, writes, nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	next.Version = acks[len(acks)-1].Version
+	return next, nil
+}
+
+func checkSaveSlotName(slot string) error {
+	if !saveSlotNamePattern.MatchString(slot) {
+		return runtime.NewError("slot must be 1-64 letters, digits, '_' or '-'", 3)
+	}
+	return nil
+}
+
+// rpcSaveSlotList returns every slot of the calling player.
+func rpcSaveSlotList(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok {
+		return "", errors.New("no user ID in context")
+	}
+
+	response := &saveSlotListResponse{Slots: []*SaveSlot{}}
+	cursor := ""
+	for {
+		objects, nextCursor, err := nk.StorageList(ctx, "", userID, storageCollectionSaveSlots, listPageSize, cursor)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to list save slots")
+			return "", err
+		}
+		for _, object := range objects {
+			saveSlot, err := unmarshalSaveSlot(object)
+			if err != nil {
+				return "", err
+			}
+			response.Slots = append(response.Slots, saveSlot)
+		}
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// rpcSaveSlotRead returns one slot of the calling player.
+func rpcSaveSlotRead(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok {
+		return "", errors.New("no user ID in context")
+	}
+
+	var req saveSlotRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid request payload", 3)
+	}
+	if err := checkSaveSlotName(req.Slot); err != nil {
+		return "", err
+	}
+
+	saveSlot, _, _, err := readSaveSlot(ctx, nk, userID, req.Slot)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read save slot")
+		return "", err
+	}
+	if saveSlot == nil {
+		return "", runtime.NewError("save slot not found", 5)
+	}
+
+	data, err := json.Marshal(saveSlot)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// rpcSaveSlotWrite writes a slot if the client's version is still current, and returns a conflict otherwise.
+func rpcSaveSlotWrite(config *CloudSaveConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		var req saveSlotWriteRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request payload", 3)
+		}
+		if err := checkSaveSlotName(req.Slot); err != nil {
+			return "", err
+		}
+		if len(req.Data) == 0 {
+			return "", runtime.NewError("data is required", 3)
+		}
+		if len(req.Data) > config.MaxDataBytes {
+			return "", runtime.NewError(fmt.Sprintf("data must not exceed %d bytes", config.MaxDataBytes), 3)
+		}
+
+		current, currentObject, revisionsObject, err := readSaveSlot(ctx, nk, userID, req.Slot)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read save slot")
+			return "", err
+		}
+
+		response := &saveSlotWriteResponse{}
+		if current == nil && req.Version != "" || current != nil && current.Version != req.Version {
+			response.Conflict = &SaveSlotConflict{Server: current, Client: req.Data}
+		} else {
+			if current == nil {
+				if err := config.checkSlotCount(ctx, nk, userID); err != nil {
+					return "", err
+				}
+			}
+			response.Slot, err = config.writeSaveSlot(ctx, nk, userID, req.Slot, current, currentObject, revisionsObject, req.Data, req.DeviceID)
+			if err != nil {
+				if !errors.Is(err, runtime.ErrStorageRejectedVersion) {
+					logger.WithField("error", err.Error()).Error("Failed to write save slot")
+					return "", err
+				}
+				// Another device wrote between our read and write, report the state it left behind.
+				logger.WithField("error", err.Error()).Debug("Save slot write lost a race")
+				latest, _, _, readErr := readSaveSlot(ctx, nk, userID, req.Slot)
+				if readErr != nil {
+					return "", readErr
+				}
+				response.Conflict = &SaveSlotConflict{Server: latest, Client: req.Data}
+			}
+		}
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
+
+func (c *CloudSaveConfig) checkSlotCount(ctx context.Context, nk runtime.NakamaModule, userID string) error {
+	objects, _, err := nk.StorageList(ctx, "", userID, storageCollectionSaveSlots, c.MaxSlots, "")
+	if err != nil {
+		return err
+	}
+	if len(objects) >= c.MaxSlots {
+		return runtime.NewError(fmt.Sprintf("no more than %d save slots allowed", c.MaxSlots), 9)
+	}
+	return nil
+}
+
+// rpcSaveSlotRevisions returns the retained previous contents of a slot, newest first.
+func rpcSaveSlotRevisions(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok {
+		return "", errors.New("no user ID in context")
+	}
+
+	var req saveSlotRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid request payload", 3)
+	}
+	if err := checkSaveSlotName(req.Slot); err != nil {
+		return "", err
+	}
+
+	_, _, revisionsObject, err := readSaveSlot(ctx, nk, userID, req.Slot)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read save slot revisions")
+		return "", err
+	}
+
+	revisions := &SaveSlotRevisions{Revisions: []*SaveSlot{}}
+	if revisionsObject != nil {
+		if err := json.Unmarshal([]byte(revisionsObject.Value), revisions); err != nil {
+			return "", err
+		}
+	}
+	for _, revision := range revisions.Revisions {
+		revision.Slot = req.Slot
+	}
+
+	data, err := json.Marshal(revisions)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// rpcSaveSlotRollback restores a retained revision as the slot's current contents. The contents being replaced are
+// kept as a revision themselves, so a rollback can be undone.
+func rpcSaveSlotRollback(config *CloudSaveConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		var req saveSlotRollbackRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request payload", 3)
+		}
+		if err := checkSaveSlotName(req.Slot); err != nil {
+			return "", err
+		}
+
+		current, currentObject, revisionsObject, err := readSaveSlot(ctx, nk, userID, req.Slot)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read save slot")
+			return "", err
+		}
+		if current == nil || revisionsObject == nil {
+			return "", runtime.NewError("save slot revision not found", 5)
+		}
+
+		revisions := &SaveSlotRevisions{}
+		if err := json.Unmarshal([]byte(revisionsObject.Value), revisions); err != nil {
+			return "", err
+		}
+		var target *SaveSlot
+		for _, revision := range revisions.Revisions {
+			if revision.Revision == req.Revision {
+				target = revision
+				break
+			}
+		}
+		if target == nil {
+			return "", runtime.NewError("save slot revision not found", 5)
+		}
+
+		saveSlot, err := config.writeSaveSlot(ctx, nk, userID, req.Slot, current, currentObject, revisionsObject, target.Data, req.DeviceID)
+		if err != nil {
+			if !errors.Is(err, runtime.ErrStorageRejectedVersion) {
+				logger.WithField("error", err.Error()).Error("Failed to roll back save slot")
+				return "", err
+			}
+			logger.WithField("error", err.Error()).Debug("Save slot rollback lost a race")
+			return "", runtime.NewError("save slot changed during rollback, try again", 10)
+		}
+
+		data, err := json.Marshal(saveSlot)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
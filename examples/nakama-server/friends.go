@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// One user-owned object caches each player's latest suggestions until it expires.
+	storageCollectionFriendSuggestions = "friend_suggestions"
+	storageKeyFriendSuggestions        = "cache"
+
+	suggestionSourceFriendsOfFriends = "friends_of_friends"
+	suggestionSourceTournament       = "tournament"
+	suggestionSourceGroup            = "group"
+	suggestionSourceLeaderboard      = "leaderboard"
+
+	friendSuggestionsDefaultLimit    = 20
+	friendSuggestionsDefaultCacheTTL = 600
+	friendSuggestionsDefaultMaxPages = 5
+	friendSuggestionsDefaultNearby   = 10
+)
+
+// FriendSuggestionsConfig is the shape of definitions/<env>/friend-suggestions.json.
+type FriendSuggestionsConfig struct {
+	// Limit is the most suggestions computed and cached per player.
+	Limit       int `json:"limit"`
+	CacheTTLSec int `json:"cache_ttl_sec"`
+	// MaxPages bounds how many pages of candidates are listed from friends of friends and from each group's members.
+	// The player's own friend list is always listed in full, so nobody on it is ever suggested.
+	MaxPages         int                            `json:"max_pages"`
+	FriendsOfFriends *FriendSuggestionsSource       `json:"friends_of_friends"`
+	Tournaments      *FriendSuggestionsBoardsSource `json:"tournaments"`
+	Groups           *FriendSuggestionsSource       `json:"groups"`
+	Leaderboards     *FriendSuggestionsBoardsSource `json:"leaderboards"`
+}
+
+// FriendSuggestionsSource is one source of candidates. A missing source is not used.
+type FriendSuggestionsSource struct {
+	// Weight is added to a candidate's score each time this source finds them.
+	Weight float64 `json:"weight"`
+}
+
+type FriendSuggestionsBoardsSource struct {
+	FriendSuggestionsSource
+	IDs []string `json:"ids"`
+	// Nearby is how many records either side of the player's own record are taken as candidates.
+	Nearby int `json:"nearby"`
+}
+
+type FriendSuggestion struct {
+	UserID   string   `json:"user_id"`
+	Username string   `json:"username"`
+	Score    float64  `json:"score"`
+	Reasons  []string `json:"reasons"`
+}
+
+type FriendSuggestions struct {
+	Suggestions []*FriendSuggestion `json:"suggestions"`
+	// ExpireTime is when the cached suggestions are recomputed, in unix seconds.
+	ExpireTime int64 `json:"expire_time"`
+}
+
+type friendSuggestionsRequest struct {
+	Limit int `json:"limit"`
+	// Refresh ignores the cached suggestions.
+	Refresh bool `json:"refresh"`
+}
+
+func loadFriendSuggestionsConfig(nk runtime.NakamaModule, path string) (*FriendSuggestionsConfig, error) {
+	config := &FriendSuggestionsConfig{}
+	if err := loadDefinitions(nk, path, config); err != nil {
+		return nil, err
+	}
+	if config.Limit <= 0 {
+		config.Limit = friendSuggestionsDefaultLimit
+	}
+	if config.CacheTTLSec <= 0 {
+		config.CacheTTLSec = friendSuggestionsDefaultCacheTTL
+	}
+	if config.MaxPages <= 0 {
+		config.MaxPages = friendSuggestionsDefaultMaxPages
+	}
+	for _, source := range []*FriendSuggestionsBoardsSource{config.Tournaments, config.Leaderboards} {
+		if source != nil && source.Nearby <= 0 {
+			source.Nearby = friendSuggestionsDefaultNearby
+		}
+	}
+	return config, nil
+}
+
+// friendSuggestionCandidates accumulates weighted candidates across sources.
+type friendSuggestionCandidates struct {
+	userID     string
+	candidates map[string]*FriendSuggestion
+}
+
+func (c *friendSuggestionCandidates) add(userID, username, reason string, weight float64) {
+	if userID == c.userID || userID == "" {
+		return
+	}
+	candidate, found := c.candidates[userID]
+	if !found {
+		candidate = &FriendSuggestion{UserID: userID, Username: username}
+		c.candidates[userID] = candidate
+	}
+	candidate.Score += weight
+	for _, existing := range candidate.Reasons {
+		if existing == reason {
+			return
+		}
+	}
+	candidate.Reasons = append(candidate.Reasons, reason)
+}
+
+// rpcFriendSuggestions returns players the caller may know, best first.
+func rpcFriendSuggestions(config *FriendSuggestionsConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		var req friendSuggestionsRequest
+		if payload != "" {
+			if err := json.Unmarshal([]byte(payload), &req); err != nil {
+				return "", runtime.NewError("invalid request payload", 3)
+			}
+		}
+		if req.Limit <= 0 || req.Limit > config.Limit {
+			req.Limit = config.Limit
+		}
+
+		var suggestions *FriendSuggestions
+		if !req.Refresh {
+			var err error
+			if suggestions, err = readFriendSuggestions(ctx, nk, userID); err != nil {
+				logger.WithField("error", err.Error()).Warn("Failed to read cached friend suggestions")
+			}
+		}
+		if suggestions == nil {
+			var err error
+			if suggestions, err = config.suggest(ctx, logger, nk, userID); err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to compute friend suggestions")
+				return "", err
+			}
+			if err := writeFriendSuggestions(ctx, nk, userID, suggestions); err != nil {
+				logger.WithField("error", err.Error()).Warn("Failed to cache friend suggestions")
+			}
+		}
+
+		if len(suggestions.Suggestions) > req.Limit {
+			suggestions.Suggestions = suggestions.Suggestions[:req.Limit]
+		}
+		response, err := json.Marshal(suggestions)
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+// readFriendSuggestions returns the cached suggestions, or nil if there are none or they have expired.
+func readFriendSuggestions(ctx context.Context, nk runtime.NakamaModule, userID string) (*FriendSuggestions, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionFriendSuggestions, Key: storageKeyFriendSuggestions, UserID: userID}})
+	if err != nil || len(objects) == 0 {
+		return nil, err
+	}
+	suggestions := &FriendSuggestions{}
+	if err := json.Unmarshal([]byte(objects[0].Value), suggestions); err != nil {
+		return nil, err
+	}
+	if suggestions.ExpireTime <= time.Now().Unix() {
+		return nil, nil
+	}
+	return suggestions, nil
+}
+
+func writeFriendSuggestions(ctx context.Context, nk runtime.NakamaModule, userID string, suggestions *FriendSuggestions) error {
+	value, err := json.Marshal(suggestions)
+	if err != nil {
+		return err
+	}
+	_, err = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionFriendSuggestions,
+		Key:             storageKeyFriendSuggestions,
+		UserID:          userID,
+		Value:           string(value),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// clearFriendSuggestions drops the caller's cached suggestions, so players they have just added or blocked are not
+// suggested again before the cache expires.
+func clearFriendSuggestions(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) {
+	userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok {
+		return
+	}
+	if err := nk.StorageDelete(ctx, []*runtime.StorageDelete{{Collection: storageCollectionFriendSuggestions, Key: storageKeyFriendSuggestions, UserID: userID}}); err != nil {
+		logger.WithField("error", err.Error()).Warn("Failed to clear cached friend suggestions")
+	}
+}
+
+// suggest ranks candidates from every configured source. Anyone already on the player's friend list, whatever the
+// state of the relationship, is excluded: friends, invites either way, and blocked users.
+func (c *FriendSuggestionsConfig) suggest(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID string) (*FriendSuggestions, error) {
+	excluded, err := listFriendIDs(ctx, nk, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := &friendSuggestionCandidates{userID: userID, candidates: make(map[string]*FriendSuggestion)}
+	if c.FriendsOfFriends != nil {
+		if err := c.addFriendsOfFriends(ctx, nk, userID, candidates); err != nil {
+			return nil, err
+		}
+	}
+	if c.Groups != nil {
+		if err := c.addGroupMembers(ctx, nk, userID, candidates); err != nil {
+			return nil, err
+		}
+	}
+	// Boards the player has no record on are skipped rather than failing the whole request.
+	if c.Tournaments != nil {
+		for _, id := range c.Tournaments.IDs {
+			records, err := nk.TournamentRecordsHaystack(ctx, id, userID, 2*c.Tournaments.Nearby+1, "", 0)
+			if err != nil {
+				logger.WithFields(map[string]interface{}{"tournament": id, "error": err.Error()}).Debug("No tournament neighbours")
+				continue
+			}
+			for _, record := range records.Records {
+				candidates.add(record.OwnerId, record.GetUsername().GetValue(), suggestionSourceTournament, c.Tournaments.Weight)
+			}
+		}
+	}
+	if c.Leaderboards != nil {
+		for _, id := range c.Leaderboards.IDs {
+			records, err := nk.LeaderboardRecordsHaystack(ctx, id, userID, 2*c.Leaderboards.Nearby+1, "", 0)
+			if err != nil {
+				logger.WithFields(map[string]interface{}{"leaderboard": id, "error": err.Error()}).Debug("No leaderboard neighbours")
+				continue
+			}
+			for _, record := range records.Records {
+				candidates.add(record.OwnerId, record.GetUsername().GetValue(), suggestionSourceLeaderboard, c.Leaderboards.Weight)
+			}
+		}
+	}
+
+	suggestions := &FriendSuggestions{
+		Suggestions: make([]*FriendSuggestion, 0, len(candidates.candidates)),
+		ExpireTime:  time.Now().Unix() + int64(c.CacheTTLSec),
+	}
+	for id, candidate := range candidates.candidates {
+		if !excluded[id] {
+			suggestions.Suggestions = append(suggestions.Suggestions, candidate)
+		}
+	}
+	sort.Slice(suggestions.Suggestions, func(i, j int) bool {
+		a, b := suggestions.Suggestions[i], suggestions.Suggestions[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.UserID < b.UserID
+	})
+	if len(suggestions.Suggestions) > c.Limit {
+		suggestions.Suggestions = suggestions.Suggestions[:c.Limit]
+	}
+	return suggestions, nil
+}
+
+func listFriendIDs(ctx context.Context, nk runtime.NakamaModule, userID string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	cursor := ""
+	for {
+		friends, nextCursor, err := nk.FriendsList(ctx, userID, listPageSize, nil, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for _, friend := range friends {
+			ids[friend.GetUser().GetId()] = true
+		}
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+	return ids, nil
+}
+
+func (c *FriendSuggestionsConfig) addFriendsOfFriends(ctx context.Context, nk runtime.NakamaModule, userID string, candidates *friendSuggestionCandidates) error {
+	cursor := ""
+	for page := 0; page < c.MaxPages; page++ {
+		friends, nextCursor, err := nk.FriendsOfFriendsList(ctx, userID, listPageSize, cursor)
+		if err != nil {
+			return err
+		}
+		// A player reached through several mutual friends is added once per friend, and ranks higher for it.
+		for _, friend := range friends {
+			candidates.add(friend.GetUser().GetId(), friend.GetUser().GetUsername(), suggestionSourceFriendsOfFriends, c.FriendsOfFriends.Weight)
+		}
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *FriendSuggestionsConfig) addGroupMembers(ctx context.Context, nk runtime.NakamaModule, userID string, candidates *friendSuggestionCandidates) error {
+	groups, _, err := nk.UserGroupsList(ctx, userID, listPageSize, nil, "")
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if group.GetState().GetValue() > groupStateMember {
+			continue
+		}
+		cursor := ""
+		for page := 0; page < c.MaxPages; page++ {
+			members, nextCursor, err := nk.GroupUsersList(ctx, group.GetGroup().GetId(), listPageSize, nil, cursor)
+			if err != nil {
+				return err
+			}
+			for _, member := range members {
+				if member.GetState().GetValue() > groupStateMember {
+					continue
+				}
+				candidates.add(member.GetUser().GetId(), member.GetUser().GetUsername(), suggestionSourceGroup, c.Groups.Weight)
+			}
+			if cursor = nextCursor; cursor == "" {
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// One system-owned object per group holds its audit log, newest first.
+	storageCollectionGroupAudit = "group_audit"
+	// One user-owned object per group holds when the player last kicked or banned someone from it.
+	storageCollectionGroupCooldowns = "group_cooldowns"
+
+	groupActionCreate  = "create"
+	groupActionJoin    = "join"
+	groupActionLeave   = "leave"
+	groupActionAdd     = "add"
+	groupActionKick    = "kick"
+	groupActionBan     = "ban"
+	groupActionPromote = "promote"
+	groupActionDemote  = "demote"
+
+	groupStateSuperadmin = 0
+	groupStateAdmin      = 1
+	// Group membership states above this are join requests.
+	groupStateMember = 2
+
+	groupAuditDefaultMaxEntries = 500
+	groupAuditDefaultLimit      = 50
+	// Audit entries are appended with optimistic concurrency, retried when another action lands at the same time.
+	groupAuditWriteAttempts = 3
+)
+
+var (
+	errGroupNameInvalid        = runtime.NewError("group name is not allowed", 3)
+	errGroupDescriptionInvalid = runtime.NewError("group description is not allowed", 3)
+	errGroupNameTaken          = runtime.NewError("group name is already taken", 6)
+	errGroupLastSuperadmin     = runtime.NewError("a group must keep at least one superadmin", 9)
+	errGroupNotAdmin           = runtime.NewError("only group admins can view the audit log", 7)
+)
+
+// GroupsConfig is the shape of definitions/<env>/groups.json. Zero values disable the matching rule.
+type GroupsConfig struct {
+	NameMinLength        int `json:"name_min_length"`
+	NameMaxLength        int `json:"name_max_length"`
+	DescriptionMaxLength int `json:"description_max_length"`
+	// BlockedWords are rejected in names and descriptions, on top of the profane username words. Names also reject
+	// the reserved username words.
+	BlockedWords []string `json:"blocked_words"`
+	// UniqueNames rejects names that differ from an existing group's only by case.
+	UniqueNames bool `json:"unique_names"`
+	// MaxGroupsPerUser caps how many existing groups a player may have created.
+	MaxGroupsPerUser int   `json:"max_groups_per_user"`
+	MinAccountAgeSec int64 `json:"min_account_age_sec"`
+	KickCooldownSec  int64 `json:"kick_cooldown_sec"`
+	BanCooldownSec   int64 `json:"ban_cooldown_sec"`
+	AuditMaxEntries  int   `json:"audit_max_entries"`
+
+	nameFilter        *UsernameFilter
+	descriptionFilter *UsernameFilter
+}
+
+type GroupAuditEntry struct {
+	Action  string   `json:"action"`
+	ActorID string   `json:"actor_id"`
+	UserIDs []string `json:"user_ids,omitempty"`
+	// CreateTime is in unix seconds.
+	CreateTime int64 `json:"create_time"`
+}
+
+type GroupAudit struct {
+	GroupID string             `json:"group_id"`
+	Entries []*GroupAuditEntry `json:"entries"`
+}
+
+type GroupCooldowns struct {
+	// LastKick and LastBan are in unix seconds.
+	LastKick int64 `json:"last_kick"`
+	LastBan  int64 `json:"last_ban"`
+}
+
+type groupAuditListRequest struct {
+	GroupID string `json:"group_id"`
+	Limit   int    `json:"limit"`
+	// Offset skips that many of the newest entries.
+	Offset int `json:"offset"`
+}
+
+func loadGroupsConfig(nk runtime.NakamaModule, path string) (*GroupsConfig, error) {
+	config := &GroupsConfig{}
+	if err := loadDefinitions(nk, path, config); err != nil {
+		return nil, err
+	}
+	if config.AuditMaxEntries <= 0 {
+		config.AuditMaxEntries = groupAuditDefaultMaxEntries
+	}
+	config.nameFilter = NewUsernameFilter(usernameReservedWords, usernameProfanityWords, config.BlockedWords)
+	config.descriptionFilter = NewUsernameFilter(usernameProfanityWords, config.BlockedWords)
+	return config, nil
+}
+
+// Register adds the group policy and audit hooks.
+func (c *GroupsConfig) Register(initializer runtime.Initializer) error {
+	if err := initializer.RegisterBeforeCreateGroup(c.beforeCreateGroup); err != nil {
+		return err
+	}
+	if err := initializer.RegisterAfterCreateGroup(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, out *api.Group, in *api.CreateGroupRequest) error {
+		c.audit(ctx, logger, nk, out.Id, groupActionCreate, nil)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := initializer.RegisterBeforeUpdateGroup(c.beforeUpdateGroup); err != nil {
+		return err
+	}
+	if err := initializer.RegisterAfterJoinGroup(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.JoinGroupRequest) error {
+		c.audit(ctx, logger, nk, in.GroupId, groupActionJoin, nil)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := initializer.RegisterAfterLeaveGroup(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.LeaveGroupRequest) error {
+		c.audit(ctx, logger, nk, in.GroupId, groupActionLeave, nil)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := initializer.RegisterAfterAddGroupUsers(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AddGroupUsersRequest) error {
+		c.audit(ctx, logger, nk, in.GroupId, groupActionAdd, in.UserIds)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := initializer.RegisterBeforeKickGroupUsers(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.KickGroupUsersRequest) (*api.KickGroupUsersRequest, error) {
+		if err := c.checkModeration(ctx, logger, nk, in.GroupId, in.UserIds, groupActionKick); err != nil {
+			return nil, err
+		}
+		return in, nil
+	}); err != nil {
+		return err
+	}
+	if err := initializer.RegisterAfterKickGroupUsers(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.KickGroupUsersRequest) error {
+		c.recordModeration(ctx, logger, nk, in.GroupId, groupActionKick)
+		c.audit(ctx, logger, nk, in.GroupId, groupActionKick, in.UserIds)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := initializer.RegisterBeforeBanGroupUsers(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.BanGroupUsersRequest) (*api.BanGroupUsersRequest, error) {
+		if err := c.checkModeration(ctx, logger, nk, in.GroupId, in.UserIds, groupActionBan); err != nil {
+			return nil, err
+		}
+		return in, nil
+	}); err != nil {
+		return err
+	}
+	if err := initializer.RegisterAfterBanGroupUsers(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.BanGroupUsersRequest) error {
+		c.recordModeration(ctx, logger, nk, in.GroupId, groupActionBan)
+		c.audit(ctx, logger, nk, in.GroupId, groupActionBan, in.UserIds)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := initializer.RegisterAfterPromoteGroupUsers(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.PromoteGroupUsersRequest) error {
+		c.audit(ctx, logger, nk, in.GroupId, groupActionPromote, in.UserIds)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := initializer.RegisterBeforeDemoteGroupUsers(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.DemoteGroupUsersRequest) (*api.DemoteGroupUsersRequest, error) {
+		if err := checkLastSuperadmin(ctx, nk, in.GroupId, in.UserIds); err != nil {
+			return nil, err
+		}
+		return in, nil
+	}); err != nil {
+		return err
+	}
+	if err := initializer.RegisterAfterDemoteGroupUsers(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.DemoteGroupUsersRequest) error {
+		c.audit(ctx, logger, nk, in.GroupId, groupActionDemote, in.UserIds)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return initializer.RegisterRpc("rpc_group_audit_list", c.rpcGroupAuditList)
+}
+
+func (c *GroupsConfig) beforeCreateGroup(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.CreateGroupRequest) (*api.CreateGroupRequest, error) {
+	userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok {
+		return nil, errors.New("no user ID in context")
+	}
+
+	if err := c.checkName(ctx, nk, in.Name, ""); err != nil {
+		return nil, err
+	}
+	if err := c.checkDescription(in.Description); err != nil {
+		return nil, err
+	}
+
+	if c.MinAccountAgeSec > 0 {
+		account, err := nk.AccountGetId(ctx, userID)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to get account")
+			return nil, err
+		}
+		if age := time.Since(account.GetUser().GetCreateTime().AsTime()); age < time.Duration(c.MinAccountAgeSec)*time.Second {
+			return nil, runtime.NewError(fmt.Sprintf("accounts must be at least %s old to create a group", time.Duration(c.MinAccountAgeSec)*time.Second), 9)
+		}
+	}
+
+	if c.MaxGroupsPerUser > 0 {
+		created, err := countGroupsCreated(ctx, nk, userID)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to list user groups")
+			return nil, err
+		}
+		if created >= c.MaxGroupsPerUser {
+			return nil, runtime.NewError(fmt.Sprintf("no more than %d groups may be created per player", c.MaxGroupsPerUser), 9)
+		}
+	}
+
+	return in, nil
+}
+
+func (c *GroupsConfig) beforeUpdateGroup(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.UpdateGroupRequest) (*api.UpdateGroupRequest, error) {
+	if in.Name != nil {
+		if err := c.checkName(ctx, nk, in.Name.Value, in.GroupId); err != nil {
+			return nil, err
+		}
+	}
+	if in.Description != nil {
+		if err := c.checkDescription(in.Description.Value); err != nil {
+			return nil, err
+		}
+	}
+	return in, nil
+}
+
+// checkName validates a group name, ignoring groupID when checking uniqueness so a group may keep its own name.
+func (c *GroupsConfig) checkName(ctx context.Context, nk runtime.NakamaModule, name, groupID string) error {
+	length := utf8.RuneCountInString(name)
+	if c.NameMinLength > 0 && length < c.NameMinLength || c.NameMaxLength > 0 && length > c.NameMaxLength || !c.nameFilter.Allowed(name) {
+		return errGroupNameInvalid
+	}
+	if !c.UniqueNames {
+		return nil
+	}
+
+	groups, _, err := nk.GroupsList(ctx, name, "", nil, nil, listPageSize, "")
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if group.Id != groupID && strings.EqualFold(group.Name, name) {
+			return errGroupNameTaken
+		}
+	}
+	return nil
+}
+
+func (c *GroupsConfig) checkDescription(description string) error {
+	if c.DescriptionMaxLength > 0 && utf8.RuneCountInString(description) > c.DescriptionMaxLength || !c.descriptionFilter.Allowed(description) {
+		return errGroupDescriptionInvalid
+	}
+	return nil
+}
+
+func countGroupsCreated(ctx context.Context, nk runtime.NakamaModule, userID string) (int, error) {
+	state := groupStateSuperadmin
+	var created int
+	cursor := ""
+	for {
+		groups, nextCursor, err := nk.UserGroupsList(ctx, userID, listPageSize, &state, cursor)
+		if err != nil {
+			return 0, err
+		}
+		for _, group := range groups {
+			if group.GetGroup().GetCreatorId() == userID {
+				created++
+			}
+		}
+		if cursor = nextCursor; cursor == "" {
+			return created, nil
+		}
+	}
+}
+
+// checkModeration enforces the kick or ban cooldown of the caller in a group, and keeps them from removing the last
+// superadmin.
+func (c *GroupsConfig) checkModeration(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, groupID string, userIDs []string, action string) error {
+	userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok {
+		return errors.New("no user ID in context")
+	}
+
+	cooldown := c.KickCooldownSec
+	if action == groupActionBan {
+		cooldown = c.BanCooldownSec
+	}
+	if cooldown > 0 {
+		cooldowns, _, err := readGroupCooldowns(ctx, nk, userID, groupID)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read group cooldowns")
+			return err
+		}
+		last := cooldowns.LastKick
+		if action == groupActionBan {
+			last = cooldowns.LastBan
+		}
+		if remaining := last + cooldown - time.Now().Unix(); remaining > 0 {
+			return runtime.NewError(fmt.Sprintf("%s is on cooldown for another %ds", action, remaining), 9)
+		}
+	}
+
+	return checkLastSuperadmin(ctx, nk, groupID, userIDs)
+}
+
+// recordModeration starts the caller's kick or ban cooldown once the action has gone through.
+func (c *GroupsConfig) recordModeration(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, groupID, action string) {
+	userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok || c.KickCooldownSec <= 0 && c.BanCooldownSec <= 0 {
+		return
+	}
+
+	cooldowns, version, err := readGroupCooldowns(ctx, nk, userID, groupID)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read group cooldowns")
+		return
+	}
+	if action == groupActionBan {
+		cooldowns.LastBan = time.Now().Unix()
+	} else {
+		cooldowns.LastKick = time.Now().Unix()
+	}
+
+	value, err := json.Marshal(cooldowns)
+	if err != nil {
+		return
+	}
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionGroupCooldowns,
+		Key:             groupID,
+		UserID:          userID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}}); err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to write group cooldowns")
+	}
+}
+
+func readGroupCooldowns(ctx context.Context, nk runtime.NakamaModule, userID, groupID string) (*GroupCooldowns, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionGroupCooldowns, Key: groupID, UserID: userID}})
+	if err != nil {
+		return nil, "", err
+	}
+	cooldowns := &GroupCooldowns{}
+	if len(objects) == 0 {
+		return cooldowns, "*", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), cooldowns); err != nil {
+		return nil, "", err
+	}
+	return cooldowns, objects[0].Version, nil
+}
+
+// checkLastSuperadmin fails if userIDs include every superadmin of the group.
+func checkLastSuperadmin(ctx context.Context, nk runtime.NakamaModule, groupID string, userIDs []string) error {
+	targets := make(map[string]bool, len(userIDs))
+	for _, id := range userIDs {
+		targets[id] = true
+	}
+
+	state := groupStateSuperadmin
+	var remaining, targeted int
+	cursor := ""
+	for {
+		users, nextCursor, err := nk.GroupUsersList(ctx, groupID, listPageSize, &state, cursor)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if targets[user.GetUser().GetId()] {
+				targeted++
+			} else {
+				remaining++
+			}
+		}
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+
+	if targeted > 0 && remaining == 0 {
+		return errGroupLastSuperadmin
+	}
+	return nil
+}
+
+// audit appends an entry for an action taken by the caller. Failures are logged rather than returned, since the action
+// itself has already happened.
+func (c *GroupsConfig) audit(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, groupID, action string, userIDs []string) {
+	actorID, _ := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	entry := &GroupAuditEntry{Action: action, ActorID: actorID, UserIDs: userIDs, CreateTime: time.Now().Unix()}
+
+	var err error
+	for attempt := 0; attempt < groupAuditWriteAttempts; attempt++ {
+		if err = c.appendAudit(ctx, nk, groupID, entry); err == nil {
+			return
+		}
+	}
+	logger.WithFields(map[string]interface{}{"group_id": groupID, "action": action, "error": err.Error()}).Error("Failed to write group audit entry")
+}
+
+func (c *GroupsConfig) appendAudit(ctx context.Context, nk runtime.NakamaModule, groupID string, entry *GroupAuditEntry) error {
+	audit, version, err := readGroupAudit(ctx, nk, groupID)
+	if err != nil {
+		return err
+	}
+	audit.Entries = append([]*GroupAuditEntry{entry}, audit.Entries...)
+	if len(audit.Entries) > c.AuditMaxEntries {
+		audit.Entries = audit.Entries[:c.AuditMaxEntries]
+	}
+
+	value, err := json.Marshal(audit)
+	if err != nil {
+		return err
+	}
+	_, err = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionGroupAudit,
+		Key:             groupID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+func readGroupAudit(ctx context.Context, nk runtime.NakamaModule, groupID string) (*GroupAudit, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionGroupAudit, Key: groupID}})
+	if err != nil {
+		return nil, "", err
+	}
+	audit := &GroupAudit{GroupID: groupID, Entries: []*GroupAuditEntry{}}
+	if len(objects) == 0 {
+		return audit, "*", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), audit); err != nil {
+		return nil, "", err
+	}
+	return audit, objects[0].Version, nil
+}
+
+// rpcGroupAuditList returns a page of a group's audit log, newest first. Only the group's admins may read it.
+func (c *GroupsConfig) rpcGroupAuditList(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok {
+		return "", errors.New("no user ID in context")
+	}
+
+	var req groupAuditListRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid request payload", 3)
+	}
+	if req.GroupID == "" {
+		return "", runtime.NewError("group_id is required", 3)
+	}
+	if req.Limit <= 0 || req.Limit > listPageSize {
+		req.Limit = groupAuditDefaultLimit
+	}
+	if req.Offset < 0 {
+		req.Offset = 0
+	}
+
+	admin, err := isGroupAdmin(ctx, nk, userID, req.GroupID)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to list user groups")
+		return "", err
+	}
+	if !admin {
+		return "", errGroupNotAdmin
+	}
+
+	audit, _, err := readGroupAudit(ctx, nk, req.GroupID)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read group audit log")
+		return "", err
+	}
+	if req.Offset > len(audit.Entries) {
+		req.Offset = len(audit.Entries)
+	}
+	audit.Entries = audit.Entries[req.Offset:]
+	if len(audit.Entries) > req.Limit {
+		audit.Entries = audit.Entries[:req.Limit]
+	}
+
+	response, err := json.Marshal(audit)
+	if err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
+
+func isGroupAdmin(ctx context.Context, nk runtime.NakamaModule, userID, groupID string) (bool, error) {
+	cursor := ""
+	for {
+		groups, nextCursor, err := nk.UserGroupsList(ctx, userID, listPageSize, nil, cursor)
+		if err != nil {
+			return false, err
+		}
+		for _, group := range groups {
+			if group.GetGroup().GetId() == groupID {
+				return group.GetState().GetValue() <= groupStateAdmin, nil
+			}
+		}
+		if cursor = nextCursor; cursor == "" {
+			return false, nil
+		}
+	}
+}
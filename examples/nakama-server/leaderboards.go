@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// Leaderboards created from the definitions file carry this metadata key, so boards that are later removed from
+	// the file can be told apart from ones created by other code or the console.
+	metadataKeyManagedBy = "managed_by"
+	managedByDefinitions = "definitions"
+
+	onDriftLog      = "log"
+	onDriftRecreate = "recreate"
+
+	onRemovedFlag   = "flag"
+	onRemovedDelete = "delete"
+
+	listPageSize = 100
+)
+
+// LeaderboardsConfig is the shape of definitions/<env>/leaderboards.json.
+type LeaderboardsConfig struct {
+	// OnDrift controls what happens when an existing leaderboard differs from its definition. Nakama has no API to
+	// update a leaderboard in place, so "recreate" deletes and recreates it, losing its records. Metadata differences
+	// alone never trigger a recreate, since the definition's metadata is used regardless; see metadataFor.
+	OnDrift string `json:"on_drift"`
+	// OnRemoved controls what happens to managed leaderboards that are no longer defined.
+	OnRemoved    string                           `json:"on_removed"`
+	Leaderboards []*LeaderboardsConfigLeaderboard `json:"leaderboards"`
+	Tournaments  []*LeaderboardsConfigTournament  `json:"tournaments"`
+}
+
+type LeaderboardsConfigLeaderboard struct {
+	ID            string                 `json:"id"`
+	Authoritative bool                   `json:"authoritative"`
+	SortOrder     string                 `json:"sort_order"`
+	Operator      string                 `json:"operator"`
+	ResetSchedule string                 `json:"reset_schedule"`
+	Metadata      map[string]interface{} `json:"metadata"`
+	EnableRanks   bool                   `json:"enable_ranks"`
+}
+
+type LeaderboardsConfigTournament struct {
+	LeaderboardsConfigLeaderboard
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Category    int    `json:"category"`
+	// StartTime of 0 starts the tournament when it is first created.
+	StartTime int `json:"start_time"`
+	// EndTime of 0 repeats the tournament forever.
+	EndTime      int  `json:"end_time"`
+	Duration     int  `json:"duration"`
+	MaxSize      int  `json:"max_size"`
+	MaxNumScore  int  `json:"max_num_score"`
+	JoinRequired bool `json:"join_required"`
+}
+
+var (
+	sortOrderValues = map[string]uint32{"asc": 0, "desc": 1}
+	operatorValues  = map[string]api.Operator{
+		"best": api.Operator_BEST,
+		"set":  api.Operator_SET,
+		"incr": api.Operator_INCREMENT,
+		"decr": api.Operator_DECREMENT,
+	}
+)
+
+func loadLeaderboardsConfig(nk runtime.NakamaModule, path string) (*LeaderboardsConfig, error) {
+	config := &LeaderboardsConfig{}
+	if err := loadDefinitions(nk, path, config); err != nil {
+		return nil, err
+	}
+	if config.OnDrift == "" {
+		config.OnDrift = onDriftLog
+	}
+	if config.OnRemoved == "" {
+		config.OnRemoved = onRemovedFlag
+	}
+
+	return config, nil
+}
+
+// Validate checks every definition and returns all problems found joined into a single error.
+func (c *LeaderboardsConfig) Validate(nk runtime.NakamaModule) error {
+	var errs []error
+
+	switch c.OnDrift {
+	case onDriftLog, onDriftRecreate:
+	default:
+		errs = append(errs, fmt.Errorf("on_drift: unknown value %q", c.OnDrift))
+	}
+	switch c.OnRemoved {
+	case onRemovedFlag, onRemovedDelete:
+	default:
+		errs = append(errs, fmt.Errorf("on_removed: unknown value %q", c.OnRemoved))
+	}
+
+	seen := make(map[string]bool, len(c.Leaderboards)+len(c.Tournaments))
+	checkID := func(kind, id string) {
+		if id == "" {
+			errs = append(errs, fmt.Errorf("%s: missing id", kind))
+			return
+		}
+		if seen[id] {
+			errs = append(errs, fmt.Errorf("%s %q: duplicate id", kind, id))
+		}
+		seen[id] = true
+	}
+
+	for _, l := range c.Leaderboards {
+		checkID("leaderboard", l.ID)
+		errs = append(errs, l.validate(nk, "leaderboard")...)
+	}
+
+	for _, t := range c.Tournaments {
+		checkID("tournament", t.ID)
+		errs = append(errs, t.validate(nk, "tournament")...)
+
+		if t.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("tournament %q: duration must be greater than 0", t.ID))
+		}
+		if t.Category < 0 || t.Category > 127 {
+			errs = append(errs, fmt.Errorf("tournament %q: category must be between 0 and 127", t.ID))
+		}
+		if t.MaxSize < 0 {
+			errs = append(errs, fmt.Errorf("tournament %q: max_size must not be negative", t.ID))
+		}
+		if t.MaxNumScore < 0 {
+			errs = append(errs, fmt.Errorf("tournament %q: max_num_score must not be negative", t.ID))
+		}
+		if t.EndTime != 0 && t.EndTime <= t.StartTime {
+			errs = append(errs, fmt.Errorf("tournament %q: end_time must be after start_time", t.ID))
+		}
+
+		prizes, err := parseTournamentPrizes(t.Metadata)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tournament %q: invalid prizes: %w", t.ID, err))
+		}
+		for _, err := range validateTournamentPrizes(prizes) {
+			errs = append(errs, fmt.Errorf("tournament %q: %w", t.ID, err))
+		}
+
+		overflow, err := parseOverflowConfig(t.Metadata)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tournament %q: invalid overflow: %w", t.ID, err))
+		}
+		if overflow != nil && t.MaxSize == 0 {
+			errs = append(errs, fmt.Errorf("tournament %q: overflow requires a max_size", t.ID))
+		}
+
+		// A tournament must finish before its next reset starts a new one.
+		if t.ResetSchedule != "" && t.Duration > 0 {
+			now := time.Now().UTC().Unix()
+			next, err1 := nk.CronNext(t.ResetSchedule, now)
+			after, err2 := nk.CronNext(t.ResetSchedule, next)
+			if err1 == nil && err2 == nil && int64(t.Duration) > after-next {
+				errs = append(errs, fmt.Errorf("tournament %q: duration %ds is longer than the %ds between resets", t.ID, t.Duration, after-next))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (l *LeaderboardsConfigLeaderboard) validate(nk runtime.NakamaModule, kind string) []error {
+	var errs []error
+	if _, found := sortOrderValues[l.SortOrder]; !found {
+		errs = append(errs, fmt.Errorf("%s %q: sort_order must be one of asc, desc, got %q", kind, l.ID, l.SortOrder))
+	}
+	if _, found := operatorValues[l.Operator]; !found {
+		errs = append(errs, fmt.Errorf("%s %q: operator must be one of best, set, incr, decr, got %q", kind, l.ID, l.Operator))
+	}
+	if l.ResetSchedule != "" {
+		if _, err := nk.CronNext(l.ResetSchedule, time.Now().UTC().Unix()); err != nil {
+			errs = append(errs, fmt.Errorf("%s %q: invalid reset_schedule %q: %w", kind, l.ID, l.ResetSchedule, err))
+		}
+	}
+	if _, err := parseSeasonArchiveConfig(l.Metadata); err != nil {
+		errs = append(errs, fmt.Errorf("%s %q: invalid season_archive: %w", kind, l.ID, err))
+	}
+	if rules, err := parseScoreRules(l.Metadata); err != nil {
+		errs = append(errs, fmt.Errorf("%s %q: invalid score_rules: %w", kind, l.ID, err))
+	} else {
+		if rules.MinRunDurationSec >= rules.RunTTLSec {
+			errs = append(errs, fmt.Errorf("%s %q: score_rules min_run_duration_sec must be less than run_ttl_sec", kind, l.ID))
+		}
+		if rules.MaxScore < 0 || rules.MaxImprovement < 0 || rules.RunStartIntervalSec < 0 || rules.MinIntervalSec < 0 || rules.MaxPerHour < 0 {
+			errs = append(errs, fmt.Errorf("%s %q: score_rules must not be negative", kind, l.ID))
+		}
+	}
+	for _, key := range []string{metadataKeyManagedBy, metadataKeyShardOf} {
+		if _, found := l.Metadata[key]; found {
+			errs = append(errs, fmt.Errorf("%s %q: metadata key %q is reserved", kind, l.ID, key))
+		}
+	}
+	return errs
+}
+
+// managedMetadata returns the definition metadata with the managed marker added.
+func (l *LeaderboardsConfigLeaderboard) managedMetadata() map[string]interface{} {
+	metadata := make(map[string]interface{}, len(l.Metadata)+1)
+	for k, v := range l.Metadata {
+		metadata[k] = v
+	}
+	metadata[metadataKeyManagedBy] = managedByDefinitions
+	return metadata
+}
+
+// metadataFor returns the metadata that governs a leaderboard or tournament. For defined boards, and shards of defined
+// tournaments, the definition is authoritative: Nakama cannot update a board's metadata in place, so the live copy only
+// holds what the board was created with. Edits to prizes, score_rules or season_archive in the definitions file take
+// effect on the next boot without a recreate, but clients listing the board still see the metadata it was created with
+// until it is recreated. Boards not in the definitions file use their live metadata.
+func (c *LeaderboardsConfig) metadataFor(id, live string) (map[string]interface{}, error) {
+	if l, _ := c.board(id); l != nil {
+		return l.Metadata, nil
+	}
+
+	var metadata map[string]interface{}
+	if live != "" {
+		if err := json.Unmarshal([]byte(live), &metadata); err != nil {
+			return nil, err
+		}
+	}
+	return metadata, nil
+}
+
+// drift describes how an existing leaderboard differs from its definition.
+func (l *LeaderboardsConfigLeaderboard) drift(nk runtime.NakamaModule, authoritative bool, sortOrder uint32, operator api.Operator, nextReset uint32) []string {
+	var diffs []string
+	if authoritative != l.Authoritative {
+		diffs = append(diffs, fmt.Sprintf("authoritative is %v, want %v", authoritative, l.Authoritative))
+	}
+	if want := sortOrderValues[l.SortOrder]; sortOrder != want {
+		diffs = append(diffs, fmt.Sprintf("sort_order is %d, want %q", sortOrder, l.SortOrder))
+	}
+	if want := operatorValues[l.Operator]; operator != want {
+		diffs = append(diffs, fmt.Sprintf("operator is %s, want %q", operator, l.Operator))
+	}
+
+	// The reset schedule itself is not exposed, so compare the next reset it would produce instead.
+	var wantNextReset int64
+	if l.ResetSchedule != "" {
+		wantNextReset, _ = nk.CronNext(l.ResetSchedule, time.Now().UTC().Unix())
+	}
+	if int64(nextReset) != wantNextReset {
+		diffs = append(diffs, fmt.Sprintf("next reset is %d, want %d from %q", nextReset, wantNextReset, l.ResetSchedule))
+	}
+
+	return diffs
+}
+
+// metadataDrift reports whether a board's live metadata differs from its definition. The definition is used either
+// way, see metadataFor, so this alone never needs a recreate.
+func (l *LeaderboardsConfigLeaderboard) metadataDrift(metadata string) bool {
+	var existing map[string]interface{}
+	if metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &existing); err != nil {
+			return true
+		}
+	}
+	// Round-trip the definition so numbers compare as float64 on both sides.
+	var want map[string]interface{}
+	if data, err := json.Marshal(l.managedMetadata()); err == nil {
+		_ = json.Unmarshal(data, &want)
+	}
+	return !reflect.DeepEqual(existing, want)
+}
+
+func (l *LeaderboardsConfigLeaderboard) create(ctx context.Context, nk runtime.NakamaModule) error {
+	return nk.LeaderboardCreate(ctx, l.ID, l.Authoritative, l.SortOrder, l.Operator, l.ResetSchedule, l.managedMetadata(), l.EnableRanks)
+}
+
+func (t *LeaderboardsConfigTournament) create(ctx context.Context, nk runtime.NakamaModule) error {
+	return nk.TournamentCreate(ctx, t.ID, t.Authoritative, t.SortOrder, t.Operator, t.ResetSchedule, t.managedMetadata(), t.Title, t.Description, t.Category, t.startTime(), t.EndTime, t.Duration, t.MaxSize, t.MaxNumScore, t.JoinRequired, t.EnableRanks)
+}
+
+func (t *LeaderboardsConfigTournament) startTime() int {
+	if t.StartTime == 0 {
+		return int(time.Now().UTC().Unix()) // start now
+	}
+	return t.StartTime
+}
+
+// Reconcile brings the leaderboards and tournaments in Nakama in line with the definitions. Missing boards are created,
+// drifted boards are logged or recreated, and managed boards no longer defined are flagged or deleted. All failures are
+// collected and returned together.
+func (c *LeaderboardsConfig) Reconcile(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	var errs []error
+
+	existingLeaderboards, err := listLeaderboards(nk)
+	if err != nil {
+		return err
+	}
+	existingTournaments, err := listTournaments(ctx, nk)
+	if err != nil {
+		return err
+	}
+
+	defined := make(map[string]bool, len(c.Leaderboards)+len(c.Tournaments))
+
+	for _, l := range c.Leaderboards {
+		defined[l.ID] = true
+		var diffs []string
+		existing, found := existingLeaderboards[l.ID]
+		if found {
+			diffs = l.drift(nk, existing.Authoritative, existing.SortOrder, existing.Operator, existing.NextReset)
+			c.logMetadataDrift(logger, "leaderboard", l, existing.Metadata)
+		}
+		if err := c.apply(ctx, logger, nk, "leaderboard", l.ID, found, found && l.Authoritative && !existing.Authoritative, diffs, func() error { return l.create(ctx, nk) }); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, t := range c.Tournaments {
+		defined[t.ID] = true
+		var diffs []string
+		existing, found := existingTournaments[t.ID]
+		if found {
+			diffs = t.drift(nk, existing.Authoritative, existing.SortOrder, existing.Operator, existing.NextReset)
+			c.logMetadataDrift(logger, "tournament", &t.LeaderboardsConfigLeaderboard, existing.Metadata)
+			if existing.Title != t.Title {
+				diffs = append(diffs, fmt.Sprintf("title is %q, want %q", existing.Title, t.Title))
+			}
+			if existing.Description != t.Description {
+				diffs = append(diffs, fmt.Sprintf("description is %q, want %q", existing.Description, t.Description))
+			}
+			if int(existing.Category) != t.Category {
+				diffs = append(diffs, fmt.Sprintf("category is %d, want %d", existing.Category, t.Category))
+			}
+			if int(existing.Duration) != t.Duration {
+				diffs = append(diffs, fmt.Sprintf("duration is %d, want %d", existing.Duration, t.Duration))
+			}
+			if int(existing.MaxSize) != t.MaxSize {
+				diffs = append(diffs, fmt.Sprintf("max_size is %d, want %d", existing.MaxSize, t.MaxSize))
+			}
+			if int(existing.MaxNumScore) != t.MaxNumScore {
+				diffs = append(diffs, fmt.Sprintf("max_num_score is %d, want %d", existing.MaxNumScore, t.MaxNumScore))
+			}
+			if existing.JoinRequired != t.JoinRequired {
+				diffs = append(diffs, fmt.Sprintf("join_required is %v, want %v", existing.JoinRequired, t.JoinRequired))
+			}
+		}
+		if err := c.apply(ctx, logger, nk, "tournament", t.ID, found, found && t.Authoritative && !existing.Authoritative, diffs, func() error { return t.create(ctx, nk) }); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for id, l := range existingLeaderboards {
+		if _, isTournament := existingTournaments[id]; isTournament {
+			continue
+		}
+		if !defined[id] && isManaged(l.Metadata) {
+			if err := c.remove(logger, "leaderboard", id, func() error { return nk.LeaderboardDelete(ctx, id) }); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for id, t := range existingTournaments {
+		if parent := shardOf(t.Metadata); parent != "" {
+			// Shards go when the tournament they overflow from is no longer defined.
+			if !defined[parent] {
+				if err := c.remove(logger, "tournament", id, func() error { return nk.TournamentDelete(ctx, id) }); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			continue
+		}
+		if !defined[id] && isManaged(t.Metadata) {
+			if err := c.remove(logger, "tournament", id, func() error { return nk.TournamentDelete(ctx, id) }); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// apply creates a missing board, or handles a drifted one according to on_drift. A board defined authoritative that is
+// not authoritative live is never left as it is, since clients could write scores to it directly and skip every score
+// check: unless on_drift is "recreate", reconciling fails.
+func (c *LeaderboardsConfig) apply(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, kind, id string, found, notAuthoritative bool, diffs []string, create func() error) error {
+	logger = logger.WithFields(map[string]interface{}{kind: id})
+
+	if found {
+		if len(diffs) == 0 {
+			return nil
+		}
+		for _, diff := range diffs {
+			logger.Warn("Definition drift: %s", diff)
+		}
+		if c.OnDrift != onDriftRecreate {
+			if notAuthoritative {
+				return fmt.Errorf("%s %q: defined authoritative but is not, set on_drift to %q to recreate it, deleting its records", kind, id, onDriftRecreate)
+			}
+			return nil
+		}
+
+		logger.Warn("Recreating %s to match definition", kind)
+		var err error
+		if kind == "tournament" {
+			err = nk.TournamentDelete(ctx, id)
+		} else {
+			err = nk.LeaderboardDelete(ctx, id)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %q: failed to delete for recreation: %w", kind, id, err)
+		}
+	}
+
+	if err := create(); err != nil {
+		return fmt.Errorf("%s %q: failed to create: %w", kind, id, err)
+	}
+	logger.Info("Created %s", kind)
+	return nil
+}
+
+func (c *LeaderboardsConfig) logMetadataDrift(logger runtime.Logger, kind string, l *LeaderboardsConfigLeaderboard, metadata string) {
+	if l.metadataDrift(metadata) {
+		logger.WithFields(map[string]interface{}{kind: l.ID}).Info("Live metadata differs from definition, using the definition; clients see the live metadata until the %s is recreated", kind)
+	}
+}
+
+func (c *LeaderboardsConfig) remove(logger runtime.Logger, kind, id string, del func() error) error {
+	logger = logger.WithFields(map[string]interface{}{kind: id})
+
+	if c.OnRemoved != onRemovedDelete {
+		logger.Warn("Managed %s is no longer defined, set on_removed to %q to delete it", kind, onRemovedDelete)
+		return nil
+	}
+
+	if err := del(); err != nil {
+		return fmt.Errorf("%s %q: failed to delete: %w", kind, id, err)
+	}
+	logger.Info("Deleted %s no longer defined", kind)
+	return nil
+}
+
+func isManaged(metadata string) bool {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(metadata), &m); err != nil {
+		return false
+	}
+	return m[metadataKeyManagedBy] == managedByDefinitions
+}
+
+func listLeaderboards(nk runtime.NakamaModule) (map[string]*api.Leaderboard, error) {
+	leaderboards := make(map[string]*api.Leaderboard)
+	cursor := ""
+	for {
+		list, err := nk.LeaderboardList(listPageSize, cursor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list leaderboards: %w", err)
+		}
+		for _, l := range list.Leaderboards {
+			leaderboards[l.Id] = l
+		}
+		if cursor = list.Cursor; cursor == "" {
+			return leaderboards, nil
+		}
+	}
+}
+
+func listTournaments(ctx context.Context, nk runtime.NakamaModule) (map[string]*api.Tournament, error) {
+	tournaments := make(map[string]*api.Tournament)
+	cursor := ""
+	for {
+		list, err := nk.TournamentList(ctx, 0, 127, 0, 0, listPageSize, cursor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tournaments: %w", err)
+		}
+		for _, t := range list.Tournaments {
+			tournaments[t.Id] = t
+		}
+		if cursor = list.Cursor; cursor == "" {
+			return tournaments, nil
+		}
+	}
+}
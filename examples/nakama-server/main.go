@@ -3,120 +3,196 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/heroiclabs/nakama-common/api"
-	"math/rand"
-	"sync"
-	"time"
 
 	"github.com/heroiclabs/nakama-common/runtime"
 )
 
-var (
-	usernameOverrideMutex  = &sync.Mutex{}
-	usernameOverrideRandom = rand.New(rand.NewSource(time.Now().UTC().UnixNano()))
-)
-
 func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, initializer runtime.Initializer) error {
+	props, ok := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
+	if !ok {
+		return errors.New("invalid context runtime env")
+	}
+
+	env, ok := props["ENV"]
+	if !ok || env == "" {
+		return errors.New("'ENV' key missing or invalid in env")
+	}
+	logger.Info("Using env named %q", env)
+
+	usernames, err := newUsernameAssigner(props)
+	if err != nil {
+		return err
+	}
+
 	// Register username overrides.
 	if err := initializer.RegisterBeforeAuthenticateApple(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateAppleRequest) (*api.AuthenticateAppleRequest, error) {
-		in.Username = usernameOverrideFn(in.Username)
+		in.Username = usernames.Assign(ctx, logger, nk, in.Username, localeFromVars(ctx, in.GetAccount().GetVars()))
 		return in, nil
 	}); err != nil {
-		return nil
+		return err
 	}
 	if err := initializer.RegisterBeforeAuthenticateCustom(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateCustomRequest) (*api.AuthenticateCustomRequest, error) {
-		in.Username = usernameOverrideFn(in.Username)
+		in.Username = usernames.Assign(ctx, logger, nk, in.Username, localeFromVars(ctx, in.GetAccount().GetVars()))
 		return in, nil
 	}); err != nil {
-		return nil
+		return err
 	}
 	if err := initializer.RegisterBeforeAuthenticateDevice(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateDeviceRequest) (*api.AuthenticateDeviceRequest, error) {
-		in.Username = usernameOverrideFn(in.Username)
+		in.Username = usernames.Assign(ctx, logger, nk, in.Username, localeFromVars(ctx, in.GetAccount().GetVars()))
 		return in, nil
 	}); err != nil {
-		return nil
+		return err
 	}
 	if err := initializer.RegisterBeforeAuthenticateEmail(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateEmailRequest) (*api.AuthenticateEmailRequest, error) {
-		in.Username = usernameOverrideFn(in.Username)
+		in.Username = usernames.Assign(ctx, logger, nk, in.Username, localeFromVars(ctx, in.GetAccount().GetVars()))
 		return in, nil
 	}); err != nil {
-		return nil
+		return err
 	}
 	if err := initializer.RegisterBeforeAuthenticateFacebook(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateFacebookRequest) (*api.AuthenticateFacebookRequest, error) {
-		in.Username = usernameOverrideFn(in.Username)
+		in.Username = usernames.Assign(ctx, logger, nk, in.Username, localeFromVars(ctx, in.GetAccount().GetVars()))
 		return in, nil
 	}); err != nil {
-		return nil
+		return err
 	}
 	if err := initializer.RegisterBeforeAuthenticateFacebookInstantGame(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateFacebookInstantGameRequest) (*api.AuthenticateFacebookInstantGameRequest, error) {
-		in.Username = usernameOverrideFn(in.Username)
+		in.Username = usernames.Assign(ctx, logger, nk, in.Username, localeFromVars(ctx, in.GetAccount().GetVars()))
 		return in, nil
 	}); err != nil {
-		return nil
+		return err
 	}
 	if err := initializer.RegisterBeforeAuthenticateGameCenter(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateGameCenterRequest) (*api.AuthenticateGameCenterRequest, error) {
-		in.Username = usernameOverrideFn(in.Username)
+		in.Username = usernames.Assign(ctx, logger, nk, in.Username, localeFromVars(ctx, in.GetAccount().GetVars()))
 		return in, nil
 	}); err != nil {
-		return nil
+		return err
 	}
 	if err := initializer.RegisterBeforeAuthenticateGoogle(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateGoogleRequest) (*api.AuthenticateGoogleRequest, error) {
-		in.Username = usernameOverrideFn(in.Username)
+		in.Username = usernames.Assign(ctx, logger, nk, in.Username, localeFromVars(ctx, in.GetAccount().GetVars()))
 		return in, nil
 	}); err != nil {
-		return nil
+		return err
 	}
 	if err := initializer.RegisterBeforeAuthenticateSteam(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateSteamRequest) (*api.AuthenticateSteamRequest, error) {
-		in.Username = usernameOverrideFn(in.Username)
+		in.Username = usernames.Assign(ctx, logger, nk, in.Username, localeFromVars(ctx, in.GetAccount().GetVars()))
 		return in, nil
 	}); err != nil {
-		return nil
+		return err
 	}
 
-	if err := nk.LeaderboardCreate(ctx, "weekly_leaderboard", false, "desc", "best",
-		"0 0 * * 1", map[string]interface{}{}, true); err != nil {
-		// Handle error.
+	// Leaderboards and tournaments are defined per environment and reconciled against what already exists.
+	leaderboardsConfig, err := loadLeaderboardsConfig(nk, fmt.Sprintf("definitions/%s/leaderboards.json", env))
+	if err != nil {
+		return err
+	}
+	if err := leaderboardsConfig.Validate(nk); err != nil {
+		return fmt.Errorf("invalid leaderboard definitions: %w", err)
+	}
+	if err := leaderboardsConfig.Reconcile(ctx, logger, nk); err != nil {
+		return fmt.Errorf("failed to reconcile leaderboard definitions: %w", err)
 	}
 
-	if err := nk.LeaderboardCreate(ctx, "global_leaderboard", false, "desc", "best",
-		"", map[string]interface{}{}, true); err != nil {
-		// Handle error.
+	// Pay tournament prizes and merge the top of overflow shards when each tournament window closes.
+	payPrizes := tournamentPrizeHandler(leaderboardsConfig)
+	mergeGlobalTop := globalTopHandler(leaderboardsConfig)
+	onWindowClosed := func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, tournament *api.Tournament, end, reset int64) error {
+		return errors.Join(payPrizes(ctx, logger, db, nk, tournament, end, reset), mergeGlobalTop(ctx, logger, db, nk, tournament, end, reset))
+	}
+	if err := initializer.RegisterTournamentEnd(onWindowClosed); err != nil {
+		return err
+	}
+	if err := initializer.RegisterTournamentReset(onWindowClosed); err != nil {
+		return err
 	}
 
-	err := createTournament(ctx, logger, nk, "daily-dash", "0 12 * * *", "Daily Dash", "Dash past your opponents for high scores and big rewards!", 86400, 0, 1, false)
-	if err != nil {
-		// Handle error.
+	// Archive final standings of leaderboards when they reset.
+	if err := initializer.RegisterLeaderboardReset(seasonArchiveHandler(leaderboardsConfig)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_leaderboard_seasons_list", rpcLeaderboardSeasonsList); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_leaderboard_season_history", rpcLeaderboardSeasonHistory); err != nil {
+		return err
 	}
 
-	err = createTournament(ctx, logger, nk, "limited-dash", "0 * * * *", "Limited Dash", "Limited spaces available, join now!", 3600, 10000, 3, true)
+	// Authoritative leaderboards only accept scores through these RPCs, which validate them first.
+	if err := initializer.RegisterRpc("rpc_score_run_start", rpcScoreRunStart(leaderboardsConfig)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_score_submit", rpcScoreSubmit(leaderboardsConfig)); err != nil {
+		return err
+	}
+
+	// Join tournaments through shards once they are full, and list the caller's shard.
+	if err := initializer.RegisterRpc("rpc_tournament_join", rpcTournamentJoin(leaderboardsConfig)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_tournament_shard_records", rpcTournamentShardRecords(leaderboardsConfig)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_tournament_global_top", rpcTournamentGlobalTop); err != nil {
+		return err
+	}
+
+	// List standings among friends or around the caller's own record.
+	if err := initializer.RegisterRpc("rpc_leaderboard_standings", rpcLeaderboardStandings(leaderboardsConfig)); err != nil {
+		return err
+	}
+
+	// Cloud saves are stored in named slots, with previous revisions kept for rollback.
+	cloudSaveConfig, err := loadCloudSaveConfig(nk, fmt.Sprintf("definitions/%s/cloud-save.json", env))
 	if err != nil {
-		// Handle error.
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_save_slot_list", rpcSaveSlotList); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_save_slot_read", rpcSaveSlotRead); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_save_slot_write", rpcSaveSlotWrite(cloudSaveConfig)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_save_slot_revisions", rpcSaveSlotRevisions); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_save_slot_rollback", rpcSaveSlotRollback(cloudSaveConfig)); err != nil {
+		return err
 	}
 
-	return nil
-}
+	// Suggest friends from the player's social graph, groups and leaderboard neighbours.
+	friendSuggestionsConfig, err := loadFriendSuggestionsConfig(nk, fmt.Sprintf("definitions/%s/friend-suggestions.json", env))
+	if err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_friend_suggestions", rpcFriendSuggestions(friendSuggestionsConfig)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterAfterAddFriends(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AddFriendsRequest) error {
+		clearFriendSuggestions(ctx, logger, nk)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := initializer.RegisterAfterBlockFriends(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.BlockFriendsRequest) error {
+		clearFriendSuggestions(ctx, logger, nk)
+		return nil
+	}); err != nil {
+		return err
+	}
 
-func createTournament(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, id, resetSchedule, title, description string, duration, maxSize, maxNumScore int, joinRequired bool) error {
-	authoritative := false // true by default
-	sortOrder := "desc"    // one of: "desc", "asc"
-	operator := "best"     // one of: "best", "set", "incr"
-	metadata := map[string]interface{}{}
-	category := 1
-	startTime := int(time.Now().UTC().Unix()) // start now
-	endTime := 0                              // never end, repeat the tournament forever
-	enableRanks := true                       // ranks are enabled
-	err := nk.TournamentCreate(ctx, id, authoritative, sortOrder, operator, resetSchedule, metadata, title, description, category, startTime, endTime, duration, maxSize, maxNumScore, joinRequired, enableRanks)
+	// Enforce group policies and keep an audit log of membership changes.
+	groupsConfig, err := loadGroupsConfig(nk, fmt.Sprintf("definitions/%s/groups.json", env))
 	if err != nil {
-		logger.Debug("unable to create tournament: %q", err.Error())
-		return runtime.NewError("failed to create tournament", 3)
+		return err
+	}
+	if err := groupsConfig.Register(initializer); err != nil {
+		return err
 	}
-	return nil
-}
 
-var usernameOverrideFn = func(_ string) string {
-	usernameOverrideMutex.Lock()
-	number := usernameOverrideRandom.Intn(100_000_000)
-	usernameOverrideMutex.Unlock()
-	return fmt.Sprintf("Player%08d", number)
+	return nil
 }
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	metadataKeyOverflow = "overflow"
+	// Shards carry the ID of the tournament they overflow from in this metadata key.
+	metadataKeyShardOf = "shard_of"
+
+	// One user-owned object per tournament records which shard the player joined in its current window.
+	storageCollectionTournamentShards = "tournament_shards"
+	// One system-owned object per tournament holds the merged top of all its shards for the last window that ended.
+	storageCollectionTournamentGlobalTop = "tournament_global_top"
+
+	overflowDefaultMaxShards = 10
+)
+
+var errTournamentShardsFull = runtime.NewError("all tournament shards are full", 8)
+
+// OverflowConfig is read from the "overflow" key of tournament metadata. Once a tournament is full, players are placed
+// in shards cloned from its definition, named "<id>-2", "<id>-3" and so on. Players only compete within their shard, so
+// each shard pays the tournament's full prize table to its own ranks; the merged global top is for display only.
+type OverflowConfig struct {
+	// MaxShards counts the tournament itself as the first shard.
+	MaxShards int `json:"max_shards"`
+	// GlobalTopCount is how many records of the merged top are kept when each window ends, 0 disables it.
+	GlobalTopCount int `json:"global_top_count"`
+}
+
+// TournamentShard is the player's shard assignment for one tournament window.
+type TournamentShard struct {
+	ShardID   string `json:"shard_id"`
+	EndActive uint32 `json:"end_active"`
+}
+
+type GlobalTopRecord struct {
+	OwnerID  string `json:"owner_id"`
+	Username string `json:"username"`
+	Score    int64  `json:"score"`
+	Subscore int64  `json:"subscore"`
+	// Rank is across all shards, ShardRank within the player's own shard.
+	Rank      int64  `json:"rank"`
+	ShardID   string `json:"shard_id"`
+	ShardRank int64  `json:"shard_rank"`
+}
+
+type GlobalTop struct {
+	TournamentID string             `json:"tournament_id"`
+	End          int64              `json:"end"`
+	Records      []*GlobalTopRecord `json:"records"`
+}
+
+type tournamentJoinRequest struct {
+	TournamentID string `json:"tournament_id"`
+}
+
+type tournamentJoinResponse struct {
+	TournamentID string `json:"tournament_id"`
+	ShardID      string `json:"shard_id"`
+}
+
+type tournamentShardRecordsRequest struct {
+	TournamentID string `json:"tournament_id"`
+	Limit        int    `json:"limit"`
+	Cursor       string `json:"cursor"`
+}
+
+type tournamentShardRecordsResponse struct {
+	TournamentID string                   `json:"tournament_id"`
+	ShardID      string                   `json:"shard_id"`
+	Records      []*api.LeaderboardRecord `json:"records"`
+	OwnerRecords []*api.LeaderboardRecord `json:"owner_records"`
+	NextCursor   string                   `json:"next_cursor,omitempty"`
+	PrevCursor   string                   `json:"prev_cursor,omitempty"`
+}
+
+func parseOverflowConfig(metadata map[string]interface{}) (*OverflowConfig, error) {
+	raw, found := metadata[metadataKeyOverflow]
+	if !found {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	config := &OverflowConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	if config.MaxShards <= 0 {
+		config.MaxShards = overflowDefaultMaxShards
+	}
+	if config.GlobalTopCount < 0 {
+		return nil, errors.New("global_top_count must not be negative")
+	}
+	return config, nil
+}
+
+func shardID(tournamentID string, shard int) string {
+	if shard <= 1 {
+		return tournamentID
+	}
+	return fmt.Sprintf("%s-%d", tournamentID, shard)
+}
+
+// shardParent returns the definition of the overflowing tournament that id is a shard of, if any.
+func (c *LeaderboardsConfig) shardParent(id string) *LeaderboardsConfigTournament {
+	i := strings.LastIndex(id, "-")
+	if i <= 0 {
+		return nil
+	}
+	if shard, err := strconv.Atoi(id[i+1:]); err != nil || shard < 2 {
+		return nil
+	}
+	for _, t := range c.Tournaments {
+		if t.ID == id[:i] {
+			if overflow, _ := parseOverflowConfig(t.Metadata); overflow != nil {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// shardOf returns the tournament that a tournament's live metadata marks it as a shard of.
+func shardOf(metadata string) string {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(metadata), &m); err != nil {
+		return ""
+	}
+	parent, _ := m[metadataKeyShardOf].(string)
+	return parent
+}
+
+// createShard creates a shard from the tournament's definition, with the start and end times of the live parent so
+// that its windows line up with the parent's. Shards are not marked as managed, so reconciling only removes them along
+// with their parent tournament.
+func (t *LeaderboardsConfigTournament) createShard(ctx context.Context, nk runtime.NakamaModule, id string, parent *api.Tournament) error {
+	metadata := make(map[string]interface{}, len(t.Metadata)+1)
+	for k, v := range t.Metadata {
+		metadata[k] = v
+	}
+	metadata[metadataKeyShardOf] = t.ID
+
+	shard := *t
+	shard.ID = id
+	shard.Metadata = metadata
+	return nk.TournamentCreate(ctx, shard.ID, shard.Authoritative, shard.SortOrder, shard.Operator, shard.ResetSchedule, shard.Metadata, shard.Title, shard.Description, shard.Category, int(parent.GetStartTime().GetSeconds()), int(parent.GetEndTime().GetSeconds()), shard.Duration, shard.MaxSize, shard.MaxNumScore, shard.JoinRequired, shard.EnableRanks)
+}
+
+func (c *LeaderboardsConfig) overflowTournament(id string) (*LeaderboardsConfigTournament, *OverflowConfig, error) {
+	for _, t := range c.Tournaments {
+		if t.ID == id {
+			overflow, err := parseOverflowConfig(t.Metadata)
+			return t, overflow, err
+		}
+	}
+	return nil, nil, runtime.NewError("tournament not found", 5)
+}
+
+// readTournamentShard returns the shard the player joined in the tournament's current window, or "" if none.
+func readTournamentShard(ctx context.Context, nk runtime.NakamaModule, userID string, tournament *api.Tournament) (string, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionTournamentShards, Key: tournament.Id, UserID: userID}})
+	if err != nil || len(objects) == 0 {
+		return "", "*", err
+	}
+	shard := &TournamentShard{}
+	if err := json.Unmarshal([]byte(objects[0].Value), shard); err != nil {
+		return "", "", err
+	}
+	if shard.EndActive != tournament.EndActive {
+		return "", objects[0].Version, nil
+	}
+	return shard.ShardID, objects[0].Version, nil
+}
+
+// rpcTournamentJoin joins a configured tournament. Tournaments with an "overflow" config place the player in the first
+// shard with room, creating it if needed, instead of refusing them once the tournament is full.
+func rpcTournamentJoin(config *LeaderboardsConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+		username, ok := ctx.Value(runtime.RUNTIME_CTX_USERNAME).(string)
+		if !ok {
+			return "", errors.New("no username in context")
+		}
+
+		var req tournamentJoinRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request payload", 3)
+		}
+		def, overflow, err := config.overflowTournament(req.TournamentID)
+		if err != nil {
+			return "", err
+		}
+		logger = logger.WithFields(map[string]interface{}{"tournament": req.TournamentID, "user_id": userID})
+
+		response := &tournamentJoinResponse{TournamentID: req.TournamentID, ShardID: req.TournamentID}
+		if overflow == nil {
+			if err := nk.TournamentJoin(ctx, req.TournamentID, userID, username); err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to join tournament")
+				return "", err
+			}
+		} else if response.ShardID, err = joinTournamentShard(ctx, logger, nk, def, overflow, userID, username); err != nil {
+			return "", err
+		}
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
+
+func joinTournamentShard(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, def *LeaderboardsConfigTournament, overflow *OverflowConfig, userID, username string) (string, error) {
+	ids := make([]string, 0, overflow.MaxShards)
+	for shard := 1; shard <= overflow.MaxShards; shard++ {
+		ids = append(ids, shardID(def.ID, shard))
+	}
+	tournaments, err := nk.TournamentsGetId(ctx, ids)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to get tournament shards")
+		return "", err
+	}
+	existing := make(map[string]*api.Tournament, len(tournaments))
+	for _, tournament := range tournaments {
+		existing[tournament.Id] = tournament
+	}
+	parent, found := existing[def.ID]
+	if !found {
+		return "", runtime.NewError("tournament not found", 5)
+	}
+
+	// Players stay in the shard they joined for the rest of the window.
+	assigned, version, err := readTournamentShard(ctx, nk, userID, parent)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read tournament shard")
+		return "", err
+	}
+	if assigned != "" {
+		if err := nk.TournamentJoin(ctx, assigned, userID, username); err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to join tournament shard")
+			return "", err
+		}
+		return assigned, nil
+	}
+
+	for _, id := range ids {
+		if _, found := existing[id]; !found {
+			// Creating a tournament that another node has just created is a no-op.
+			if err := def.createShard(ctx, nk, id, parent); err != nil {
+				logger.WithFields(map[string]interface{}{"shard": id, "error": err.Error()}).Error("Failed to create tournament shard")
+				return "", err
+			}
+			logger.Info("Created tournament shard %q", id)
+		}
+
+		err := nk.TournamentJoin(ctx, id, userID, username)
+		if errors.Is(err, runtime.ErrTournamentMaxSizeReached) {
+			continue
+		}
+		if err != nil {
+			logger.WithFields(map[string]interface{}{"shard": id, "error": err.Error()}).Error("Failed to join tournament shard")
+			return "", err
+		}
+
+		value, err := json.Marshal(&TournamentShard{ShardID: id, EndActive: parent.EndActive})
+		if err != nil {
+			return "", err
+		}
+		if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+			Collection:      storageCollectionTournamentShards,
+			Key:             def.ID,
+			UserID:          userID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  1,
+			PermissionWrite: 0,
+		}}); err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to write tournament shard")
+			return "", err
+		}
+		return id, nil
+	}
+
+	logger.Warn("All %d tournament shards are full", overflow.MaxShards)
+	return "", errTournamentShardsFull
+}
+
+// rpcTournamentShardRecords lists the records of the shard the caller joined in the current window, or of the
+// tournament itself if they have not joined a shard.
+func rpcTournamentShardRecords(config *LeaderboardsConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		var req tournamentShardRecordsRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request payload", 3)
+		}
+		if _, _, err := config.overflowTournament(req.TournamentID); err != nil {
+			return "", err
+		}
+		if req.Limit <= 0 || req.Limit > listPageSize {
+			req.Limit = listPageSize
+		}
+
+		tournaments, err := nk.TournamentsGetId(ctx, []string{req.TournamentID})
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to get tournament")
+			return "", err
+		}
+		if len(tournaments) == 0 {
+			return "", runtime.NewError("tournament not found", 5)
+		}
+		shard, _, err := readTournamentShard(ctx, nk, userID, tournaments[0])
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read tournament shard")
+			return "", err
+		}
+		if shard == "" {
+			shard = req.TournamentID
+		}
+
+		records, ownerRecords, prevCursor, nextCursor, err := nk.TournamentRecordsList(ctx, shard, []string{userID}, req.Limit, req.Cursor, 0)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to list tournament records")
+			return "", err
+		}
+
+		response, err := json.Marshal(&tournamentShardRecordsResponse{
+			TournamentID: req.TournamentID,
+			ShardID:      shard,
+			Records:      records,
+			OwnerRecords: ownerRecords,
+			NextCursor:   nextCursor,
+			PrevCursor:   prevCursor,
+		})
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+// globalTopHandler merges the top records of every shard of a tournament when its window ends. It only acts on the
+// callback for the tournament itself, since all shards end at the same time.
+func globalTopHandler(config *LeaderboardsConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, tournament *api.Tournament, end, reset int64) error {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, tournament *api.Tournament, end, reset int64) error {
+		def, overflow, err := config.overflowTournament(tournament.Id)
+		if err != nil || overflow == nil || overflow.GlobalTopCount == 0 {
+			return nil
+		}
+		logger = logger.WithFields(map[string]interface{}{"tournament": tournament.Id, "end": end})
+
+		objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionTournamentGlobalTop, Key: def.ID}})
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read tournament global top")
+			return err
+		}
+		version := "*"
+		if len(objects) > 0 {
+			previous := &GlobalTop{}
+			if err := json.Unmarshal([]byte(objects[0].Value), previous); err == nil && previous.End >= end {
+				// End and reset may both be delivered for the same window.
+				return nil
+			}
+			version = objects[0].Version
+		}
+
+		ids := make([]string, 0, overflow.MaxShards)
+		for shard := 1; shard <= overflow.MaxShards; shard++ {
+			ids = append(ids, shardID(def.ID, shard))
+		}
+		shards, err := nk.TournamentsGetId(ctx, ids)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to get tournament shards")
+			return err
+		}
+
+		globalTop := &GlobalTop{TournamentID: def.ID, End: end, Records: []*GlobalTopRecord{}}
+		for _, shard := range shards {
+			// Records from the window that just ended have expired, so list them as of its end time.
+			records, _, _, _, err := nk.TournamentRecordsList(ctx, shard.Id, nil, overflow.GlobalTopCount, "", end)
+			if err != nil {
+				logger.WithFields(map[string]interface{}{"shard": shard.Id, "error": err.Error()}).Error("Failed to list tournament shard records")
+				return err
+			}
+			for _, record := range records {
+				globalTop.Records = append(globalTop.Records, &GlobalTopRecord{
+					OwnerID:   record.OwnerId,
+					Username:  record.GetUsername().GetValue(),
+					Score:     record.Score,
+					Subscore:  record.Subscore,
+					ShardID:   shard.Id,
+					ShardRank: record.Rank,
+				})
+			}
+		}
+
+		ascending := def.SortOrder == "asc"
+		sort.SliceStable(globalTop.Records, func(i, j int) bool {
+			a, b := globalTop.Records[i], globalTop.Records[j]
+			if a.Score != b.Score {
+				return (a.Score < b.Score) == ascending
+			}
+			if a.Subscore != b.Subscore {
+				return (a.Subscore < b.Subscore) == ascending
+			}
+			return a.ShardRank < b.ShardRank
+		})
+		if len(globalTop.Records) > overflow.GlobalTopCount {
+			globalTop.Records = globalTop.Records[:overflow.GlobalTopCount]
+		}
+		for i, record := range globalTop.Records {
+			record.Rank = int64(i + 1)
+		}
+
+		value, err := json.Marshal(globalTop)
+		if err != nil {
+			return err
+		}
+		if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+			Collection:      storageCollectionTournamentGlobalTop,
+			Key:             def.ID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  2,
+			PermissionWrite: 0,
+		}}); err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to write tournament global top")
+			return err
+		}
+
+		logger.Info("Merged global top of %d shards", len(shards))
+		return nil
+	}
+}
+
+// rpcTournamentGlobalTop returns the merged top of all shards of a tournament for the last window that ended.
+func rpcTournamentGlobalTop(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var req tournamentJoinRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid request payload", 3)
+	}
+	if req.TournamentID == "" {
+		return "", runtime.NewError("tournament_id is required", 3)
+	}
+
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionTournamentGlobalTop, Key: req.TournamentID}})
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read tournament global top")
+		return "", err
+	}
+	if len(objects) == 0 {
+		return "", runtime.NewError("no global top for tournament", 5)
+	}
+	return objects[0].Value, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	metadataKeyPrizes = "prizes"
+
+	// Each paid prize is recorded as a user-owned storage object keyed by tournament and end time. The object is written
+	// in the same transaction as the wallet update, so a prize can never be paid twice for the same tournament window.
+	storageCollectionTournamentPayouts = "tournament_payouts"
+)
+
+// TournamentPrize pays every player ranked between MinRank and MaxRank inclusive.
+type TournamentPrize struct {
+	MinRank    int64            `json:"min_rank"`
+	MaxRank    int64            `json:"max_rank"`
+	Currencies map[string]int64 `json:"currencies"`
+}
+
+// TournamentPayout is the ledger entry stored for each paid prize.
+type TournamentPayout struct {
+	TournamentID string           `json:"tournament_id"`
+	End          int64            `json:"end"`
+	Rank         int64            `json:"rank"`
+	Score        int64            `json:"score"`
+	Currencies   map[string]int64 `json:"currencies"`
+}
+
+// parseTournamentPrizes reads prize brackets from the "prizes" key of tournament metadata, sorted by rank.
+func parseTournamentPrizes(metadata map[string]interface{}) ([]*TournamentPrize, error) {
+	raw, found := metadata[metadataKeyPrizes]
+	if !found {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var prizes []*TournamentPrize
+	if err := json.Unmarshal(data, &prizes); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(prizes, func(i, j int) bool {
+		return prizes[i].MinRank < prizes[j].MinRank
+	})
+	return prizes, nil
+}
+
+func validateTournamentPrizes(prizes []*TournamentPrize) []error {
+	var errs []error
+	for i, prize := range prizes {
+		if prize.MinRank < 1 || prize.MaxRank < prize.MinRank {
+			errs = append(errs, fmt.Errorf("prizes: invalid rank range %d-%d", prize.MinRank, prize.MaxRank))
+		}
+		if i > 0 && prize.MinRank <= prizes[i-1].MaxRank {
+			errs = append(errs, fmt.Errorf("prizes: rank range %d-%d overlaps %d-%d", prize.MinRank, prize.MaxRank, prizes[i-1].MinRank, prizes[i-1].MaxRank))
+		}
+		if len(prize.Currencies) == 0 {
+			errs = append(errs, fmt.Errorf("prizes: rank range %d-%d has no currencies", prize.MinRank, prize.MaxRank))
+		}
+		for currency, amount := range prize.Currencies {
+			if amount <= 0 {
+				errs = append(errs, fmt.Errorf("prizes: rank range %d-%d pays non-positive %q", prize.MinRank, prize.MaxRank, currency))
+			}
+		}
+	}
+	return errs
+}
+
+func prizeForRank(prizes []*TournamentPrize, rank int64) *TournamentPrize {
+	for _, prize := range prizes {
+		if rank >= prize.MinRank && rank <= prize.MaxRank {
+			return prize
+		}
+	}
+	return nil
+}
+
+// tournamentPrizeHandler pays prizes when a tournament window ends. It is registered for both tournament end and reset,
+// since either may be the last callback for a window; the payout ledger keeps the second call from paying again.
+// Brackets come from the definitions, so edits to them apply to tournaments that already exist. Each shard of an
+// overflowing tournament pays its own ranks from the parent's brackets.
+func tournamentPrizeHandler(config *LeaderboardsConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, tournament *api.Tournament, end, reset int64) error {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, tournament *api.Tournament, end, reset int64) error {
+		logger = logger.WithFields(map[string]interface{}{"tournament": tournament.Id, "end": end})
+
+		metadata, err := config.metadataFor(tournament.Id, tournament.Metadata)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Invalid tournament metadata")
+			return err
+		}
+
+		prizes, err := parseTournamentPrizes(metadata)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Invalid tournament prizes")
+			return err
+		}
+		if len(prizes) == 0 {
+			return nil
+		}
+
+		return payTournamentPrizes(ctx, logger, nk, tournament.Id, end, prizes)
+	}
+}
+
+func payTournamentPrizes(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, tournamentID string, end int64, prizes []*TournamentPrize) error {
+	maxRank := prizes[len(prizes)-1].MaxRank
+	key := fmt.Sprintf("%s_%d", tournamentID, end)
+
+	var paid, skipped int
+	cursor := ""
+	for {
+		// Records from the window that just ended have expired, so list them as of its end time.
+		records, _, _, nextCursor, err := nk.TournamentRecordsList(ctx, tournamentID, nil, listPageSize, cursor, end)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to list tournament records")
+			return err
+		}
+
+		winners := make([]*api.LeaderboardRecord, 0, len(records))
+		reads := make([]*runtime.StorageRead, 0, len(records))
+		for _, record := range records {
+			if record.Rank > maxRank {
+				break
+			}
+			if prizeForRank(prizes, record.Rank) == nil {
+				continue
+			}
+			winners = append(winners, record)
+			reads = append(reads, &runtime.StorageRead{Collection: storageCollectionTournamentPayouts, Key: key, UserID: record.OwnerId})
+		}
+
+		alreadyPaid := make(map[string]bool, len(winners))
+		if len(reads) > 0 {
+			objects, err := nk.StorageRead(ctx, reads)
+			if err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to read tournament payout ledger")
+				return err
+			}
+			for _, object := range objects {
+				alreadyPaid[object.UserId] = true
+			}
+		}
+
+		var errs []error
+		for _, record := range winners {
+			if alreadyPaid[record.OwnerId] {
+				skipped++
+				continue
+			}
+			if err := payTournamentPrize(ctx, nk, tournamentID, key, end, record, prizeForRank(prizes, record.Rank)); err != nil {
+				logger.WithFields(map[string]interface{}{"user_id": record.OwnerId, "error": err.Error()}).Error("Failed to pay tournament prize")
+				errs = append(errs, err)
+				continue
+			}
+			paid++
+		}
+		if len(errs) > 0 {
+			return errors.Join(errs...)
+		}
+
+		if nextCursor == "" || len(records) == 0 || records[len(records)-1].Rank >= maxRank {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	logger.Info("Tournament prizes paid to %d players, %d already paid", paid, skipped)
+	return nil
+}
+
+func payTournamentPrize(ctx context.Context, nk runtime.NakamaModule, tournamentID, key string, end int64, record *api.LeaderboardRecord, prize *TournamentPrize) error {
+	payout := &TournamentPayout{
+		TournamentID: tournamentID,
+		End:          end,
+		Rank:         record.Rank,
+		Score:        record.Score,
+		Currencies:   prize.Currencies,
+	}
+	value, err := json.Marshal(payout)
+	if err != nil {
+		return err
+	}
+
+	// Version "*" only writes the ledger entry if it does not exist yet, which fails the whole update, wallet included,
+	// when another node has already paid this prize.
+	_, _, err = nk.MultiUpdate(ctx, nil, []*runtime.StorageWrite{{
+		Collection:      storageCollectionTournamentPayouts,
+		Key:             key,
+		UserID:          record.OwnerId,
+		Value:           string(value),
+		Version:         "*",
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}}, nil, []*runtime.WalletUpdate{{
+		UserID:    record.OwnerId,
+		Changeset: prize.Currencies,
+		Metadata: map[string]interface{}{
+			"tournament_id": tournamentID,
+			"end":           end,
+			"rank":          record.Rank,
+		},
+	}}, true)
+	return err
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	metadataKeyScoreRules = "score_rules"
+
+	// Runs are user-owned and keyed by board ID, so a player has at most one open run per board and starting another
+	// replaces it. A run is consumed by deleting it when its score is submitted.
+	storageCollectionScoreRuns = "score_runs"
+	// Per-user submission counters used for rate limiting, keyed by leaderboard ID.
+	storageCollectionScoreSubmissions = "score_submissions"
+	// System-owned log of rejected submissions for review.
+	storageCollectionScoreRejections = "score_rejections"
+
+	scoreRunDefaultTTLSec = 3600
+)
+
+// ScoreRules is read from the "score_rules" key of leaderboard and tournament metadata. Zero values disable a rule.
+type ScoreRules struct {
+	MaxScore int64 `json:"max_score"`
+	// MaxImprovement caps how much a single submission may improve on the player's current record.
+	MaxImprovement int64 `json:"max_improvement"`
+	// MinRunDurationSec is the shortest time between starting a run and submitting its score.
+	MinRunDurationSec int64 `json:"min_run_duration_sec"`
+	// RunTTLSec is how long a run token stays valid, defaulting to one hour.
+	RunTTLSec int64 `json:"run_ttl_sec"`
+	// RunStartIntervalSec is the shortest time between starting two runs on the board.
+	RunStartIntervalSec int64 `json:"run_start_interval_sec"`
+	MinIntervalSec      int64 `json:"min_interval_sec"`
+	MaxPerHour          int   `json:"max_per_hour"`
+}
+
+type ScoreRun struct {
+	Token     string `json:"token"`
+	SessionID string `json:"session_id"`
+	StartTime int64  `json:"start_time"`
+}
+
+type ScoreSubmissions struct {
+	LastSubmitTime  int64 `json:"last_submit_time"`
+	WindowStartTime int64 `json:"window_start_time"`
+	WindowCount     int   `json:"window_count"`
+}
+
+type ScoreRejection struct {
+	UserID        string   `json:"user_id"`
+	LeaderboardID string   `json:"leaderboard_id"`
+	Score         int64    `json:"score"`
+	Subscore      int64    `json:"subscore"`
+	Reasons       []string `json:"reasons"`
+	Time          int64    `json:"time"`
+}
+
+type scoreRunStartRequest struct {
+	LeaderboardID string `json:"leaderboard_id"`
+}
+
+type scoreRunStartResponse struct {
+	RunToken  string `json:"run_token"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type scoreSubmitRequest struct {
+	LeaderboardID string                 `json:"leaderboard_id"`
+	RunToken      string                 `json:"run_token"`
+	Score         int64                  `json:"score"`
+	Subscore      int64                  `json:"subscore"`
+	Metadata      map[string]interface{} `json:"metadata"`
+}
+
+var (
+	errScoreRejected   = runtime.NewError("score rejected", 9) // FAILED_PRECONDITION
+	errScoreRunTooSoon = runtime.NewError("score run started too soon after the previous one", 8)
+)
+
+func parseScoreRules(metadata map[string]interface{}) (*ScoreRules, error) {
+	rules := &ScoreRules{}
+	if raw, found := metadata[metadataKeyScoreRules]; found {
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, rules); err != nil {
+			return nil, err
+		}
+	}
+	if rules.RunTTLSec <= 0 {
+		rules.RunTTLSec = scoreRunDefaultTTLSec
+	}
+	return rules, nil
+}
+
+// board returns the definition of a leaderboard or tournament, and whether it is a tournament. Tournament shards return
+// the definition of the tournament they overflow from.
+func (c *LeaderboardsConfig) board(id string) (*LeaderboardsConfigLeaderboard, bool) {
+	for _, l := range c.Leaderboards {
+		if l.ID == id {
+			return l, false
+		}
+	}
+	for _, t := range c.Tournaments {
+		if t.ID == id {
+			return &t.LeaderboardsConfigLeaderboard, true
+		}
+	}
+	if t := c.shardParent(id); t != nil {
+		return &t.LeaderboardsConfigLeaderboard, true
+	}
+	return nil, false
+}
+
+func newRunToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// rpcScoreRunStart issues a run token that must accompany the score submitted at the end of the run. It replaces the
+// player's open run on the board, if any.
+func rpcScoreRunStart(config *LeaderboardsConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+		sessionID, _ := ctx.Value(runtime.RUNTIME_CTX_SESSION_ID).(string)
+
+		var req scoreRunStartRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request payload", 3)
+		}
+		board, _ := config.board(req.LeaderboardID)
+		if board == nil || !board.Authoritative {
+			return "", runtime.NewError("leaderboard not found", 5)
+		}
+		rules, err := parseScoreRules(board.Metadata)
+		if err != nil {
+			return "", err
+		}
+
+		objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionScoreRuns, Key: req.LeaderboardID, UserID: userID}})
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read score run")
+			return "", err
+		}
+		now := time.Now().UTC().Unix()
+		version := "*"
+		if len(objects) > 0 {
+			open := &ScoreRun{}
+			if err := json.Unmarshal([]byte(objects[0].Value), open); err != nil {
+				return "", err
+			}
+			if rules.RunStartIntervalSec > 0 && now-open.StartTime < rules.RunStartIntervalSec {
+				return "", errScoreRunTooSoon
+			}
+			version = objects[0].Version
+		}
+
+		token, err := newRunToken()
+		if err != nil {
+			return "", err
+		}
+		value, err := json.Marshal(&ScoreRun{Token: token, SessionID: sessionID, StartTime: now})
+		if err != nil {
+			return "", err
+		}
+		// The open run's version keeps concurrent starts from getting around run_start_interval_sec.
+		if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+			Collection:      storageCollectionScoreRuns,
+			Key:             req.LeaderboardID,
+			UserID:          userID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}}); err != nil {
+			if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+				return "", errScoreRunTooSoon
+			}
+			logger.WithField("error", err.Error()).Error("Failed to store score run")
+			return "", err
+		}
+
+		response, err := json.Marshal(&scoreRunStartResponse{RunToken: token, ExpiresAt: now + rules.RunTTLSec})
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+// rpcScoreSubmit validates a score against the board's rules and writes it on the player's behalf. Rejected scores
+// consume the run token and are recorded for review.
+func rpcScoreSubmit(config *LeaderboardsConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+		username, _ := ctx.Value(runtime.RUNTIME_CTX_USERNAME).(string)
+		sessionID, _ := ctx.Value(runtime.RUNTIME_CTX_SESSION_ID).(string)
+
+		var req scoreSubmitRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request payload", 3)
+		}
+		board, isTournament := config.board(req.LeaderboardID)
+		if board == nil || !board.Authoritative {
+			return "", runtime.NewError("leaderboard not found", 5)
+		}
+		if req.RunToken == "" {
+			return "", runtime.NewError("run_token is required", 3)
+		}
+		rules, err := parseScoreRules(board.Metadata)
+		if err != nil {
+			return "", err
+		}
+
+		objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{
+			{Collection: storageCollectionScoreRuns, Key: req.LeaderboardID, UserID: userID},
+			{Collection: storageCollectionScoreSubmissions, Key: req.LeaderboardID, UserID: userID},
+		})
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read score run")
+			return "", err
+		}
+		var runObject, submissionsObject *api.StorageObject
+		for _, object := range objects {
+			switch object.Collection {
+			case storageCollectionScoreRuns:
+				runObject = object
+			case storageCollectionScoreSubmissions:
+				submissionsObject = object
+			}
+		}
+
+		now := time.Now().UTC().Unix()
+		var reasons []string
+
+		run := &ScoreRun{}
+		if runObject != nil {
+			if err := json.Unmarshal([]byte(runObject.Value), run); err != nil {
+				return "", err
+			}
+		}
+		if runObject == nil || run.Token != req.RunToken {
+			reasons = append(reasons, "unknown, replaced or already used run token")
+		} else {
+			if run.SessionID != sessionID {
+				reasons = append(reasons, "run started in a different session")
+			}
+			if elapsed := now - run.StartTime; elapsed < rules.MinRunDurationSec {
+				reasons = append(reasons, fmt.Sprintf("run lasted %ds, minimum is %ds", elapsed, rules.MinRunDurationSec))
+			} else if elapsed > rules.RunTTLSec {
+				reasons = append(reasons, fmt.Sprintf("run expired after %ds", rules.RunTTLSec))
+			}
+		}
+
+		submissions := &ScoreSubmissions{}
+		submissionsVersion := "*"
+		if submissionsObject != nil {
+			if err := json.Unmarshal([]byte(submissionsObject.Value), submissions); err != nil {
+				return "", err
+			}
+			submissionsVersion = submissionsObject.Version
+		}
+		if rules.MinIntervalSec > 0 && now-submissions.LastSubmitTime < rules.MinIntervalSec {
+			reasons = append(reasons, fmt.Sprintf("submitted %ds after the previous score, minimum is %ds", now-submissions.LastSubmitTime, rules.MinIntervalSec))
+		}
+		if now-submissions.WindowStartTime >= 3600 {
+			submissions.WindowStartTime = now
+			submissions.WindowCount = 0
+		}
+		if rules.MaxPerHour > 0 && submissions.WindowCount >= rules.MaxPerHour {
+			reasons = append(reasons, fmt.Sprintf("more than %d submissions this hour", rules.MaxPerHour))
+		}
+
+		if rules.MaxScore > 0 && req.Score > rules.MaxScore {
+			reasons = append(reasons, fmt.Sprintf("score %d exceeds maximum %d", req.Score, rules.MaxScore))
+		}
+		if rules.MaxImprovement > 0 {
+			improvement, err := scoreImprovement(ctx, nk, board, isTournament, req.LeaderboardID, userID, req.Score)
+			if err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to read current record")
+				return "", err
+			}
+			if improvement > rules.MaxImprovement {
+				reasons = append(reasons, fmt.Sprintf("improvement %d exceeds maximum %d", improvement, rules.MaxImprovement))
+			}
+		}
+
+		// Consume the run whether or not the score is accepted. Deleting by version makes the token single use even
+		// when the same token is submitted concurrently. An expired open run is deleted too, whatever token was sent.
+		if runObject != nil && (run.Token == req.RunToken || now-run.StartTime > rules.RunTTLSec) {
+			if err := nk.StorageDelete(ctx, []*runtime.StorageDelete{{Collection: storageCollectionScoreRuns, Key: req.LeaderboardID, UserID: userID, Version: runObject.Version}}); err != nil && run.Token == req.RunToken {
+				reasons = append(reasons, "run token already used")
+			}
+		}
+
+		submissions.LastSubmitTime = now
+		submissions.WindowCount++
+		value, err := json.Marshal(submissions)
+		if err != nil {
+			return "", err
+		}
+		if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+			Collection:      storageCollectionScoreSubmissions,
+			Key:             req.LeaderboardID,
+			UserID:          userID,
+			Value:           string(value),
+			Version:         submissionsVersion,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}}); err != nil {
+			// A concurrent submission updated the counters first.
+			reasons = append(reasons, "concurrent submission")
+		}
+
+		if len(reasons) > 0 {
+			recordScoreRejection(ctx, logger, nk, &ScoreRejection{
+				UserID:        userID,
+				LeaderboardID: req.LeaderboardID,
+				Score:         req.Score,
+				Subscore:      req.Subscore,
+				Reasons:       reasons,
+				Time:          now,
+			})
+			return "", errScoreRejected
+		}
+
+		var record *api.LeaderboardRecord
+		if isTournament {
+			record, err = nk.TournamentRecordWrite(ctx, req.LeaderboardID, userID, username, req.Score, req.Subscore, req.Metadata, nil)
+		} else {
+			record, err = nk.LeaderboardRecordWrite(ctx, req.LeaderboardID, userID, username, req.Score, req.Subscore, req.Metadata, nil)
+		}
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to write score")
+			return "", err
+		}
+
+		response, err := json.Marshal(record)
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+// scoreImprovement returns how much score improves on the player's current record on the board with ID id, in the sort
+// order of its definition. A shard's definition is its parent's, so the record is read from id rather than board.ID.
+// Incremental boards treat every submission as an improvement of its full value.
+func scoreImprovement(ctx context.Context, nk runtime.NakamaModule, board *LeaderboardsConfigLeaderboard, isTournament bool, id, userID string, score int64) (int64, error) {
+	switch board.Operator {
+	case "incr":
+		return score, nil
+	case "decr":
+		return -score, nil
+	}
+
+	var ownerRecords []*api.LeaderboardRecord
+	var err error
+	if isTournament {
+		_, ownerRecords, _, _, err = nk.TournamentRecordsList(ctx, id, []string{userID}, 1, "", 0)
+	} else {
+		_, ownerRecords, _, _, err = nk.LeaderboardRecordsList(ctx, id, []string{userID}, 1, "", 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(ownerRecords) == 0 {
+		// Without a previous record only max_score applies.
+		return 0, nil
+	}
+
+	if board.SortOrder == "asc" {
+		return ownerRecords[0].Score - score, nil
+	}
+	return score - ownerRecords[0].Score, nil
+}
+
+func recordScoreRejection(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, rejection *ScoreRejection) {
+	logger.WithFields(map[string]interface{}{
+		"user_id":     rejection.UserID,
+		"leaderboard": rejection.LeaderboardID,
+		"score":       rejection.Score,
+		"reasons":     rejection.Reasons,
+	}).Warn("Score submission rejected")
+
+	value, err := json.Marshal(rejection)
+	if err != nil {
+		return
+	}
+	token, err := newRunToken()
+	if err != nil {
+		return
+	}
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionScoreRejections,
+		Key:             fmt.Sprintf("%d_%s", rejection.Time, token),
+		Value:           string(value),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to record score rejection")
+	}
+}
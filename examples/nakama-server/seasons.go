@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	metadataKeySeasonArchive = "season_archive"
+
+	// One system-owned object per leaderboard holds its archived seasons, newest first.
+	storageCollectionLeaderboardSeasons = "leaderboard_seasons"
+	// One user-owned object per leaderboard holds the player's own final result for each archived season.
+	storageCollectionLeaderboardSeasonResults = "leaderboard_season_results"
+
+	seasonArchiveDefaultTopCount   = 10
+	seasonArchiveDefaultMaxSeasons = 52
+	seasonListDefaultLimit         = 10
+)
+
+// SeasonArchiveConfig is read from the "season_archive" key of leaderboard metadata.
+type SeasonArchiveConfig struct {
+	// TopCount is how many of the top records are kept in each season summary.
+	TopCount int `json:"top_count"`
+	// MaxSeasons is how many past seasons are kept, both in summaries and player histories.
+	MaxSeasons int `json:"max_seasons"`
+}
+
+type SeasonRecord struct {
+	OwnerID  string `json:"owner_id"`
+	Username string `json:"username"`
+	Score    int64  `json:"score"`
+	Subscore int64  `json:"subscore"`
+	Rank     int64  `json:"rank"`
+}
+
+type Season struct {
+	SeasonEnd   int64           `json:"season_end"`
+	PlayerCount int64           `json:"player_count"`
+	Top         []*SeasonRecord `json:"top"`
+}
+
+type LeaderboardSeasons struct {
+	LeaderboardID string    `json:"leaderboard_id"`
+	Seasons       []*Season `json:"seasons"`
+}
+
+type SeasonResult struct {
+	SeasonEnd int64 `json:"season_end"`
+	Rank      int64 `json:"rank"`
+	Score     int64 `json:"score"`
+	Subscore  int64 `json:"subscore"`
+}
+
+type SeasonHistory struct {
+	LeaderboardID string          `json:"leaderboard_id"`
+	Seasons       []*SeasonResult `json:"seasons"`
+	// BestRank and BestScore cover every archived season, including ones since dropped by max_seasons.
+	BestRank  int64 `json:"best_rank"`
+	BestScore int64 `json:"best_score"`
+}
+
+type seasonsListRequest struct {
+	LeaderboardID string `json:"leaderboard_id"`
+	Limit         int    `json:"limit"`
+}
+
+type seasonHistoryRequest struct {
+	LeaderboardID string `json:"leaderboard_id"`
+	// UserID defaults to the caller.
+	UserID string `json:"user_id"`
+}
+
+func parseSeasonArchiveConfig(metadata map[string]interface{}) (*SeasonArchiveConfig, error) {
+	raw, found := metadata[metadataKeySeasonArchive]
+	if !found {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	config := &SeasonArchiveConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	if config.TopCount <= 0 {
+		config.TopCount = seasonArchiveDefaultTopCount
+	}
+	if config.MaxSeasons <= 0 {
+		config.MaxSeasons = seasonArchiveDefaultMaxSeasons
+	}
+	return config, nil
+}
+
+// seasonArchiveHandler snapshots a leaderboard's final standings when it resets. Only leaderboards with a
+// "season_archive" key in their metadata are archived.
+func seasonArchiveHandler(config *LeaderboardsConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, leaderboard *api.Leaderboard, reset int64) error {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, leaderboard *api.Leaderboard, reset int64) error {
+		logger = logger.WithFields(map[string]interface{}{"leaderboard": leaderboard.Id, "reset": reset})
+
+		metadata, err := config.metadataFor(leaderboard.Id, leaderboard.Metadata)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Invalid leaderboard metadata")
+			return err
+		}
+		archiveConfig, err := parseSeasonArchiveConfig(metadata)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Invalid season archive config")
+			return err
+		}
+		if archiveConfig == nil {
+			return nil
+		}
+
+		season := &Season{SeasonEnd: reset}
+		cursor := ""
+		for {
+			// Records from the season that just ended have expired, so list them as of the reset time.
+			records, _, nextCursor, _, err := nk.LeaderboardRecordsList(ctx, leaderboard.Id, nil, listPageSize, cursor, reset)
+			if err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to list leaderboard records")
+				return err
+			}
+
+			for _, record := range records {
+				if len(season.Top) < archiveConfig.TopCount {
+					season.Top = append(season.Top, &SeasonRecord{
+						OwnerID:  record.OwnerId,
+						Username: record.GetUsername().GetValue(),
+						Score:    record.Score,
+						Subscore: record.Subscore,
+						Rank:     record.Rank,
+					})
+				}
+			}
+			season.PlayerCount += int64(len(records))
+
+			if err := archiveSeasonResults(ctx, nk, leaderboard.Id, reset, archiveConfig.MaxSeasons, records); err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to archive player season results")
+				return err
+			}
+
+			if nextCursor == "" || len(records) == 0 {
+				break
+			}
+			cursor = nextCursor
+		}
+
+		if err := archiveSeason(ctx, nk, leaderboard.Id, archiveConfig.MaxSeasons, season); err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to archive season")
+			return err
+		}
+
+		logger.Info("Archived season with %d players", season.PlayerCount)
+		return nil
+	}
+}
+
+func archiveSeason(ctx context.Context, nk runtime.NakamaModule, leaderboardID string, maxSeasons int, season *Season) error {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionLeaderboardSeasons, Key: leaderboardID}})
+	if err != nil {
+		return err
+	}
+
+	seasons := &LeaderboardSeasons{LeaderboardID: leaderboardID}
+	version := "*"
+	if len(objects) > 0 {
+		if err := json.Unmarshal([]byte(objects[0].Value), seasons); err != nil {
+			return err
+		}
+		version = objects[0].Version
+	}
+
+	// A reset may be delivered more than once, only keep the first snapshot.
+	if len(seasons.Seasons) > 0 && seasons.Seasons[0].SeasonEnd >= season.SeasonEnd {
+		return nil
+	}
+	seasons.Seasons = append([]*Season{season}, seasons.Seasons...)
+	if len(seasons.Seasons) > maxSeasons {
+		seasons.Seasons = seasons.Seasons[:maxSeasons]
+	}
+
+	value, err := json.Marshal(seasons)
+	if err != nil {
+		return err
+	}
+	_, err = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      storageCollectionLeaderboardSeasons,
+		Key:             leaderboardID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  2,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+func archiveSeasonResults(ctx context.Context, nk runtime.NakamaModule, leaderboardID string, seasonEnd int64, maxSeasons int, records []*api.LeaderboardRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	reads := make([]*runtime.StorageRead, 0, len(records))
+	for _, record := range records {
+		reads = append(reads, &runtime.StorageRead{Collection: storageCollectionLeaderboardSeasonResults, Key: leaderboardID, UserID: record.OwnerId})
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]*api.StorageObject, len(objects))
+	for _, object := range objects {
+		existing[object.UserId] = object
+	}
+
+	writes := make([]*runtime.StorageWrite, 0, len(records))
+	for _, record := range records {
+		history := &SeasonHistory{LeaderboardID: leaderboardID}
+		version := "*"
+		if object, found := existing[record.OwnerId]; found {
+			if err := json.Unmarshal([]byte(object.Value), history); err != nil {
+				return err
+			}
+			version = object.Version
+		}
+
+		if len(history.Seasons) > 0 && history.Seasons[0].SeasonEnd >= seasonEnd {
+			continue
+		}
+		history.Seasons = append([]*SeasonResult{{
+			SeasonEnd: seasonEnd,
+			Rank:      record.Rank,
+			Score:     record.Score,
+			Subscore:  record.Subscore,
+		}}, history.Seasons...)
+		if len(history.Seasons) > maxSeasons {
+			history.Seasons = history.Seasons[:maxSeasons]
+		}
+		if history.BestRank == 0 || record.Rank < history.BestRank {
+			history.BestRank = record.Rank
+		}
+		if record.Score > history.BestScore {
+			history.BestScore = record.Score
+		}
+
+		value, err := json.Marshal(history)
+		if err != nil {
+			return err
+		}
+		writes = append(writes, &runtime.StorageWrite{
+			Collection:      storageCollectionLeaderboardSeasonResults,
+			Key:             leaderboardID,
+			UserID:          record.OwnerId,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  2,
+			PermissionWrite: 0,
+		})
+	}
+
+	if len(writes) == 0 {
+		return nil
+	}
+	_, err = nk.StorageWrite(ctx, writes)
+	return err
+}
+
+// rpcLeaderboardSeasonsList returns the most recent archived seasons of a leaderboard, newest first.
+func rpcLeaderboardSeasonsList(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var req seasonsListRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid request payload", 3)
+	}
+	if req.LeaderboardID == "" {
+		return "", runtime.NewError("leaderboard_id is required", 3)
+	}
+	if req.Limit <= 0 {
+		req.Limit = seasonListDefaultLimit
+	}
+
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionLeaderboardSeasons, Key: req.LeaderboardID}})
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read leaderboard seasons")
+		return "", err
+	}
+
+	seasons := &LeaderboardSeasons{LeaderboardID: req.LeaderboardID, Seasons: []*Season{}}
+	if len(objects) > 0 {
+		if err := json.Unmarshal([]byte(objects[0].Value), seasons); err != nil {
+			return "", err
+		}
+	}
+	if len(seasons.Seasons) > req.Limit {
+		seasons.Seasons = seasons.Seasons[:req.Limit]
+	}
+
+	response, err := json.Marshal(seasons)
+	if err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
+
+// rpcLeaderboardSeasonHistory returns a player's final result for each archived season of a leaderboard.
+func rpcLeaderboardSeasonHistory(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var req seasonHistoryRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", runtime.NewError("invalid request payload", 3)
+	}
+	if req.LeaderboardID == "" {
+		return "", runtime.NewError("leaderboard_id is required", 3)
+	}
+	if req.UserID == "" {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+		req.UserID = userID
+	}
+
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: storageCollectionLeaderboardSeasonResults, Key: req.LeaderboardID, UserID: req.UserID}})
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read season history")
+		return "", err
+	}
+
+	history := &SeasonHistory{LeaderboardID: req.LeaderboardID, Seasons: []*SeasonResult{}}
+	if len(objects) > 0 {
+		if err := json.Unmarshal([]byte(objects[0].Value), history); err != nil {
+			return "", fmt.Errorf("invalid season history: %w", err)
+		}
+	}
+
+	response, err := json.Marshal(history)
+	if err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
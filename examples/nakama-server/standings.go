@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	standingsViewAroundMe = "around_me"
+	standingsViewFriends  = "friends"
+
+	standingsDefaultLimit = 20
+	// Nakama lists at most this many friends per page.
+	standingsMaxFriends = 1000
+	friendStateMutual   = 0
+)
+
+var errStandingsInvalidCursor = runtime.NewError("invalid cursor", 3)
+
+type StandingsRecord struct {
+	OwnerID  string `json:"owner_id"`
+	Username string `json:"username"`
+	Score    int64  `json:"score"`
+	Subscore int64  `json:"subscore"`
+	// Rank is the global rank on the leaderboard.
+	Rank int64 `json:"rank"`
+	// Position is the rank among the caller and their friends, only set in the friends view.
+	Position int64 `json:"position,omitempty"`
+}
+
+type Standings struct {
+	LeaderboardID string             `json:"leaderboard_id"`
+	View          string             `json:"view"`
+	Records       []*StandingsRecord `json:"records"`
+	// Owner is the caller's own record, if they have one, whether or not it is on this page.
+	Owner      *StandingsRecord `json:"owner,omitempty"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+	PrevCursor string           `json:"prev_cursor,omitempty"`
+}
+
+type standingsRequest struct {
+	LeaderboardID string `json:"leaderboard_id"`
+	View          string `json:"view"`
+	Limit         int    `json:"limit"`
+	Cursor        string `json:"cursor"`
+}
+
+// standingsCursor is what the opaque cursor handed to clients decodes to. Around-me pages wrap Nakama's own record
+// cursor, friends pages an offset into the merged friends list.
+type standingsCursor struct {
+	LeaderboardID string `json:"l"`
+	View          string `json:"v"`
+	Cursor        string `json:"c,omitempty"`
+	Offset        int    `json:"o,omitempty"`
+}
+
+func (c *standingsCursor) encode() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeStandingsCursor(cursor, leaderboardID, view string) (*standingsCursor, error) {
+	decoded := &standingsCursor{LeaderboardID: leaderboardID, View: view}
+	if cursor == "" {
+		return decoded, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errStandingsInvalidCursor
+	}
+	if err := json.Unmarshal(data, decoded); err != nil || decoded.LeaderboardID != leaderboardID || decoded.View != view || decoded.Offset < 0 {
+		return nil, errStandingsInvalidCursor
+	}
+	return decoded, nil
+}
+
+func newStandingsRecord(record *api.LeaderboardRecord) *StandingsRecord {
+	return &StandingsRecord{
+		OwnerID:  record.OwnerId,
+		Username: record.GetUsername().GetValue(),
+		Score:    record.Score,
+		Subscore: record.Subscore,
+		Rank:     record.Rank,
+	}
+}
+
+// rpcLeaderboardStandings lists the records of a configured leaderboard or tournament either around the caller's own
+// record, or among the caller and their friends.
+func rpcLeaderboardStandings(config *LeaderboardsConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		var req standingsRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request payload", 3)
+		}
+		def, isTournament := config.board(req.LeaderboardID)
+		if def == nil {
+			return "", runtime.NewError("leaderboard not found", 5)
+		}
+		if req.View == "" {
+			req.View = standingsViewAroundMe
+		}
+		if req.View != standingsViewAroundMe && req.View != standingsViewFriends {
+			return "", runtime.NewError("view must be one of: around_me, friends", 3)
+		}
+		if req.Limit <= 0 || req.Limit > listPageSize {
+			req.Limit = standingsDefaultLimit
+		}
+		cursor, err := decodeStandingsCursor(req.Cursor, req.LeaderboardID, req.View)
+		if err != nil {
+			return "", err
+		}
+
+		var standings *Standings
+		if req.View == standingsViewFriends {
+			standings, err = friendsStandings(ctx, nk, userID, req.LeaderboardID, isTournament, req.Limit, cursor)
+		} else {
+			standings, err = aroundMeStandings(ctx, nk, userID, req.LeaderboardID, isTournament, req.Limit, cursor)
+		}
+		if err != nil {
+			logger.WithFields(map[string]interface{}{"leaderboard": req.LeaderboardID, "view": req.View, "error": err.Error()}).Error("Failed to list standings")
+			return "", err
+		}
+
+		response, err := json.Marshal(standings)
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+// aroundMeStandings starts from the page centred on the caller's record and pages on from there with Nakama's own
+// cursors. Callers without a record get the top of the leaderboard.
+func aroundMeStandings(ctx context.Context, nk runtime.NakamaModule, userID, leaderboardID string, isTournament bool, limit int, cursor *standingsCursor) (*Standings, error) {
+	var list *api.LeaderboardRecordList
+	if isTournament {
+		tournamentList, err := nk.TournamentRecordsHaystack(ctx, leaderboardID, userID, limit, cursor.Cursor, 0)
+		if err != nil {
+			return nil, err
+		}
+		list = &api.LeaderboardRecordList{Records: tournamentList.Records, NextCursor: tournamentList.NextCursor, PrevCursor: tournamentList.PrevCursor}
+	} else {
+		var err error
+		if list, err = nk.LeaderboardRecordsHaystack(ctx, leaderboardID, userID, limit, cursor.Cursor, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	standings := &Standings{LeaderboardID: leaderboardID, View: standingsViewAroundMe, Records: make([]*StandingsRecord, 0, len(list.Records))}
+	for _, record := range list.Records {
+		standingsRecord := newStandingsRecord(record)
+		standings.Records = append(standings.Records, standingsRecord)
+		if record.OwnerId == userID {
+			standings.Owner = standingsRecord
+		}
+	}
+
+	var err error
+	if list.NextCursor != "" {
+		if standings.NextCursor, err = (&standingsCursor{LeaderboardID: leaderboardID, View: standingsViewAroundMe, Cursor: list.NextCursor}).encode(); err != nil {
+			return nil, err
+		}
+	}
+	if list.PrevCursor != "" {
+		if standings.PrevCursor, err = (&standingsCursor{LeaderboardID: leaderboardID, View: standingsViewAroundMe, Cursor: list.PrevCursor}).encode(); err != nil {
+			return nil, err
+		}
+	}
+	return standings, nil
+}
+
+// friendsStandings ranks the caller and their mutual friends. Their records are fetched as owner records with one
+// call per page of friends, rather than one call per friend, then merged by rank and paged by offset.
+func friendsStandings(ctx context.Context, nk runtime.NakamaModule, userID, leaderboardID string, isTournament bool, limit int, cursor *standingsCursor) (*Standings, error) {
+	var records []*api.LeaderboardRecord
+	state := friendStateMutual
+	friendsCursor := ""
+	for {
+		friends, nextCursor, err := nk.FriendsList(ctx, userID, standingsMaxFriends, &state, friendsCursor)
+		if err != nil {
+			return nil, err
+		}
+		ownerIDs := make([]string, 0, len(friends)+1)
+		if friendsCursor == "" {
+			ownerIDs = append(ownerIDs, userID)
+		}
+		for _, friend := range friends {
+			ownerIDs = append(ownerIDs, friend.GetUser().GetId())
+		}
+		ownerRecords, err := listOwnerRecords(ctx, nk, leaderboardID, isTournament, ownerIDs)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, ownerRecords...)
+
+		if friendsCursor = nextCursor; friendsCursor == "" {
+			break
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Rank < records[j].Rank
+	})
+
+	standings := &Standings{LeaderboardID: leaderboardID, View: standingsViewFriends, Records: make([]*StandingsRecord, 0, limit)}
+	for i, record := range records {
+		standingsRecord := newStandingsRecord(record)
+		standingsRecord.Position = int64(i + 1)
+		if record.OwnerId == userID {
+			standings.Owner = standingsRecord
+		}
+		if i >= cursor.Offset && i < cursor.Offset+limit {
+			standings.Records = append(standings.Records, standingsRecord)
+		}
+	}
+
+	var err error
+	if cursor.Offset+limit < len(records) {
+		if standings.NextCursor, err = (&standingsCursor{LeaderboardID: leaderboardID, View: standingsViewFriends, Offset: cursor.Offset + limit}).encode(); err != nil {
+			return nil, err
+		}
+	}
+	if cursor.Offset > 0 {
+		prev := cursor.Offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		if standings.PrevCursor, err = (&standingsCursor{LeaderboardID: leaderboardID, View: standingsViewFriends, Offset: prev}).encode(); err != nil {
+			return nil, err
+		}
+	}
+	return standings, nil
+}
+
+// listOwnerRecords returns the records of the given owners only. A zero limit has Nakama skip the global page.
+func listOwnerRecords(ctx context.Context, nk runtime.NakamaModule, leaderboardID string, isTournament bool, ownerIDs []string) ([]*api.LeaderboardRecord, error) {
+	if isTournament {
+		_, ownerRecords, _, _, err := nk.TournamentRecordsList(ctx, leaderboardID, ownerIDs, 0, "", 0)
+		return ownerRecords, err
+	}
+	_, ownerRecords, _, _, err := nk.LeaderboardRecordsList(ctx, leaderboardID, ownerIDs, 0, "", 0)
+	return ownerRecords, err
+}
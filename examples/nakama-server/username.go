@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	usernameGeneratorNumeric = "numeric"
+	usernameGeneratorWords   = "words"
+	usernameGeneratorLocale  = "locale"
+
+	usernameMaxLength          = 128
+	usernameDefaultMaxAttempts = 5
+)
+
+// UsernameGenerator produces candidate usernames. Implementations must be safe to call with a shared *rand.Rand
+// that the caller has already locked.
+type UsernameGenerator interface {
+	Generate(random *rand.Rand, locale string) string
+}
+
+// NumericUsernameGenerator produces usernames such as "Player01234567".
+type NumericUsernameGenerator struct {
+	Prefix string
+	Digits int
+}
+
+func (g *NumericUsernameGenerator) Generate(random *rand.Rand, _ string) string {
+	return g.Prefix + randomDigits(random, g.Digits)
+}
+
+// WordsUsernameGenerator produces usernames such as "BraveOtter042" from adjective and noun word lists.
+type WordsUsernameGenerator struct {
+	Adjectives []string
+	Nouns      []string
+	Digits     int
+}
+
+func (g *WordsUsernameGenerator) Generate(random *rand.Rand, _ string) string {
+	if len(g.Adjectives) == 0 || len(g.Nouns) == 0 {
+		return ""
+	}
+	adjective := g.Adjectives[random.Intn(len(g.Adjectives))]
+	noun := g.Nouns[random.Intn(len(g.Nouns))]
+	return adjective + noun + randomDigits(random, g.Digits)
+}
+
+// LocaleUsernameGenerator picks a generator by the player's language tag, falling back to a default generator when
+// no word list exists for that language.
+type LocaleUsernameGenerator struct {
+	Locales  map[string]UsernameGenerator
+	Fallback UsernameGenerator
+}
+
+func (g *LocaleUsernameGenerator) Generate(random *rand.Rand, locale string) string {
+	// Match "pt-BR" and "pt_BR" against a "pt" word list.
+	locale = strings.ToLower(locale)
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		locale = locale[:i]
+	}
+	if generator, found := g.Locales[locale]; found {
+		return generator.Generate(random, locale)
+	}
+	return g.Fallback.Generate(random, locale)
+}
+
+func randomDigits(random *rand.Rand, digits int) string {
+	if digits <= 0 {
+		return ""
+	}
+	max := 1
+	for i := 0; i < digits; i++ {
+		max *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, random.Intn(max))
+}
+
+// UsernameFilter rejects usernames that contain reserved or profane words. Matching is case-insensitive and ignores
+// common character substitutions, so "4dm1n" and "A_D_M_I_N" are both caught by "admin".
+type UsernameFilter struct {
+	words []string
+}
+
+func NewUsernameFilter(words ...[]string) *UsernameFilter {
+	f := &UsernameFilter{}
+	for _, list := range words {
+		for _, word := range list {
+			if word = normalizeUsername(word); word != "" {
+				f.words = append(f.words, word)
+			}
+		}
+	}
+	return f
+}
+
+// Allowed reports whether the username contains none of the filtered words.
+func (f *UsernameFilter) Allowed(username string) bool {
+	normalized := normalizeUsername(username)
+	for _, word := range f.words {
+		if strings.Contains(normalized, word) {
+			return false
+		}
+	}
+	return true
+}
+
+var usernameSubstitutions = strings.NewReplacer(
+	"0", "o",
+	"1", "i",
+	"3", "e",
+	"4", "a",
+	"5", "s",
+	"7", "t",
+	"@", "a",
+	"$", "s",
+)
+
+func normalizeUsername(username string) string {
+	username = usernameSubstitutions.Replace(strings.ToLower(username))
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) {
+			return r
+		}
+		return -1
+	}, username)
+}
+
+// validUsername applies the same rules Nakama uses for account usernames.
+func validUsername(username string) bool {
+	if username == "" || len(username) > usernameMaxLength || !utf8.ValidString(username) {
+		return false
+	}
+	for _, r := range username {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// UsernameAssigner decides which username a newly authenticating player receives. A requested username is kept if it
+// is valid, passes the filter and is not already taken; otherwise a generated one is used.
+type UsernameAssigner struct {
+	generator   UsernameGenerator
+	filter      *UsernameFilter
+	maxAttempts int
+
+	randomMutex sync.Mutex
+	random      *rand.Rand
+}
+
+func NewUsernameAssigner(generator UsernameGenerator, filter *UsernameFilter, maxAttempts int) *UsernameAssigner {
+	if maxAttempts <= 0 {
+		maxAttempts = usernameDefaultMaxAttempts
+	}
+	return &UsernameAssigner{
+		generator:   generator,
+		filter:      filter,
+		maxAttempts: maxAttempts,
+		random:      rand.New(rand.NewSource(time.Now().UTC().UnixNano())),
+	}
+}
+
+// Assign returns the username to use for an authenticate request. An empty result leaves the choice to Nakama, which
+// generates its own random username; this is only returned when no unique candidate could be found.
+func (a *UsernameAssigner) Assign(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, requested, locale string) string {
+	if requested != "" && validUsername(requested) && a.filter.Allowed(requested) {
+		taken, err := usernameTaken(ctx, nk, requested)
+		if err != nil {
+			logger.WithField("error", err.Error()).Warn("Unable to check requested username availability")
+		} else if !taken {
+			return requested
+		}
+	}
+
+	for attempt := 0; attempt < a.maxAttempts; attempt++ {
+		a.randomMutex.Lock()
+		candidate := a.generator.Generate(a.random, locale)
+		a.randomMutex.Unlock()
+
+		if !validUsername(candidate) || !a.filter.Allowed(candidate) {
+			continue
+		}
+
+		taken, err := usernameTaken(ctx, nk, candidate)
+		if err != nil {
+			logger.WithField("error", err.Error()).Warn("Unable to check generated username availability")
+			return ""
+		}
+		if !taken {
+			return candidate
+		}
+	}
+
+	logger.Warn("Unable to generate a unique username after %d attempts", a.maxAttempts)
+	return ""
+}
+
+func usernameTaken(ctx context.Context, nk runtime.NakamaModule, username string) (bool, error) {
+	users, err := nk.UsersGetUsername(ctx, []string{username})
+	if err != nil {
+		return false, err
+	}
+	return len(users) > 0, nil
+}
+
+// newUsernameAssigner builds the assigner from the runtime env. USERNAME_GENERATOR selects one of "numeric" (the
+// default), "words" or "locale".
+func newUsernameAssigner(props map[string]string) (*UsernameAssigner, error) {
+	var generator UsernameGenerator
+	switch name := props["USERNAME_GENERATOR"]; name {
+	case "", usernameGeneratorNumeric:
+		generator = &NumericUsernameGenerator{Prefix: "Player", Digits: 8}
+	case usernameGeneratorWords:
+		generator = usernameWordLists["en"]
+	case usernameGeneratorLocale:
+		locales := make(map[string]UsernameGenerator, len(usernameWordLists))
+		for locale, generator := range usernameWordLists {
+			locales[locale] = generator
+		}
+		generator = &LocaleUsernameGenerator{Locales: locales, Fallback: usernameWordLists["en"]}
+	default:
+		return nil, fmt.Errorf("unknown USERNAME_GENERATOR %q", name)
+	}
+
+	return NewUsernameAssigner(generator, NewUsernameFilter(usernameReservedWords, usernameProfanityWords), usernameDefaultMaxAttempts), nil
+}
+
+func localeFromVars(ctx context.Context, vars map[string]string) string {
+	if locale := vars["locale"]; locale != "" {
+		return locale
+	}
+	locale, _ := ctx.Value(runtime.RUNTIME_CTX_LANG).(string)
+	return locale
+}
+
+var usernameWordLists = map[string]*WordsUsernameGenerator{
+	"en": {
+		Adjectives: []string{"Brave", "Swift", "Clever", "Mighty", "Silent", "Lucky", "Fierce", "Jolly", "Noble", "Sneaky"},
+		Nouns:      []string{"Otter", "Falcon", "Tiger", "Wizard", "Knight", "Panda", "Comet", "Dragon", "Ranger", "Fox"},
+		Digits:     3,
+	},
+	"es": {
+		Adjectives: []string{"Valiente", "Veloz", "Astuto", "Feroz", "Noble", "Audaz", "Alegre", "Sabio"},
+		Nouns:      []string{"Lobo", "Halcon", "Tigre", "Mago", "Caballero", "Cometa", "Dragon", "Zorro"},
+		Digits:     3,
+	},
+	"fr": {
+		Adjectives: []string{"Brave", "Rapide", "Malin", "Feroce", "Noble", "Joyeux", "Sage", "Agile"},
+		Nouns:      []string{"Loup", "Faucon", "Tigre", "Mage", "Chevalier", "Comete", "Dragon", "Renard"},
+		Digits:     3,
+	},
+	"de": {
+		Adjectives: []string{"Mutig", "Schnell", "Schlau", "Wild", "Edel", "Froh", "Weise", "Flink"},
+		Nouns:      []string{"Wolf", "Falke", "Tiger", "Magier", "Ritter", "Komet", "Drache", "Fuchs"},
+		Digits:     3,
+	},
+}
+
+var usernameReservedWords = []string{
+	"admin",
+	"administrator",
+	"moderator",
+	"heroiclabs",
+	"nakama",
+	"support",
+	"system",
+}
+
+// Keep this list short and extend it from a proper word list in production.
+var usernameProfanityWords = []string{
+	"fuck",
+	"shit",
+	"bitch",
+	"cunt",
+}
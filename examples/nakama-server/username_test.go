@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// fakeUsernameNk answers UsersGetUsername from a set of taken usernames. Any other NakamaModule call panics.
+type fakeUsernameNk struct {
+	runtime.NakamaModule
+	taken   map[string]bool
+	lookups []string
+}
+
+func (nk *fakeUsernameNk) UsersGetUsername(_ context.Context, usernames []string) ([]*api.User, error) {
+	nk.lookups = append(nk.lookups, usernames...)
+	var users []*api.User
+	for _, username := range usernames {
+		if nk.taken[username] {
+			users = append(users, &api.User{Username: username})
+		}
+	}
+	return users, nil
+}
+
+type fakeUsernameLogger struct{}
+
+func (l *fakeUsernameLogger) Debug(string, ...interface{})                     {}
+func (l *fakeUsernameLogger) Info(string, ...interface{})                      {}
+func (l *fakeUsernameLogger) Warn(string, ...interface{})                      {}
+func (l *fakeUsernameLogger) Error(string, ...interface{})                     {}
+func (l *fakeUsernameLogger) WithField(string, interface{}) runtime.Logger     { return l }
+func (l *fakeUsernameLogger) WithFields(map[string]interface{}) runtime.Logger { return l }
+func (l *fakeUsernameLogger) Fields() map[string]interface{}                   { return nil }
+
+// sequenceUsernameGenerator returns its candidates in order, then empty strings.
+type sequenceUsernameGenerator struct {
+	candidates []string
+	calls      int
+}
+
+func (g *sequenceUsernameGenerator) Generate(*rand.Rand, string) string {
+	g.calls++
+	if g.calls > len(g.candidates) {
+		return ""
+	}
+	return g.candidates[g.calls-1]
+}
+
+func TestUsernameAssignerKeepsValidRequestedName(t *testing.T) {
+	nk := &fakeUsernameNk{}
+	generator := &sequenceUsernameGenerator{candidates: []string{"Generated1"}}
+	assigner := NewUsernameAssigner(generator, NewUsernameFilter(usernameReservedWords), 3)
+
+	if got := assigner.Assign(context.Background(), &fakeUsernameLogger{}, nk, "BraveOtter", ""); got != "BraveOtter" {
+		t.Fatalf("got %q, want the requested username", got)
+	}
+	if generator.calls != 0 {
+		t.Fatalf("generator called %d times, want 0", generator.calls)
+	}
+}
+
+func TestUsernameAssignerReplacesTakenRequestedName(t *testing.T) {
+	nk := &fakeUsernameNk{taken: map[string]bool{"BraveOtter": true}}
+	generator := &sequenceUsernameGenerator{candidates: []string{"Generated1"}}
+	assigner := NewUsernameAssigner(generator, NewUsernameFilter(usernameReservedWords), 3)
+
+	if got := assigner.Assign(context.Background(), &fakeUsernameLogger{}, nk, "BraveOtter", ""); got != "Generated1" {
+		t.Fatalf("got %q, want %q", got, "Generated1")
+	}
+}
+
+func TestUsernameAssignerRetriesCollisions(t *testing.T) {
+	nk := &fakeUsernameNk{taken: map[string]bool{"Player1": true, "Player2": true}}
+	generator := &sequenceUsernameGenerator{candidates: []string{"Player1", "Player2", "Player3"}}
+	assigner := NewUsernameAssigner(generator, NewUsernameFilter(usernameReservedWords), 5)
+
+	if got := assigner.Assign(context.Background(), &fakeUsernameLogger{}, nk, "", ""); got != "Player3" {
+		t.Fatalf("got %q, want %q", got, "Player3")
+	}
+	if len(nk.lookups) != 3 {
+		t.Fatalf("got %d lookups, want 3", len(nk.lookups))
+	}
+}
+
+func TestUsernameAssignerBoundsRetries(t *testing.T) {
+	nk := &fakeUsernameNk{taken: map[string]bool{"Player1": true, "Player2": true, "Player3": true, "Player4": true}}
+	generator := &sequenceUsernameGenerator{candidates: []string{"Player1", "Player2", "Player3", "Player4"}}
+	assigner := NewUsernameAssigner(generator, NewUsernameFilter(usernameReservedWords), 3)
+
+	if got := assigner.Assign(context.Background(), &fakeUsernameLogger{}, nk, "", ""); got != "" {
+		t.Fatalf("got %q, want no username after the attempts run out", got)
+	}
+	if generator.calls != 3 {
+		t.Fatalf("generator called %d times, want 3", generator.calls)
+	}
+}
+
+func TestUsernameAssignerSkipsFilteredNames(t *testing.T) {
+	nk := &fakeUsernameNk{}
+	generator := &sequenceUsernameGenerator{candidates: []string{"Admin42", "Sys_Tem7", "Player1"}}
+	assigner := NewUsernameAssigner(generator, NewUsernameFilter(usernameReservedWords), 5)
+
+	if got := assigner.Assign(context.Background(), &fakeUsernameLogger{}, nk, "4dm1n", ""); got != "Player1" {
+		t.Fatalf("got %q, want %q", got, "Player1")
+	}
+	// Filtered names are rejected before their availability is checked.
+	if len(nk.lookups) != 1 || nk.lookups[0] != "Player1" {
+		t.Fatalf("got lookups %v, want only Player1", nk.lookups)
+	}
+}
+
+func TestUsernameFilter(t *testing.T) {
+	filter := NewUsernameFilter(usernameReservedWords)
+	for username, want := range map[string]bool{
+		"BraveOtter": true,
+		"admin":      false,
+		"4dm1n":      false,
+		"A_D_M_I_N":  false,
+		"xXNakamaXx": false,
+	} {
+		if got := filter.Allowed(username); got != want {
+			t.Errorf("Allowed(%q) = %v, want %v", username, got, want)
+		}
+	}
+}
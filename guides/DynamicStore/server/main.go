@@ -60,6 +60,21 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
 		return err
 	}
 
+	// Definitions uploaded by a server are previewed as a diff, then applied over the
+	// files above without a restart. See reload.go for the admin RPCs. Personalizers
+	// apply in the order they're added, so Satori's per-player overrides below are
+	// still merged on top of an upload.
+	reloadConfig := &DefinitionsReloadConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/definitions-reload.json", env), reloadConfig); err != nil {
+		return err
+	}
+	if err := reloadConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid definitions reload: %w", err)
+	}
+	if err := reloadConfig.Register(logger, initializer, systems); err != nil {
+		return err
+	}
+
 	// Satori personalization: merges Satori feature flag values (e.g. "Hiro-Economy")
 	// onto the base configs per player, enabling audience-based offers and live events
 	// in the store. Requires the Satori integration to be configured on the Nakama instance.
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Featured items are offered at these rarities, each pulled from the ticket's item set of the same rarity.
+var featuredRarities = map[float64]struct {
+	itemSetSuffix        string
+	guaranteedStatSuffix string
+}{
+	rarityFiveStar: {itemSetSuffix: itemSetSuffixFiveStar, guaranteedStatSuffix: "_five_star_guarantee"},
+	raritySixStar:  {itemSetSuffix: itemSetSuffixSixStar, guaranteedStatSuffix: "_six_star_guarantee"},
+}
+
+// GachaBannersConfig holds the limited-time banners. A banner puts its featured items up on a gacha ticket while it
+// runs; outside every banner the ticket pulls as usual.
+type GachaBannersConfig struct {
+	Banners map[string]*GachaBanner `json:"banners"`
+}
+
+type GachaBanner struct {
+	Name         string                 `json:"name"`
+	TicketID     string                 `json:"ticket_id"`
+	StartTimeSec int64                  `json:"start_time_sec"`
+	EndTimeSec   int64                  `json:"end_time_sec"`
+	Featured     []*GachaBannerFeatured `json:"featured"`
+}
+
+// GachaBannerFeatured is the rate-up of one rarity. When a pull lands on that rarity, it is one of the featured items
+// with probability Rate, and otherwise one of the ticket's standard items. With Guarantee, the pull after a lost 50/50
+// at that rarity is always featured.
+type GachaBannerFeatured struct {
+	StarRarity float64  `json:"star_rarity"`
+	Items      []string `json:"items"`
+	Rate       float64  `json:"rate"`
+	Guarantee  bool     `json:"guarantee"`
+}
+
+type bannersListResponse struct {
+	Banners []*bannerInfo `json:"banners"`
+}
+
+type bannerInfo struct {
+	ID           string                `json:"id"`
+	Name         string                `json:"name"`
+	TicketID     string                `json:"ticket_id"`
+	StartTimeSec int64                 `json:"start_time_sec"`
+	EndTimeSec   int64                 `json:"end_time_sec"`
+	RemainingSec int64                 `json:"remaining_sec"`
+	Featured     []*bannerFeaturedInfo `json:"featured"`
+}
+
+type bannerFeaturedInfo struct {
+	*GachaBannerFeatured
+	// Guaranteed is true if the player's next pull at this rarity will be featured.
+	Guaranteed bool `json:"guaranteed"`
+}
+
+func (c *GachaBannersConfig) Validate(inventory *hiro.InventoryConfig) error {
+	var errs []error
+	for id, banner := range c.Banners {
+		if ticket, found := inventory.Items[banner.TicketID]; !found || ticket.Category != categoryGachaTicket {
+			errs = append(errs, fmt.Errorf("banner %q: ticket_id %q is not a gacha ticket", id, banner.TicketID))
+		}
+		if banner.EndTimeSec <= banner.StartTimeSec {
+			errs = append(errs, fmt.Errorf("banner %q: end_time_sec must be after start_time_sec", id))
+		}
+		for otherID, other := range c.Banners {
+			if otherID < id && other.TicketID == banner.TicketID && other.StartTimeSec < banner.EndTimeSec && banner.StartTimeSec < other.EndTimeSec {
+				errs = append(errs, fmt.Errorf("banners %q and %q both run on %q at the same time", otherID, id, banner.TicketID))
+			}
+		}
+		rarities := make(map[float64]bool, len(banner.Featured))
+		for _, featured := range banner.Featured {
+			if _, found := featuredRarities[featured.StarRarity]; !found || rarities[featured.StarRarity] {
+				errs = append(errs, fmt.Errorf("banner %q: featured star_rarity must be %d or %d, and each at most once", id, rarityFiveStar, raritySixStar))
+			}
+			rarities[featured.StarRarity] = true
+			if featured.Rate <= 0 || featured.Rate > 1 {
+				errs = append(errs, fmt.Errorf("banner %q: featured rate must be in (0, 1]", id))
+			}
+			if len(featured.Items) == 0 {
+				errs = append(errs, fmt.Errorf("banner %q: no featured %v-star items", id, featured.StarRarity))
+			}
+			for _, itemID := range featured.Items {
+				if getItemRarity(inventory, itemID) != featured.StarRarity {
+					errs = append(errs, fmt.Errorf("banner %q: featured item %q is not a %v-star item", id, itemID, featured.StarRarity))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Active returns the ID and banner running on the ticket at now, if there is one.
+func (c *GachaBannersConfig) Active(ticketID string, now time.Time) (string, *GachaBanner) {
+	for id, banner := range c.Banners {
+		if banner.TicketID == ticketID && banner.StartTimeSec <= now.Unix() && now.Unix() < banner.EndTimeSec {
+			return id, banner
+		}
+	}
+	return "", nil
+}
+
+func (b *GachaBanner) featured(rarity float64) *GachaBannerFeatured {
+	for _, featured := range b.Featured {
+		if featured.StarRarity == rarity {
+			return featured
+		}
+	}
+	return nil
+}
+
+// guaranteedStat is the private stat set to 1 while the player's next pull of rarity on the ticket is guaranteed to be
+// featured, so the guarantee carries over to the ticket's next banner. The key is the ticket's pity key.
+func guaranteedStat(key string, rarity float64) string {
+	return key + featuredRarities[rarity].guaranteedStatSuffix
+}
+
+// apply makes a pull that landed on a featured rarity either featured or standard. It returns the rarity's featured
+// config, or nil if the rarity isn't featured, and whether the next pull at that rarity is guaranteed to be featured.
+func (b *GachaBanner) apply(config *hiro.InventoryConfig, ticketID string, reward *hiro.Reward, guaranteed bool) (*GachaBannerFeatured, bool) {
+	itemID := firstRewardItemID(reward)
+	if itemID == "" {
+		return nil, guaranteed
+	}
+	featured := b.featured(getItemRarity(config, itemID))
+	if featured == nil {
+		return nil, guaranteed
+	}
+
+	// Won the 50/50, or guaranteed after losing the last one.
+	if guaranteed || rand.Float64() < featured.Rate {
+		if !slices.Contains(featured.Items, itemID) {
+			replaceRewardItem(reward, itemID, featured.Items[rand.Intn(len(featured.Items))])
+		}
+		return featured, false
+	}
+
+	// Lost the 50/50: the pull is one of the ticket's standard items of this rarity.
+	if slices.Contains(featured.Items, itemID) {
+		var standard []string
+		for _, candidate := range itemSetItems(config, ticketID+featuredRarities[featured.StarRarity].itemSetSuffix) {
+			if !slices.Contains(featured.Items, candidate) {
+				standard = append(standard, candidate)
+			}
+		}
+		if len(standard) > 0 {
+			replaceRewardItem(reward, itemID, standard[rand.Intn(len(standard))])
+		}
+	}
+	return featured, featured.Guarantee
+}
+
+func replaceRewardItem(reward *hiro.Reward, fromItemID, toItemID string) {
+	reward.Items = map[string]int64{
+		toItemID: reward.Items[fromItemID],
+	}
+}
+
+func itemSetItems(config *hiro.InventoryConfig, set string) []string {
+	var items []string
+	for itemID, item := range config.Items {
+		if slices.Contains(item.ItemSets, set) {
+			items = append(items, itemID)
+		}
+	}
+	sort.Strings(items)
+	return items
+}
+
+func boolStat(value bool) int64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// rpcGachaBannersList returns the banners running now, with their timers and whether the player's next featured-rarity
+// pull on each is guaranteed.
+func rpcGachaBannersList(banners *GachaBannersConfig, pityGroups *GachaPityGroupsConfig, inventorySystem hiro.InventorySystem, statsSystem hiro.StatsSystem) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		config, ok := inventorySystem.GetConfig().(*hiro.InventoryConfig)
+		if !ok {
+			return "", errors.New("unexpected inventory system config type")
+		}
+
+		statList, err := statsSystem.List(ctx, logger, nk, userID, []string{userID})
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("statsSystem.List error")
+			return "", err
+		}
+
+		now := time.Now()
+		response := &bannersListResponse{Banners: make([]*bannerInfo, 0, len(banners.Banners))}
+		for id, banner := range banners.Banners {
+			if activeID, _ := banners.Active(banner.TicketID, now); activeID != id {
+				continue
+			}
+			info := &bannerInfo{
+				ID:           id,
+				Name:         banner.Name,
+				TicketID:     banner.TicketID,
+				StartTimeSec: banner.StartTimeSec,
+				EndTimeSec:   banner.EndTimeSec,
+				RemainingSec: banner.EndTimeSec - now.Unix(),
+			}
+			// A guarantee is shown as it will be at the next pull, after any pity group migration or reset.
+			ticket := config.Items[banner.TicketID]
+			pending := pityGroups.pendingUpdates(config, banners, statList, userID, ticket, now)
+			for _, featured := range banner.Featured {
+				info.Featured = append(info.Featured, &bannerFeaturedInfo{
+					GachaBannerFeatured: featured,
+					Guaranteed:          statValue(statList, userID, pending, guaranteedStat(pityKey(ticket, banner.TicketID), featured.StarRarity)) > 0,
+				})
+			}
+			response.Banners = append(response.Banners, info)
+		}
+		sort.Slice(response.Banners, func(i, j int) bool {
+			return response.Banners[i].EndTimeSec < response.Banners[j].EndTimeSec
+		})
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// cronField is one of the five fields of a cron expression, with the names it accepts in place of numbers.
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = []*cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	// Sunday is both 0 and 7.
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var cronDescriptors = map[string]bool{
+	"@yearly": true, "@annually": true, "@monthly": true, "@weekly": true, "@daily": true, "@midnight": true, "@hourly": true,
+}
+
+// checkCron returns why expr is not a standard five field cron expression, as Nakama and Hiro parse reset schedules.
+func checkCron(expr string) error {
+	if strings.HasPrefix(expr, "@") {
+		if !cronDescriptors[expr] {
+			return fmt.Errorf("unknown descriptor %q", expr)
+		}
+		return nil
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return fmt.Errorf("want 5 fields, got %d", len(fields))
+	}
+	for i, field := range fields {
+		if err := cronFields[i].check(field); err != nil {
+			return fmt.Errorf("%s %q: %w", cronFields[i].name, field, err)
+		}
+	}
+	return nil
+}
+
+func (f *cronField) check(field string) error {
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step, hasStep := strings.Cut(part, "/")
+		if hasStep {
+			if n, err := strconv.Atoi(step); err != nil || n <= 0 {
+				return fmt.Errorf("step %q must be a positive number", step)
+			}
+		}
+		if rangePart == "*" {
+			continue
+		}
+		low, high, isRange := strings.Cut(rangePart, "-")
+		lowValue, err := f.value(low)
+		if err != nil {
+			return err
+		}
+		if !isRange {
+			continue
+		}
+		highValue, err := f.value(high)
+		if err != nil {
+			return err
+		}
+		if highValue < lowValue {
+			return fmt.Errorf("range %q ends before it starts", rangePart)
+		}
+	}
+	return nil
+}
+
+func (f *cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		if s == "" {
+			return 0, errors.New("empty value")
+		}
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	if n < f.min || n > f.max {
+		return 0, fmt.Errorf("%d is outside %d-%d", n, f.min, f.max)
+	}
+	return n, nil
+}
@@ -0,0 +1,135 @@
+// Command lintdefs checks definitions folders offline, before a server loads them.
+//
+// Every definitions/<env> folder found under the given paths (default ".") is linted as one set. Hiro's base-*.json
+// files are loaded into their Hiro config types, reporting fields the types don't have. Keys starting with "//" are
+// comments and are ignored. The folder is then checked as a whole: rewards, store costs and starting wallets only
+// reference currencies, items and item sets that exist, weighted rewards can roll, reset schedules are valid cron
+// expressions, achievement preconditions exist and "level_N" sub-achievements have no gaps. Reward and schedule fields
+// in the server's own definitions files are checked the same way. Next to a gacha.go, the gacha tickets are checked
+// against its constants too.
+//
+// Definitions are loaded with the Hiro version of the module lintdefs is built in. Folders inside a module that requires
+// a different version are skipped, and are linted by running the copy of lintdefs in that module instead.
+//
+// Each problem is reported with its file and JSON path, and the command exits with status 1 if there are any:
+//
+//	cd guides/Gacha/server && go run ./cmd/lintdefs ../../..
+//	cd examples/nakama-hiro-server && go run ./cmd/lintdefs .
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// problem is one thing wrong with a definitions file, at a JSON path such as "$.items.shield.item_sets[0]".
+type problem struct {
+	file    string
+	path    string
+	message string
+}
+
+func (p *problem) String() string {
+	if p.path == "" {
+		return fmt.Sprintf("%s: %s", p.file, p.message)
+	}
+	return fmt.Sprintf("%s: %s: %s", p.file, p.path, p.message)
+}
+
+// reporter collects the problems of one file.
+type reporter struct {
+	file     string
+	problems *[]*problem
+}
+
+func (r *reporter) report(path, format string, args ...any) {
+	*r.problems = append(*r.problems, &problem{file: r.file, path: path, message: fmt.Sprintf(format, args...)})
+}
+
+func main() {
+	roots := os.Args[1:]
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+
+	folders, err := findDefinitionsFolders(roots)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(folders) == 0 {
+		fmt.Fprintln(os.Stderr, "no definitions folders found")
+		os.Exit(2)
+	}
+
+	// Folders of a module on another Hiro version are skipped, the config types here may not match the ones their
+	// server loads them into.
+	version := hiroVersion()
+	var problems []*problem
+	var skipped int
+	for _, folder := range folders {
+		moduleVersion, err := moduleHiroVersion(folder)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if moduleVersion != "" && version != "" && moduleVersion != version {
+			fmt.Fprintf(os.Stderr, "%s: skipped, its module uses hiro %s and lintdefs is built with %s, run the lintdefs of that module\n", folder, moduleVersion, version)
+			skipped++
+			continue
+		}
+		problems = append(problems, lintFolder(folder)...)
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].file < problems[j].file
+	})
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Fprintf(os.Stderr, "%d definitions folders, %d skipped, %d problems\n", len(folders), skipped, len(problems))
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// findDefinitionsFolders returns every <env> folder inside a "definitions" directory under roots, skipping vendored
+// and hidden directories.
+func findDefinitionsFolders(roots []string) ([]string, error) {
+	var folders []string
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() {
+				return nil
+			}
+			name := entry.Name()
+			if path != root && (name == "vendor" || name == "node_modules" || name[0] == '.') {
+				return filepath.SkipDir
+			}
+			if name != "definitions" {
+				return nil
+			}
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			for _, env := range entries {
+				if env.IsDir() {
+					folders = append(folders, filepath.Join(path, env.Name()))
+				}
+			}
+			return filepath.SkipDir
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(folders)
+	return folders, nil
+}
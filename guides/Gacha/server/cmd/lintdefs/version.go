@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+)
+
+const hiroModulePath = "github.com/heroiclabs/hiro"
+
+// hiroVersion is the version of Hiro lintdefs was built with, and so the config types it loads definitions into.
+func hiroVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == hiroModulePath {
+			return dep.Version
+		}
+	}
+	return ""
+}
+
+// moduleHiroVersion returns the version of Hiro required by the go.mod nearest above folder, or "" if there is none.
+// Definitions are only valid for the Hiro version of the server that loads them.
+func moduleHiroVersion(folder string) (string, error) {
+	dir, err := filepath.Abs(folder)
+	if err != nil {
+		return "", err
+	}
+	for {
+		file, err := os.Open(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			defer file.Close()
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "require"))
+				if len(fields) >= 2 && fields[0] == hiroModulePath {
+					return fields[1], nil
+				}
+			}
+			return "", scanner.Err()
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// loadDefinitions reads a JSON definitions file relative to the runtime path into config. Each sample server is built
+// from its own folder, so this file is copied unchanged into every one that loads definitions.
+func loadDefinitions(nk runtime.NakamaModule, path string, config any) error {
+	file, err := nk.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("failed to parse %q: %w", path, err)
+	}
+
+	return nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"time"
+
 	"github.com/heroiclabs/hiro"
 	"github.com/heroiclabs/nakama-common/runtime"
 )
@@ -34,6 +36,9 @@ func handleGachaConsumeReward(
 	economySystem hiro.EconomySystem,
 	inventorySystem hiro.InventorySystem,
 	statsSystem hiro.StatsSystem,
+	banners *GachaBannersConfig,
+	pityGroups *GachaPityGroupsConfig,
+	history *GachaHistoryConfig,
 	userID, sourceID string,
 	source *hiro.InventoryConfigItem,
 	reward *hiro.Reward,
@@ -50,6 +55,21 @@ func handleGachaConsumeReward(
 		return nil, nil
 	}
 
+	// A multi-pull carries its pity counters and inventory through every pull, and saves them and its history once with
+	// the last.
+	if batch, ok := ctx.Value(gachaBatchKey{}).(*gachaBatch); ok && batch.ticketID == sourceID {
+		reward, err := batch.pull(ctx, logger, nk, economySystem, config, userID, sourceID, source, reward)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch.pulls) == batch.count {
+			if err := batch.save(ctx, logger, nk, statsSystem, history, userID); err != nil {
+				return nil, err
+			}
+		}
+		return reward, nil
+	}
+
 	// Load stats for getting and updating pity progress.
 	statList, err := statsSystem.List(ctx, logger, nk, userID, []string{userID})
 	if err != nil {
@@ -57,54 +77,128 @@ func handleGachaConsumeReward(
 		return nil, err
 	}
 
-	sixStarPity := getPityStat(statList, userID, sourceID+statSuffixSixStarPity)
-	maxSixStarPity, hasSixStarPity := source.NumericProperties[propSixStarPity]
+	// Tickets in a pity group share its counters, which may first need migrating or resetting.
+	key := pityKey(source, sourceID)
+	statList, err = pityGroups.preparePity(ctx, logger, nk, statsSystem, config, banners, statList, userID, source)
+	if err != nil {
+		return nil, err
+	}
 
-	// Time for 6-star pity to kick in.
-	if hasSixStarPity && sixStarPity >= int(maxSixStarPity-1) {
-		// Roll a new reward with a guaranteed 6-star.
-		cfg := buildPityRewardConfig(sourceID, 0, pityWeightGuaranteedSixStar)
-		reward, err = rollPityReward(ctx, logger, nk, economySystem, config, userID, reward, cfg, raritySixStar)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		// If it's not time for 6-star pity, check if it's time for 5-star pity instead.
-		fiveStarPity := getPityStat(statList, userID, sourceID+statSuffixFiveStarPity)
-		maxFiveStarPity, hasFiveStarPity := source.NumericProperties[propFiveStarPity]
-
-		// Time for 5-star pity to kick in.
-		if hasFiveStarPity && fiveStarPity >= int(maxFiveStarPity-1) {
-			// Roll a new reward with an extremely likely 5-star, whilst keeping the small chance for a 6-star.
-			cfg := buildPityRewardConfig(sourceID, pityWeightFiveStar, pityWeightSixStar)
-			reward, err = rollPityReward(ctx, logger, nk, economySystem, config, userID, reward, cfg, rarityFiveStar)
-			if err != nil {
-				return nil, err
-			}
+	sixStarPity := getPityStat(statList, userID, key+statSuffixSixStarPity)
+	fiveStarPity := getPityStat(statList, userID, key+statSuffixFiveStarPity)
+	reward, err = rollWithPity(ctx, logger, nk, economySystem, config, userID, sourceID, source, reward, sixStarPity, fiveStarPity, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// If a banner is running on this ticket, a pull on one of its featured rarities goes through its 50/50.
+	now := time.Now()
+	var guaranteeUpdates []*hiro.StatUpdate
+	bannerID, banner := banners.Active(sourceID, now)
+	if banner != nil {
+		rarity := getItemRarity(config, firstRewardItemID(reward))
+		statName := guaranteedStat(key, rarity)
+		if featured, guaranteed := banner.apply(config, sourceID, reward, getPityStat(statList, userID, statName) > 0); featured != nil {
+			guaranteeUpdates = append(guaranteeUpdates, &hiro.StatUpdate{Name: statName, Value: boolStat(guaranteed), Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET})
 		}
 	}
 
 	// After deciding what reward the user will receive,
 	// update pity stats accordingly (based on the rarity of the reward item).
-	if err := updatePityStats(ctx, logger, nk, statsSystem, config, userID, sourceID, reward); err != nil {
+	if err := updatePityStats(ctx, logger, nk, statsSystem, config, userID, key, reward, guaranteeUpdates); err != nil {
 		return nil, err
 	}
 
+	record := newPullRecord(config, sourceID, bannerID, reward, sixStarPity, fiveStarPity, pityDue(source, sixStarPity, fiveStarPity, false) != 0, now)
+
 	// Finally, check if the user already has the reward item.
 	// If they do, then replace the reward with a stackable token representing a duplicate.
 	// This could be used to upgrade the item later, for example.
-	return replaceDuplicateWithToken(ctx, logger, nk, inventorySystem, userID, reward)
+	reward, err = replaceDuplicateWithToken(ctx, logger, nk, inventorySystem, userID, reward)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep a record of the pull in the player's history.
+	if record.ItemID != "" {
+		record.Duplicate = firstRewardItemID(reward) != record.ItemID
+		if err := history.write(ctx, logger, nk, userID, []*gachaPullRecord{record}); err != nil {
+			return nil, err
+		}
+	}
+
+	return reward, nil
 }
 
 func getPityStat(statList map[string]*hiro.StatList, userID, statKey string) int {
+	value, _ := findStat(statList, userID, statKey)
+	return int(value)
+}
+
+func findStat(statList map[string]*hiro.StatList, userID, statKey string) (int64, bool) {
 	if stats, found := statList[userID]; found {
 		if stat, found := stats.GetPrivate()[statKey]; found {
-			return int(stat.GetValue())
+			return stat.GetValue(), true
 		}
 	}
+	return 0, false
+}
+
+// pityDue returns the rarity whose pity kicks in on the next pull given the pity counters, or 0 if neither does.
+func pityDue(source *hiro.InventoryConfigItem, sixStarPity, fiveStarPity int, forceFiveStar bool) float64 {
+	// Time for 6-star pity to kick in.
+	if maxSixStarPity, hasSixStarPity := source.NumericProperties[propSixStarPity]; hasSixStarPity && sixStarPity >= int(maxSixStarPity-1) {
+		return raritySixStar
+	}
+
+	// If it's not time for 6-star pity, check if it's time for 5-star pity instead.
+	if maxFiveStarPity, hasFiveStarPity := source.NumericProperties[propFiveStarPity]; forceFiveStar || (hasFiveStarPity && fiveStarPity >= int(maxFiveStarPity-1)) {
+		return rarityFiveStar
+	}
+
 	return 0
 }
 
+// rollWithPity replaces the reward with a pity roll if the pity counters have reached the ticket's thresholds. A
+// forced five-star pity, as used by the multi-pull guarantee, is overridden by six-star pity.
+func rollWithPity(
+	ctx context.Context,
+	logger runtime.Logger,
+	nk runtime.NakamaModule,
+	economySystem hiro.EconomySystem,
+	config *hiro.InventoryConfig,
+	userID, sourceID string,
+	source *hiro.InventoryConfigItem,
+	reward *hiro.Reward,
+	sixStarPity, fiveStarPity int,
+	forceFiveStar bool,
+) (*hiro.Reward, error) {
+	switch pityDue(source, sixStarPity, fiveStarPity, forceFiveStar) {
+	case raritySixStar:
+		// Roll a new reward with a guaranteed 6-star.
+		cfg := buildPityRewardConfig(sourceID, 0, pityWeightGuaranteedSixStar)
+		return rollPityReward(ctx, logger, nk, economySystem, config, userID, reward, cfg, raritySixStar)
+	case rarityFiveStar:
+		// Roll a new reward with an extremely likely 5-star, whilst keeping the small chance for a 6-star.
+		cfg := buildPityRewardConfig(sourceID, pityWeightFiveStar, pityWeightSixStar)
+		return rollPityReward(ctx, logger, nk, economySystem, config, userID, reward, cfg, rarityFiveStar)
+	}
+
+	return reward, nil
+}
+
+// nextPity returns the pity counters after a pull of the given rarity.
+func nextPity(rarity float64, sixStarPity, fiveStarPity int) (int, int) {
+	switch {
+	case rarity >= raritySixStar:
+		return 0, 0
+	case rarity >= rarityFiveStar:
+		return sixStarPity + 1, 0
+	default:
+		return sixStarPity + 1, fiveStarPity + 1
+	}
+}
+
 func getItemRarity(config *hiro.InventoryConfig, itemID string) float64 {
 	if item, found := config.Items[itemID]; found {
 		return item.NumericProperties[propStarRarity]
@@ -180,8 +274,9 @@ func updatePityStats(
 	nk runtime.NakamaModule,
 	statsSystem hiro.StatsSystem,
 	config *hiro.InventoryConfig,
-	userID, sourceID string,
+	userID, key string,
 	reward *hiro.Reward,
+	extraUpdates []*hiro.StatUpdate,
 ) error {
 	itemID := firstRewardItemID(reward)
 	if itemID == "" {
@@ -196,23 +291,26 @@ func updatePityStats(
 	case rarity >= raritySixStar:
 		// Reset both pity counters on a six-star pull.
 		statUpdates = []*hiro.StatUpdate{
-			{Name: sourceID + statSuffixSixStarPity, Value: 0, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET},
-			{Name: sourceID + statSuffixFiveStarPity, Value: 0, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET},
+			{Name: key + statSuffixSixStarPity, Value: 0, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET},
+			{Name: key + statSuffixFiveStarPity, Value: 0, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET},
 		}
 	case rarity >= rarityFiveStar:
 		// Increment six-star pity, and reset five-star pity on a five-star pull.
 		statUpdates = []*hiro.StatUpdate{
-			{Name: sourceID + statSuffixSixStarPity, Value: 1, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_DELTA},
-			{Name: sourceID + statSuffixFiveStarPity, Value: 0, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET},
+			{Name: key + statSuffixSixStarPity, Value: 1, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_DELTA},
+			{Name: key + statSuffixFiveStarPity, Value: 0, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET},
 		}
 	default:
 		// Increment both pity counters on a sub-five-star pull.
 		statUpdates = []*hiro.StatUpdate{
-			{Name: sourceID + statSuffixSixStarPity, Value: 1, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_DELTA},
-			{Name: sourceID + statSuffixFiveStarPity, Value: 1, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_DELTA},
+			{Name: key + statSuffixSixStarPity, Value: 1, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_DELTA},
+			{Name: key + statSuffixFiveStarPity, Value: 1, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_DELTA},
 		}
 	}
 
+	// Banner guarantees are saved in the same update.
+	statUpdates = append(statUpdates, extraUpdates...)
+
 	if _, err := statsSystem.Update(ctx, logger, nk, userID, nil, statUpdates); err != nil {
 		logger.Error("Failed to update pity stats for user %s: %v", userID, err)
 		return err
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	gachaHistoryCollection = "gacha_history"
+
+	// Nakama lists at most 100 storage objects at a time.
+	gachaHistoryMaxLimit     = 100
+	gachaHistoryDefaultLimit = 20
+)
+
+// GachaHistoryConfig controls the record kept of every gacha pull.
+type GachaHistoryConfig struct {
+	// RetentionDays is how long pull records are kept, or 0 to keep them forever.
+	RetentionDays int `json:"retention_days"`
+}
+
+func (c *GachaHistoryConfig) Validate() error {
+	if c.RetentionDays < 0 {
+		return errors.New("retention_days must not be negative")
+	}
+	return nil
+}
+
+// gachaPullRecord is the record of one pull, as the player rolled it. Duplicate records that the player was granted the
+// item's token instead.
+type gachaPullRecord struct {
+	TicketID           string  `json:"ticket_id"`
+	BannerID           string  `json:"banner_id,omitempty"`
+	ItemID             string  `json:"item_id"`
+	StarRarity         float64 `json:"star_rarity"`
+	SixStarPityBefore  int     `json:"six_star_pity_before"`
+	SixStarPityAfter   int     `json:"six_star_pity_after"`
+	FiveStarPityBefore int     `json:"five_star_pity_before"`
+	FiveStarPityAfter  int     `json:"five_star_pity_after"`
+	PityTriggered      bool    `json:"pity_triggered"`
+	Duplicate          bool    `json:"duplicate"`
+	CreateTimeSec      int64   `json:"create_time_sec"`
+}
+
+var gachaPullRecordColumns = []string{"ticket_id", "banner_id", "item_id", "star_rarity", "six_star_pity_before", "six_star_pity_after", "five_star_pity_before", "five_star_pity_after", "pity_triggered", "duplicate", "create_time_sec"}
+
+func (r *gachaPullRecord) csvRow() []string {
+	return []string{
+		r.TicketID,
+		r.BannerID,
+		r.ItemID,
+		strconv.FormatFloat(r.StarRarity, 'f', -1, 64),
+		strconv.Itoa(r.SixStarPityBefore),
+		strconv.Itoa(r.SixStarPityAfter),
+		strconv.Itoa(r.FiveStarPityBefore),
+		strconv.Itoa(r.FiveStarPityAfter),
+		strconv.FormatBool(r.PityTriggered),
+		strconv.FormatBool(r.Duplicate),
+		strconv.FormatInt(r.CreateTimeSec, 10),
+	}
+}
+
+// newPullRecord records the pull that rolled the reward from the given pity counters.
+func newPullRecord(
+	config *hiro.InventoryConfig,
+	ticketID, bannerID string,
+	reward *hiro.Reward,
+	sixStarPity, fiveStarPity int,
+	pityTriggered bool,
+	now time.Time,
+) *gachaPullRecord {
+	itemID := firstRewardItemID(reward)
+	rarity := getItemRarity(config, itemID)
+	sixStarPityAfter, fiveStarPityAfter := nextPity(rarity, sixStarPity, fiveStarPity)
+	return &gachaPullRecord{
+		TicketID:           ticketID,
+		BannerID:           bannerID,
+		ItemID:             itemID,
+		StarRarity:         rarity,
+		SixStarPityBefore:  sixStarPity,
+		SixStarPityAfter:   sixStarPityAfter,
+		FiveStarPityBefore: fiveStarPity,
+		FiveStarPityAfter:  fiveStarPityAfter,
+		PityTriggered:      pityTriggered,
+		CreateTimeSec:      now.Unix(),
+	}
+}
+
+// write saves pull records to the player's history, then deletes their records older than the retention. Keys are
+// the time written, so the history lists oldest first and expired records are always at its start.
+//
+// Pulls are recorded from the consume reward hook, which runs before Hiro saves the consumed tickets and granted
+// rewards. A write that fails there fails the consume, but a consume that fails after the hook has run leaves records,
+// like the pity stats saved alongside them, for pulls the player was never granted.
+func (c *GachaHistoryConfig) write(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID string, records []*gachaPullRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	writes := make([]*runtime.StorageWrite, 0, len(records))
+	for i, record := range records {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		writes = append(writes, &runtime.StorageWrite{
+			Collection:      gachaHistoryCollection,
+			Key:             fmt.Sprintf("%019d_%03d", now.UnixNano(), i),
+			UserID:          userID,
+			Value:           string(value),
+			PermissionRead:  1,
+			PermissionWrite: 0,
+		})
+	}
+	if _, err := nk.StorageWrite(ctx, writes); err != nil {
+		logger.Error("Failed to write gacha history for user %s: %v", userID, err)
+		return err
+	}
+
+	if c.RetentionDays == 0 {
+		return nil
+	}
+
+	// Prune at most one page per write, so a long-expired history is cleared over the next few pulls. The pull is
+	// recorded already, so failing to prune is only logged.
+	cutoff := now.AddDate(0, 0, -c.RetentionDays).Unix()
+	objects, _, err := nk.StorageList(ctx, "", userID, gachaHistoryCollection, gachaHistoryMaxLimit, "")
+	if err != nil {
+		logger.Error("Failed to list gacha history for user %s: %v", userID, err)
+		return nil
+	}
+	var deletes []*runtime.StorageDelete
+	for _, object := range objects {
+		if object.GetCreateTime().GetSeconds() >= cutoff {
+			break
+		}
+		deletes = append(deletes, &runtime.StorageDelete{Collection: gachaHistoryCollection, Key: object.GetKey(), UserID: userID})
+	}
+	if len(deletes) > 0 {
+		if err := nk.StorageDelete(ctx, deletes); err != nil {
+			logger.Error("Failed to prune gacha history for user %s: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// list returns one page of the player's pull records, oldest first, and the cursor of the next page.
+func (c *GachaHistoryConfig) list(ctx context.Context, nk runtime.NakamaModule, userID string, limit int, cursor string) ([]*gachaPullRecord, string, error) {
+	objects, cursor, err := nk.StorageList(ctx, "", userID, gachaHistoryCollection, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Records past the retention are hidden until they're pruned.
+	var cutoff int64
+	if c.RetentionDays > 0 {
+		cutoff = time.Now().AddDate(0, 0, -c.RetentionDays).Unix()
+	}
+	records := make([]*gachaPullRecord, 0, len(objects))
+	for _, object := range objects {
+		record := &gachaPullRecord{}
+		if err := json.Unmarshal([]byte(object.GetValue()), record); err != nil {
+			return nil, "", err
+		}
+		if record.CreateTimeSec >= cutoff {
+			records = append(records, record)
+		}
+	}
+	return records, cursor, nil
+}
+
+type historyListRequest struct {
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+type historyListResponse struct {
+	Records []*gachaPullRecord `json:"records"`
+	Cursor  string             `json:"cursor,omitempty"`
+}
+
+type historyExportRequest struct {
+	UserID string `json:"user_id"`
+	// Format is "csv" or "ndjson".
+	Format string `json:"format"`
+}
+
+// rpcGachaHistoryList returns a page of the player's own pull history, oldest first.
+func rpcGachaHistoryList(history *GachaHistoryConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		req := historyListRequest{Limit: gachaHistoryDefaultLimit}
+		if payload != "" {
+			if err := json.Unmarshal([]byte(payload), &req); err != nil {
+				return "", runtime.NewError("invalid request", 3)
+			}
+		}
+		if req.Limit < 1 || req.Limit > gachaHistoryMaxLimit {
+			return "", runtime.NewError("limit must be between 1 and 100", 3)
+		}
+
+		records, cursor, err := history.list(ctx, nk, userID, req.Limit, req.Cursor)
+		if err != nil {
+			logger.Error("Failed to list gacha history for user %s: %v", userID, err)
+			return "", err
+		}
+
+		response, err := json.Marshal(&historyListResponse{Records: records, Cursor: cursor})
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+// rpcGachaHistoryExport returns a player's whole pull history as CSV, with a header row, or as NDJSON. It can only be
+// called server to server, e.g. by a support tool.
+func rpcGachaHistoryExport(history *GachaHistoryConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		if _, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string); ok {
+			return "", runtime.NewError("gacha history can only be exported server to server", 7)
+		}
+
+		var req historyExportRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request", 3)
+		}
+		if req.UserID == "" {
+			return "", runtime.NewError("user_id is required", 3)
+		}
+		if req.Format != "csv" && req.Format != "ndjson" {
+			return "", runtime.NewError(`format must be "csv" or "ndjson"`, 3)
+		}
+
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		if req.Format == "csv" {
+			_ = w.Write(gachaPullRecordColumns)
+		}
+		cursor := ""
+		for {
+			records, next, err := history.list(ctx, nk, req.UserID, gachaHistoryMaxLimit, cursor)
+			if err != nil {
+				logger.Error("Failed to list gacha history for user %s: %v", req.UserID, err)
+				return "", err
+			}
+			for _, record := range records {
+				if req.Format == "csv" {
+					_ = w.Write(record.csvRow())
+					continue
+				}
+				line, err := json.Marshal(record)
+				if err != nil {
+					return "", err
+				}
+				buf.Write(line)
+				buf.WriteByte('\n')
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+}
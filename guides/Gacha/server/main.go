@@ -62,6 +62,18 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
 		return err
 	}
 
+	// Definitions uploaded by a server are previewed as a diff, then applied over the files above without a restart.
+	reloadConfig := &DefinitionsReloadConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/definitions-reload.json", env), reloadConfig); err != nil {
+		return err
+	}
+	if err := reloadConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid definitions reload: %w", err)
+	}
+	if err := reloadConfig.Register(logger, initializer, systems); err != nil {
+		return err
+	}
+
 	// Make sure that users can't update their stats directly to prevent cheating.
 	if err = hiro.UnregisterRpc(initializer,
 		hiro.RpcId_RPC_ID_STATS_UPDATE,
@@ -69,18 +81,69 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
 		return err
 	}
 
+	// Limited-time banners put featured items up on a gacha ticket, with a 50/50 and carry-over guarantee.
+	inventoryConfig, ok := systems.GetInventorySystem().GetConfig().(*hiro.InventoryConfig)
+	if !ok {
+		return errors.New("unexpected inventory system config type")
+	}
+	bannersConfig := &GachaBannersConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/gacha-banners.json", env), bannersConfig); err != nil {
+		return err
+	}
+	if err := bannersConfig.Validate(inventoryConfig); err != nil {
+		return fmt.Errorf("invalid gacha banners: %w", err)
+	}
+
+	// Tickets with a pity_group share pity, carried over or reset across banners by the group's rules.
+	pityGroupsConfig := &GachaPityGroupsConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/gacha-pity-groups.json", env), pityGroupsConfig); err != nil {
+		return err
+	}
+	if err := pityGroupsConfig.Validate(inventoryConfig); err != nil {
+		return fmt.Errorf("invalid gacha pity groups: %w", err)
+	}
+
+	if err := initializer.RegisterRpc("rpc_gacha_banners_list", rpcGachaBannersList(bannersConfig, pityGroupsConfig, systems.GetInventorySystem(), systems.GetStatsSystem())); err != nil {
+		return err
+	}
+
+	// Disclose each gacha ticket's drop rates, with and without pity, from the player's personalised config.
+	if err := initializer.RegisterRpc("rpc_gacha_odds", rpcGachaOdds(systems.GetInventorySystem(), bannersConfig)); err != nil {
+		return err
+	}
+
+	// Every pull is recorded in the player's gacha history, kept for the configured retention.
+	historyConfig := &GachaHistoryConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/gacha-history.json", env), historyConfig); err != nil {
+		return err
+	}
+	if err := historyConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid gacha history: %w", err)
+	}
+	if err := initializer.RegisterRpc("rpc_gacha_history_list", rpcGachaHistoryList(historyConfig)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_gacha_history_export", rpcGachaHistoryExport(historyConfig)); err != nil {
+		return err
+	}
+
 	// Run our custom log when an inventory item is consumed. (i.e. "pulling" a gacha ticket)
 	systems.GetInventorySystem().SetOnConsumeReward(OnConsumeReward(
-		systems.GetEconomySystem(), systems.GetInventorySystem(), systems.GetStatsSystem()))
+		systems.GetEconomySystem(), systems.GetInventorySystem(), systems.GetStatsSystem(), bannersConfig, pityGroupsConfig, historyConfig))
+
+	// Pull several gacha tickets at once, with a rarity guarantee per batch.
+	if err := initializer.RegisterRpc("rpc_gacha_multi_pull", rpcGachaMultiPull(systems.GetInventorySystem(), systems.GetStatsSystem(), bannersConfig, pityGroupsConfig)); err != nil {
+		return err
+	}
 
 	logger.Info("Module loaded in %dms", time.Since(initStart).Milliseconds())
 
 	return nil
 }
 
-func OnConsumeReward(economySystem hiro.EconomySystem, inventorySystem hiro.InventorySystem, statsSystem hiro.StatsSystem) func(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID, sourceID string, source *hiro.InventoryConfigItem, rewardConfig *hiro.EconomyConfigReward, reward *hiro.Reward) (*hiro.Reward, error) {
+func OnConsumeReward(economySystem hiro.EconomySystem, inventorySystem hiro.InventorySystem, statsSystem hiro.StatsSystem, banners *GachaBannersConfig, pityGroups *GachaPityGroupsConfig, history *GachaHistoryConfig) func(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID, sourceID string, source *hiro.InventoryConfigItem, rewardConfig *hiro.EconomyConfigReward, reward *hiro.Reward) (*hiro.Reward, error) {
 	return func(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID, sourceID string, source *hiro.InventoryConfigItem, rewardConfig *hiro.EconomyConfigReward, reward *hiro.Reward) (*hiro.Reward, error) {
 		// Gacha logic is separated into gacha.go
-		return handleGachaConsumeReward(ctx, logger, nk, economySystem, inventorySystem, statsSystem, userID, sourceID, source, reward)
+		return handleGachaConsumeReward(ctx, logger, nk, economySystem, inventorySystem, statsSystem, banners, pityGroups, history, userID, sourceID, source, reward)
 	}
 }
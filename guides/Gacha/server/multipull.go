@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"maps"
+	"sort"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// propMultiPullGuarantee on a gacha ticket guarantees at least one five-star or better in every run of that many
+	// pulls of a multi-pull, e.g. 10 for one per ten-pull.
+	propMultiPullGuarantee = "multi_pull_guarantee"
+
+	multiPullMaxCount = 100
+)
+
+type multiPullRequest struct {
+	TicketID string `json:"ticket_id"`
+	Count    int    `json:"count"`
+}
+
+type multiPullResponse struct {
+	Pulls []*gachaPull `json:"pulls"`
+}
+
+// gachaPull is the result of one pull of a multi-pull.
+type gachaPull struct {
+	ItemID     string  `json:"item_id"`
+	StarRarity float64 `json:"star_rarity"`
+	// Duplicate is true if the player already had the item, so they were granted its token instead.
+	Duplicate bool `json:"duplicate"`
+}
+
+type gachaBatchKey struct{}
+
+// gachaBatch carries a multi-pull through the consume reward hook, which Hiro runs once for each ticket consumed. The
+// pity counters and owned items are read once before the first pull and advanced in memory after each one, and the last
+// pull saves them.
+type gachaBatch struct {
+	ticketID  string
+	key       string
+	count     int
+	guarantee int
+
+	// banner is the banner running on the ticket when the multi-pull started, if any, and now is when it started.
+	bannerID string
+	banner   *GachaBanner
+	now      time.Time
+
+	// The initial pity and guarantees are the stats as read before the first pull, which the saved updates are
+	// relative to.
+	initialSixStarPity  int
+	initialFiveStarPity int
+	initialGuarantees   map[string]int64
+
+	sixStarPity    int
+	fiveStarPity   int
+	guarantees     map[string]int64
+	owned          map[string]bool
+	runHasFiveStar bool
+	pulls          []*gachaPull
+	records        []*gachaPullRecord
+}
+
+func (b *gachaBatch) pull(
+	ctx context.Context,
+	logger runtime.Logger,
+	nk runtime.NakamaModule,
+	economySystem hiro.EconomySystem,
+	config *hiro.InventoryConfig,
+	userID, sourceID string,
+	source *hiro.InventoryConfigItem,
+	reward *hiro.Reward,
+) (*hiro.Reward, error) {
+	// The last pull of each run is forced to five-star pity if the run has no five-star yet.
+	index := len(b.pulls)
+	forceFiveStar := false
+	if b.guarantee > 0 {
+		if index%b.guarantee == 0 {
+			b.runHasFiveStar = false
+		}
+		forceFiveStar = index%b.guarantee == b.guarantee-1 && !b.runHasFiveStar
+	}
+
+	sixStarPity, fiveStarPity := b.sixStarPity, b.fiveStarPity
+	reward, err := rollWithPity(ctx, logger, nk, economySystem, config, userID, sourceID, source, reward, sixStarPity, fiveStarPity, forceFiveStar)
+	if err != nil {
+		return nil, err
+	}
+
+	itemID := firstRewardItemID(reward)
+	pull := &gachaPull{ItemID: itemID}
+	b.pulls = append(b.pulls, pull)
+	if itemID == "" {
+		return reward, nil
+	}
+
+	pull.StarRarity = getItemRarity(config, itemID)
+	b.sixStarPity, b.fiveStarPity = nextPity(pull.StarRarity, b.sixStarPity, b.fiveStarPity)
+	if pull.StarRarity >= rarityFiveStar {
+		b.runHasFiveStar = true
+	}
+
+	if b.banner != nil {
+		statName := guaranteedStat(pityKey(source, sourceID), pull.StarRarity)
+		if featured, guaranteed := b.banner.apply(config, sourceID, reward, b.guarantees[statName] > 0); featured != nil {
+			b.guarantees[statName] = boolStat(guaranteed)
+		}
+		itemID = firstRewardItemID(reward)
+		pull.ItemID = itemID
+	}
+	record := newPullRecord(config, sourceID, b.bannerID, reward, sixStarPity, fiveStarPity, pityDue(source, sixStarPity, fiveStarPity, forceFiveStar) != 0, b.now)
+	b.records = append(b.records, record)
+
+	// Items pulled earlier in the batch count as owned, so a second copy becomes a token too.
+	if b.owned[itemID] {
+		reward.Items = map[string]int64{
+			itemID + tokenSuffix: 1,
+		}
+		pull.Duplicate = true
+		record.Duplicate = true
+	}
+	b.owned[itemID] = true
+
+	return reward, nil
+}
+
+// save writes the pity counters and guarantees of the whole batch, then its pull records. The stats are deltas from the
+// ones read before the first pull, so stat updates made elsewhere while the batch ran are added to rather than
+// overwritten.
+func (b *gachaBatch) save(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, statsSystem hiro.StatsSystem, history *GachaHistoryConfig, userID string) error {
+	deltas := map[string]int64{
+		b.key + statSuffixSixStarPity:  int64(b.sixStarPity - b.initialSixStarPity),
+		b.key + statSuffixFiveStarPity: int64(b.fiveStarPity - b.initialFiveStarPity),
+	}
+	for statName, value := range b.guarantees {
+		deltas[statName] = value - b.initialGuarantees[statName]
+	}
+
+	var statUpdates []*hiro.StatUpdate
+	for _, statName := range sortedStatNames(deltas) {
+		if deltas[statName] != 0 {
+			statUpdates = append(statUpdates, &hiro.StatUpdate{Name: statName, Value: deltas[statName], Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_DELTA})
+		}
+	}
+	if len(statUpdates) > 0 {
+		if _, err := statsSystem.Update(ctx, logger, nk, userID, nil, statUpdates); err != nil {
+			logger.Error("Failed to update pity stats for user %s: %v", userID, err)
+			return err
+		}
+	}
+	return history.write(ctx, logger, nk, userID, b.records)
+}
+
+// rpcGachaMultiPull consumes several gacha tickets of one type in a single operation. Pity applies to each pull in
+// turn, exactly as if the tickets were consumed one at a time, and the pity stats and history are saved once by the last
+// pull. If the player doesn't have enough tickets, or the pity stats or history can't be saved, nothing is consumed.
+func rpcGachaMultiPull(inventorySystem hiro.InventorySystem, statsSystem hiro.StatsSystem, banners *GachaBannersConfig, pityGroups *GachaPityGroupsConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		var req multiPullRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			return "", runtime.NewError("invalid request", 3)
+		}
+		if req.Count < 1 || req.Count > multiPullMaxCount {
+			return "", runtime.NewError("count must be between 1 and 100", 3)
+		}
+
+		config, ok := inventorySystem.GetConfig().(*hiro.InventoryConfig)
+		if !ok {
+			return "", errors.New("unexpected inventory system config type")
+		}
+		ticket, found := config.Items[req.TicketID]
+		if !found || ticket.Category != categoryGachaTicket {
+			return "", runtime.NewError("unknown gacha ticket", 3)
+		}
+
+		// Load the inventory once, to check the ticket count and to find duplicates.
+		inventory, err := inventorySystem.ListInventoryItems(ctx, logger, nk, userID, "")
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("inventorySystem.ListInventoryItems error")
+			return "", err
+		}
+		owned := make(map[string]bool, len(inventory.GetItems()))
+		var tickets int64
+		for _, item := range inventory.GetItems() {
+			owned[item.GetId()] = true
+			if item.GetId() == req.TicketID {
+				tickets += item.GetCount()
+			}
+		}
+		if tickets < int64(req.Count) {
+			return "", runtime.NewError("not enough gacha tickets", 9)
+		}
+
+		statList, err := statsSystem.List(ctx, logger, nk, userID, []string{userID})
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("statsSystem.List error")
+			return "", err
+		}
+		key := pityKey(ticket, req.TicketID)
+		if statList, err = pityGroups.preparePity(ctx, logger, nk, statsSystem, config, banners, statList, userID, ticket); err != nil {
+			return "", err
+		}
+
+		batch := &gachaBatch{
+			ticketID:     req.TicketID,
+			key:          key,
+			count:        req.Count,
+			guarantee:    int(ticket.NumericProperties[propMultiPullGuarantee]),
+			sixStarPity:  getPityStat(statList, userID, key+statSuffixSixStarPity),
+			fiveStarPity: getPityStat(statList, userID, key+statSuffixFiveStarPity),
+			owned:        owned,
+			guarantees:   make(map[string]int64),
+			now:          time.Now(),
+		}
+		if batch.bannerID, batch.banner = banners.Active(req.TicketID, batch.now); batch.banner != nil {
+			for _, featured := range batch.banner.Featured {
+				statName := guaranteedStat(key, featured.StarRarity)
+				batch.guarantees[statName] = int64(getPityStat(statList, userID, statName))
+			}
+		}
+		batch.initialSixStarPity, batch.initialFiveStarPity = batch.sixStarPity, batch.fiveStarPity
+		batch.initialGuarantees = maps.Clone(batch.guarantees)
+
+		// Hiro deducts all the tickets or none, and runs the consume reward hook for each one.
+		if _, _, _, err := inventorySystem.ConsumeItems(context.WithValue(ctx, gachaBatchKey{}, batch), logger, nk, userID, map[string]int64{req.TicketID: int64(req.Count)}, nil, false); err != nil {
+			logger.WithField("error", err.Error()).Error("inventorySystem.ConsumeItems error")
+			return "", err
+		}
+
+		response, err := json.Marshal(&multiPullResponse{Pulls: batch.pulls})
+		if err != nil {
+			return "", err
+		}
+		return string(response), nil
+	}
+}
+
+func sortedStatNames(stats map[string]int64) []string {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
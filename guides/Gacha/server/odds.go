@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// oddsMaxPulls bounds the pity cycle for a ticket without six-star pity, once less than oddsEpsilon of it is left.
+const (
+	oddsMaxPulls = 10000
+	oddsEpsilon  = 1e-12
+)
+
+type oddsResponse struct {
+	Tickets []*ticketOdds `json:"tickets"`
+}
+
+// ticketOdds discloses the odds of one gacha ticket. Base is a single pull with no pity. Consolidated is the long-run
+// share of all pulls once pity, and the 50/50 guarantee of any banner running, are taken into account.
+type ticketOdds struct {
+	TicketID     string           `json:"ticket_id"`
+	Name         string           `json:"name"`
+	BannerID     string           `json:"banner_id,omitempty"`
+	Base         *odds            `json:"base"`
+	Consolidated *odds            `json:"consolidated"`
+	Guarantees   []*oddsGuarantee `json:"guarantees"`
+}
+
+type odds struct {
+	Rarities []*rarityOdds `json:"rarities"`
+	Items    []*itemOdds   `json:"items"`
+}
+
+type rarityOdds struct {
+	StarRarity  float64 `json:"star_rarity"`
+	Probability float64 `json:"probability"`
+}
+
+type itemOdds struct {
+	ItemID      string  `json:"item_id"`
+	Name        string  `json:"name"`
+	StarRarity  float64 `json:"star_rarity"`
+	Probability float64 `json:"probability"`
+}
+
+// oddsGuarantee is a hard guarantee: a pull of at least StarRarity within WithinPulls pulls.
+type oddsGuarantee struct {
+	Description string  `json:"description"`
+	StarRarity  float64 `json:"star_rarity,omitempty"`
+	WithinPulls int     `json:"within_pulls,omitempty"`
+}
+
+// rewardItemOdds returns the probability of each item from one roll of a weighted reward, where each item set in the
+// rolled contents grants one of the items in all of its sets, uniformly.
+func rewardItemOdds(itemSets map[string][]string, reward *hiro.EconomyConfigReward) map[string]float64 {
+	probabilities := make(map[string]float64)
+	if reward == nil {
+		return probabilities
+	}
+
+	var totalWeight int64
+	for _, contents := range reward.Weighted {
+		totalWeight += contents.Weight
+	}
+	if totalWeight <= 0 {
+		return probabilities
+	}
+
+	for _, contents := range reward.Weighted {
+		p := float64(contents.Weight) / float64(totalWeight)
+		for itemID := range contents.Items {
+			probabilities[itemID] += p
+		}
+		for _, set := range contents.ItemSets {
+			items := itemSetsIntersection(itemSets, set.Set)
+			for _, itemID := range items {
+				probabilities[itemID] += p / float64(len(items))
+			}
+		}
+	}
+	return probabilities
+}
+
+func itemSetsIntersection(itemSets map[string][]string, sets []string) []string {
+	if len(sets) == 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, set := range sets {
+		for _, itemID := range itemSets[set] {
+			counts[itemID]++
+		}
+	}
+	var items []string
+	for itemID, count := range counts {
+		if count == len(sets) {
+			items = append(items, itemID)
+		}
+	}
+	sort.Strings(items)
+	return items
+}
+
+// pityItemOdds returns the odds of a pull on which pity is due. As in rollPityReward, a natural roll of at least
+// minRarity is kept, and only the rest are replaced by the pity roll.
+func pityItemOdds(config *hiro.InventoryConfig, natural, pity map[string]float64, minRarity float64) map[string]float64 {
+	probabilities := make(map[string]float64, len(natural)+len(pity))
+	var rerolled float64
+	for itemID, p := range natural {
+		if getItemRarity(config, itemID) >= minRarity {
+			probabilities[itemID] += p
+		} else {
+			rerolled += p
+		}
+	}
+	for itemID, p := range pity {
+		probabilities[itemID] += rerolled * p
+	}
+	return probabilities
+}
+
+// consolidatedItemOdds returns the long-run probability of each item per pull, with pity. Six-star pity resets both
+// counters, so the pulls split into cycles that each end on a six-star. The share of each item is its expected count
+// per cycle over the expected cycle length, found by following the distribution of the five-star counter through one
+// cycle.
+func consolidatedItemOdds(config *hiro.InventoryConfig, itemSets map[string][]string, sourceID string, source *hiro.InventoryConfigItem) map[string]float64 {
+	natural := rewardItemOdds(itemSets, source.ConsumeReward)
+	rolls := map[float64]map[string]float64{
+		0:              natural,
+		rarityFiveStar: pityItemOdds(config, natural, rewardItemOdds(itemSets, buildPityRewardConfig(sourceID, pityWeightFiveStar, pityWeightSixStar)), rarityFiveStar),
+		raritySixStar:  pityItemOdds(config, natural, rewardItemOdds(itemSets, buildPityRewardConfig(sourceID, 0, pityWeightGuaranteedSixStar)), raritySixStar),
+	}
+
+	// Without five-star pity, the five-star counter doesn't matter and is left at 0.
+	fiveStarStates := 1
+	if maxFiveStarPity, found := source.NumericProperties[propFiveStarPity]; found && maxFiveStarPity > 0 {
+		fiveStarStates = int(maxFiveStarPity)
+	}
+
+	counts := make(map[string]float64)
+	var cycleLength float64
+	mass := make([]float64, fiveStarStates)
+	mass[0] = 1
+	for sixStarPity := 0; sixStarPity < oddsMaxPulls; sixStarPity++ {
+		next := make([]float64, fiveStarStates)
+		var remaining float64
+		for fiveStarPity, p := range mass {
+			if p == 0 {
+				continue
+			}
+			cycleLength += p
+			for itemID, q := range rolls[pityDue(source, sixStarPity, fiveStarPity, false)] {
+				counts[itemID] += p * q
+				switch rarity := getItemRarity(config, itemID); {
+				case rarity >= raritySixStar:
+				case rarity >= rarityFiveStar:
+					next[0] += p * q
+					remaining += p * q
+				default:
+					next[min(fiveStarPity+1, fiveStarStates-1)] += p * q
+					remaining += p * q
+				}
+			}
+		}
+		mass = next
+		if remaining < oddsEpsilon {
+			break
+		}
+	}
+
+	probabilities := make(map[string]float64, len(counts))
+	for itemID, count := range counts {
+		probabilities[itemID] = count / cycleLength
+	}
+	return probabilities
+}
+
+// applyBannerOdds splits the odds of each featured rarity between the banner's featured and standard items. With
+// guaranteed, the featured share is the long run with the 50/50 guarantee: after a lost 50/50 the next pull at that
+// rarity is featured, so a share of (1-rate)/(2-rate) of those pulls are guaranteed, and 1/(2-rate) are featured.
+func applyBannerOdds(config *hiro.InventoryConfig, probabilities map[string]float64, banner *GachaBanner, guaranteed bool) {
+	for _, featured := range banner.Featured {
+		// A won 50/50 may grant a featured item outside the ticket's item sets, so every featured item gets a share.
+		var total float64
+		var standardItems []string
+		for itemID, p := range probabilities {
+			if getItemRarity(config, itemID) != featured.StarRarity {
+				continue
+			}
+			total += p
+			if !slices.Contains(featured.Items, itemID) {
+				standardItems = append(standardItems, itemID)
+			}
+		}
+
+		// A lost 50/50 with no standard items to fall back on keeps the featured item.
+		share := featured.Rate
+		switch {
+		case len(standardItems) == 0:
+			share = 1
+		case guaranteed && featured.Guarantee:
+			share = 1 / (2 - featured.Rate)
+		}
+		for _, itemID := range featured.Items {
+			probabilities[itemID] = total * share / float64(len(featured.Items))
+		}
+		for _, itemID := range standardItems {
+			probabilities[itemID] = total * (1 - share) / float64(len(standardItems))
+		}
+	}
+}
+
+func newOdds(config *hiro.InventoryConfig, probabilities map[string]float64) *odds {
+	result := &odds{Rarities: make([]*rarityOdds, 0), Items: make([]*itemOdds, 0, len(probabilities))}
+	rarities := make(map[float64]float64)
+	for itemID, p := range probabilities {
+		rarity := getItemRarity(config, itemID)
+		rarities[rarity] += p
+		result.Items = append(result.Items, &itemOdds{ItemID: itemID, Name: itemName(config, itemID), StarRarity: rarity, Probability: p})
+	}
+	for rarity, p := range rarities {
+		result.Rarities = append(result.Rarities, &rarityOdds{StarRarity: rarity, Probability: p})
+	}
+	sort.Slice(result.Rarities, func(i, j int) bool {
+		return result.Rarities[i].StarRarity > result.Rarities[j].StarRarity
+	})
+	sort.Slice(result.Items, func(i, j int) bool {
+		if result.Items[i].StarRarity != result.Items[j].StarRarity {
+			return result.Items[i].StarRarity > result.Items[j].StarRarity
+		}
+		return result.Items[i].ItemID < result.Items[j].ItemID
+	})
+	return result
+}
+
+func itemName(config *hiro.InventoryConfig, itemID string) string {
+	if item, found := config.Items[itemID]; found {
+		return item.Name
+	}
+	return ""
+}
+
+func ticketGuarantees(source *hiro.InventoryConfigItem, banner *GachaBanner) []*oddsGuarantee {
+	guarantees := make([]*oddsGuarantee, 0)
+	if maxSixStarPity, found := source.NumericProperties[propSixStarPity]; found {
+		guarantees = append(guarantees, &oddsGuarantee{
+			Description: fmt.Sprintf("A six-star within every %d pulls.", int(maxSixStarPity)),
+			StarRarity:  raritySixStar,
+			WithinPulls: int(maxSixStarPity),
+		})
+	}
+	if maxFiveStarPity, found := source.NumericProperties[propFiveStarPity]; found {
+		guarantees = append(guarantees, &oddsGuarantee{
+			Description: fmt.Sprintf("A five-star or better within every %d pulls.", int(maxFiveStarPity)),
+			StarRarity:  rarityFiveStar,
+			WithinPulls: int(maxFiveStarPity),
+		})
+	}
+	if guarantee, found := source.NumericProperties[propMultiPullGuarantee]; found {
+		guarantees = append(guarantees, &oddsGuarantee{
+			Description: fmt.Sprintf("A five-star or better in every %d pulls of a multi-pull.", int(guarantee)),
+			StarRarity:  rarityFiveStar,
+			WithinPulls: int(guarantee),
+		})
+	}
+	if banner != nil {
+		for _, featured := range banner.Featured {
+			if featured.Guarantee {
+				guarantees = append(guarantees, &oddsGuarantee{
+					Description: fmt.Sprintf("After a %v-star that isn't featured, the next %v-star is featured.", featured.StarRarity, featured.StarRarity),
+					StarRarity:  featured.StarRarity,
+				})
+			}
+		}
+	}
+	return guarantees
+}
+
+// rpcGachaOdds discloses the drop rates of every gacha ticket, computed from the player's personalised inventory
+// config, so any overrides from a personalizer such as Satori are reflected.
+func rpcGachaOdds(inventorySystem hiro.InventorySystem, banners *GachaBannersConfig) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errors.New("no user ID in context")
+		}
+
+		items, itemSets, err := inventorySystem.List(ctx, logger, nk, userID, "")
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("inventorySystem.List error")
+			return "", err
+		}
+		config := &hiro.InventoryConfig{Items: items}
+
+		now := time.Now()
+		response := &oddsResponse{Tickets: make([]*ticketOdds, 0)}
+		for _, ticketID := range sortedItemIDs(config) {
+			ticket := config.Items[ticketID]
+			if ticket.Category != categoryGachaTicket || ticket.Disabled {
+				continue
+			}
+
+			bannerID, banner := banners.Active(ticketID, now)
+			base := rewardItemOdds(itemSets, ticket.ConsumeReward)
+			consolidated := consolidatedItemOdds(config, itemSets, ticketID, ticket)
+			if banner != nil {
+				applyBannerOdds(config, base, banner, false)
+				applyBannerOdds(config, consolidated, banner, true)
+			}
+
+			response.Tickets = append(response.Tickets, &ticketOdds{
+				TicketID:     ticketID,
+				Name:         ticket.Name,
+				BannerID:     bannerID,
+				Base:         newOdds(config, base),
+				Consolidated: newOdds(config, consolidated),
+				Guarantees:   ticketGuarantees(ticket, banner),
+			})
+		}
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
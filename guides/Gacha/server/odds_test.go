@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// fakeRollEconomy rolls one weighted entry of a reward config, granting one item of its item sets, as Hiro does for
+// gacha tickets. Any other EconomySystem call panics.
+type fakeRollEconomy struct {
+	hiro.EconomySystem
+	rng      *rand.Rand
+	itemSets map[string][]string
+}
+
+func (e *fakeRollEconomy) RewardRoll(_ context.Context, _ runtime.Logger, _ runtime.NakamaModule, _ string, rewardConfig *hiro.EconomyConfigReward) (*hiro.Reward, error) {
+	var totalWeight int64
+	for _, contents := range rewardConfig.Weighted {
+		totalWeight += contents.Weight
+	}
+	n := e.rng.Int63n(totalWeight)
+	for _, contents := range rewardConfig.Weighted {
+		if n >= contents.Weight {
+			n -= contents.Weight
+			continue
+		}
+		items := itemSetsIntersection(e.itemSets, contents.ItemSets[0].Set)
+		return &hiro.Reward{Items: map[string]int64{items[e.rng.Intn(len(items))]: 1}}, nil
+	}
+	return &hiro.Reward{}, nil
+}
+
+func oddsTestItemSet(setID string, weight int64) *hiro.EconomyConfigRewardContents {
+	return &hiro.EconomyConfigRewardContents{
+		ItemSets: []*hiro.EconomyConfigRewardItemSet{{Set: []string{setID}, EconomyConfigRewardRangeInt64: hiro.EconomyConfigRewardRangeInt64{Min: 1}}},
+		Weight:   weight,
+	}
+}
+
+func TestConsolidatedItemOddsMatchesPulls(t *testing.T) {
+	const ticketID = "ticket"
+	config := &hiro.InventoryConfig{Items: map[string]*hiro.InventoryConfigItem{
+		ticketID: {
+			Category:          categoryGachaTicket,
+			NumericProperties: map[string]float64{propSixStarPity: 30, propFiveStarPity: 4},
+			ConsumeReward: &hiro.EconomyConfigReward{
+				MaxRolls: 1,
+				Weighted: []*hiro.EconomyConfigRewardContents{
+					oddsTestItemSet(ticketID+itemSetSuffixSixStar, 6),
+					oddsTestItemSet(ticketID+itemSetSuffixFiveStar, 4),
+					oddsTestItemSet(ticketID+"_four_star", 90),
+				},
+			},
+		},
+		"six_a":  {NumericProperties: map[string]float64{propStarRarity: 6}},
+		"six_b":  {NumericProperties: map[string]float64{propStarRarity: 6}},
+		"five_a": {NumericProperties: map[string]float64{propStarRarity: 5}},
+		"five_b": {NumericProperties: map[string]float64{propStarRarity: 5}},
+		"four_a": {NumericProperties: map[string]float64{propStarRarity: 4}},
+	}}
+	itemSets := map[string][]string{
+		ticketID + itemSetSuffixSixStar:  {"six_a", "six_b"},
+		ticketID + itemSetSuffixFiveStar: {"five_a", "five_b"},
+		ticketID + "_four_star":          {"four_a"},
+	}
+	ticket := config.Items[ticketID]
+
+	want := consolidatedItemOdds(config, itemSets, ticketID, ticket)
+
+	economy := &fakeRollEconomy{rng: rand.New(rand.NewSource(1)), itemSets: itemSets}
+	const pulls = 400000
+	counts := make(map[string]int)
+	var sixStarPity, fiveStarPity int
+	for i := 0; i < pulls; i++ {
+		reward, err := economy.RewardRoll(context.Background(), nil, nil, "", ticket.ConsumeReward)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reward, err = rollWithPity(context.Background(), nil, nil, economy, config, "", ticketID, ticket, reward, sixStarPity, fiveStarPity, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		itemID := firstRewardItemID(reward)
+		counts[itemID]++
+		sixStarPity, fiveStarPity = nextPity(getItemRarity(config, itemID), sixStarPity, fiveStarPity)
+	}
+
+	var total float64
+	for itemID, p := range want {
+		total += p
+		if got := float64(counts[itemID]) / pulls; math.Abs(got-p) > 0.003 {
+			t.Errorf("%s: simulated %.4f, consolidated odds %.4f", itemID, got, p)
+		}
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("consolidated odds sum to %v, want 1", total)
+	}
+	for itemID := range counts {
+		if _, found := want[itemID]; !found {
+			t.Errorf("%s was pulled but has no consolidated odds", itemID)
+		}
+	}
+}
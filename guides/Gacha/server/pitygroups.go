@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// propPityGroup on a gacha ticket puts it in a pity group. Every ticket in the group advances and resets the same
+	// pity counters and banner guarantees, instead of its own.
+	propPityGroup = "pity_group"
+
+	// statSuffixPityBanner is the start time of the latest banner running on a group's tickets when the player last
+	// pulled one, or 0 if none was.
+	statSuffixPityBanner = "_pity_banner"
+)
+
+// GachaPityGroupsConfig holds the rules of each pity group named by a ticket's pity_group.
+type GachaPityGroupsConfig struct {
+	Groups map[string]*GachaPityGroup `json:"groups"`
+}
+
+// GachaPityGroup decides what happens to a group's pity when its banners change. With CarryOver, pity and guarantees
+// carry over from one banner to the next. Without it, they reset whenever a new banner starts on the group's tickets or
+// the last of their banners ends.
+type GachaPityGroup struct {
+	CarryOver bool `json:"carry_over"`
+}
+
+func (c *GachaPityGroupsConfig) Validate(inventory *hiro.InventoryConfig) error {
+	var errs []error
+	for id := range c.Groups {
+		if _, found := inventory.Items[id]; found {
+			errs = append(errs, fmt.Errorf("pity group %q has the same ID as an item", id))
+		}
+	}
+
+	// Tickets in a group share counters, so they must also share the thresholds the counters are checked against.
+	thresholds := make(map[string]*hiro.InventoryConfigItem, len(c.Groups))
+	for _, ticketID := range sortedItemIDs(inventory) {
+		ticket := inventory.Items[ticketID]
+		group := ticket.StringProperties[propPityGroup]
+		if ticket.Category != categoryGachaTicket || group == "" {
+			continue
+		}
+		if _, found := c.Groups[group]; !found {
+			errs = append(errs, fmt.Errorf("ticket %q: unknown pity group %q", ticketID, group))
+			continue
+		}
+		first, found := thresholds[group]
+		if !found {
+			thresholds[group] = ticket
+			continue
+		}
+		for _, prop := range []string{propSixStarPity, propFiveStarPity} {
+			if ticket.NumericProperties[prop] != first.NumericProperties[prop] {
+				errs = append(errs, fmt.Errorf("ticket %q: %s differs from the other tickets in pity group %q", ticketID, prop, group))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// pityKey is the prefix of the stats holding a ticket's pity counters and banner guarantees: its pity group if it has
+// one, or else the ticket itself.
+func pityKey(source *hiro.InventoryConfigItem, sourceID string) string {
+	if group := source.StringProperties[propPityGroup]; group != "" {
+		return group
+	}
+	return sourceID
+}
+
+// pityStatSuffixes are the stats, after the pity key, that belong to a pity group.
+func pityStatSuffixes() []string {
+	suffixes := []string{statSuffixSixStarPity, statSuffixFiveStarPity}
+	for _, rarity := range []float64{rarityFiveStar, raritySixStar} {
+		suffixes = append(suffixes, featuredRarities[rarity].guaranteedStatSuffix)
+	}
+	return suffixes
+}
+
+// pendingUpdates returns the stat updates that bring the player's pity for the ticket's group up to date before a
+// pull, if any. The first time the player pulls a ticket in the group, the furthest progress of each counter on the
+// group's tickets moves into the group's counter. In a group without carry over, the counters then reset whenever the
+// group's banners change.
+func (c *GachaPityGroupsConfig) pendingUpdates(
+	config *hiro.InventoryConfig,
+	banners *GachaBannersConfig,
+	statList map[string]*hiro.StatList,
+	userID string,
+	source *hiro.InventoryConfigItem,
+	now time.Time,
+) []*hiro.StatUpdate {
+	group := source.StringProperties[propPityGroup]
+	rules, found := c.Groups[group]
+	if group == "" || !found {
+		return nil
+	}
+
+	var updates []*hiro.StatUpdate
+	values := make(map[string]int64)
+	if _, found := findStat(statList, userID, group+statSuffixSixStarPity); !found {
+		for _, suffix := range pityStatSuffixes() {
+			values[group+suffix] = 0
+		}
+		for _, ticketID := range sortedItemIDs(config) {
+			if config.Items[ticketID].StringProperties[propPityGroup] != group {
+				continue
+			}
+			for _, suffix := range pityStatSuffixes() {
+				if value, found := findStat(statList, userID, ticketID+suffix); found {
+					values[group+suffix] = max(values[group+suffix], value)
+					updates = append(updates, &hiro.StatUpdate{Name: ticketID + suffix, Value: 0, Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET})
+				}
+			}
+		}
+	}
+
+	if !rules.CarryOver {
+		var bannerStart int64
+		for _, ticketID := range sortedItemIDs(config) {
+			if config.Items[ticketID].StringProperties[propPityGroup] != group {
+				continue
+			}
+			if _, banner := banners.Active(ticketID, now); banner != nil {
+				bannerStart = max(bannerStart, banner.StartTimeSec)
+			}
+		}
+		lastStart, found := findStat(statList, userID, group+statSuffixPityBanner)
+		if found && lastStart != bannerStart {
+			for _, suffix := range pityStatSuffixes() {
+				values[group+suffix] = 0
+			}
+		}
+		if !found || lastStart != bannerStart {
+			values[group+statSuffixPityBanner] = bannerStart
+		}
+	}
+
+	for _, statName := range sortedStatNames(values) {
+		updates = append(updates, &hiro.StatUpdate{Name: statName, Value: values[statName], Operator: hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET})
+	}
+	return updates
+}
+
+// preparePity saves the pending updates to the player's pity for the ticket's group, and returns their stats as
+// updated.
+func (c *GachaPityGroupsConfig) preparePity(
+	ctx context.Context,
+	logger runtime.Logger,
+	nk runtime.NakamaModule,
+	statsSystem hiro.StatsSystem,
+	config *hiro.InventoryConfig,
+	banners *GachaBannersConfig,
+	statList map[string]*hiro.StatList,
+	userID string,
+	source *hiro.InventoryConfigItem,
+) (map[string]*hiro.StatList, error) {
+	updates := c.pendingUpdates(config, banners, statList, userID, source, time.Now())
+	if len(updates) == 0 {
+		return statList, nil
+	}
+
+	stats, err := statsSystem.Update(ctx, logger, nk, userID, nil, updates)
+	if err != nil {
+		logger.Error("Failed to update pity group stats for user %s: %v", userID, err)
+		return nil, err
+	}
+	return map[string]*hiro.StatList{userID: stats}, nil
+}
+
+// statValue is the value a stat will have once the pending updates are saved.
+func statValue(statList map[string]*hiro.StatList, userID string, pending []*hiro.StatUpdate, statName string) int64 {
+	for i := len(pending) - 1; i >= 0; i-- {
+		if pending[i].Name == statName {
+			return pending[i].Value
+		}
+	}
+	value, _ := findStat(statList, userID, statName)
+	return value
+}
+
+func sortedItemIDs(config *hiro.InventoryConfig) []string {
+	ids := make([]string, 0, len(config.Items))
+	for id := range config.Items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -2,8 +2,9 @@
 // in a Nakama server plugin to build an XP-based player progression system.
 //
 // Flow: a client calls rpc_grant_xp → a reward containing the XP currency is
-// rolled and granted via the Economy reward APIs → the publisher detects the
-// currencyGranted event and advances the player's level achievements.
+// rolled and granted via the Economy reward APIs → the rules publisher matches
+// the currencyGranted event against definitions/<env>/rules.json and advances the
+// player's level achievements (see rules.go).
 package main
 
 import (
@@ -29,15 +30,6 @@ type grantXPRequest struct {
 	Amount int64 `json:"amount"`
 }
 
-// XPLevelPublisher advances a player's level achievements in response to the
-// currencyGranted events Hiro emits when XP is granted.
-type XPLevelPublisher struct {
-	achievements hiro.AchievementsSystem
-}
-
-// Compile-time assertion to ensure that XPLevelPublisher implements hiro.Publisher.
-var _ hiro.Publisher = (*XPLevelPublisher)(nil)
-
 // InitModule is the Nakama plugin entry point. It runs once on server startup
 // and is responsible for initialising Hiro systems and registering all RPCs.
 func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, initializer runtime.Initializer) error {
@@ -91,10 +83,28 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
 		return err
 	}
 
-	// Register the XP level publisher. Hiro calls Send on every registered publisher
-	// when a system event occurs. XPLevelPublisher listens for currencyGranted events
-	// on the "xp" currency and advances the player's level achievements accordingly.
-	systems.AddPublisher(&XPLevelPublisher{achievements: systems.GetAchievementsSystem()})
+	// Definitions uploaded by a server are previewed as a diff, then applied over the
+	// files above without a restart. See reload.go for the admin RPCs.
+	reloadConfig := &DefinitionsReloadConfig{}
+	if err := loadDefinitions(nk, fmt.Sprintf("definitions/%s/definitions-reload.json", env), reloadConfig); err != nil {
+		return err
+	}
+	if err := reloadConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid definitions reload: %w", err)
+	}
+	if err := reloadConfig.Register(logger, initializer, systems); err != nil {
+		return err
+	}
+
+	// Register the rules publisher. Hiro calls Send on every registered publisher
+	// when a system event occurs. RulesPublisher matches each event against the rules
+	// in rules.json, e.g. currencyGranted events on the "xp" currency advance the
+	// player's level achievements.
+	rules, err := NewRulesPublisher(nk, systems, fmt.Sprintf("definitions/%s/rules.json", env))
+	if err != nil {
+		return err
+	}
+	systems.AddPublisher(rules)
 
 	if err := initializer.RegisterRpc("rpc_grant_xp", rpcGrantXP(systems)); err != nil {
 		return err
@@ -108,47 +118,25 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
 	return nil
 }
 
-// The Publisher interface in Hiro requires two methods: Send and Authenticate.
-// This publisher doesn't need to act on authentication, so it's a no-op.
-func (p *XPLevelPublisher) Authenticate(_ context.Context, _ runtime.Logger, _ runtime.NakamaModule, _ string, _ bool) {
-}
-
-// The publisher listens for currencyGranted event on the "xp" currency and advances
-// the player's level achievements by the actual granted amount.
-//
-// Because Hiro emits currencyGranted with the post-modifier value (reward
-// multipliers are applied inside batch.apply before the event is constructed),
-// no wallet snapshot is needed. The event Value is always the real delta.
-func (p *XPLevelPublisher) Send(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID string, events []*hiro.PublisherEvent) {
-	for _, event := range events {
-		if event.Name != "currencyGranted" || event.Metadata["currencyId"] != "xp" {
-			continue
-		}
-		xp, err := strconv.ParseInt(event.Value, 10, 64)
-		if err != nil || xp <= 0 {
-			continue
-		}
-		if err := advanceLevelsFromXP(ctx, logger, nk, p.achievements, userID, xp); err != nil {
-			logger.WithField("error", err.Error()).Error("advanceLevelsFromXP failed")
-		}
-	}
-}
-
-// Advances the player's level sub-achievements by xp points.
+// Advances the player's level sub-achievements in the achievementID group by xp points.
+// The "levels" rule action calls this for the currencyGranted events on the "xp"
+// currency. Because Hiro emits currencyGranted with the post-modifier value (reward
+// multipliers are applied inside batch.apply before the event is constructed), no
+// wallet snapshot is needed. The event Value is always the real delta.
 //
-// Levels are modelled as sub-achievements inside the "player_levels" group.
+// Levels are modelled as sub-achievements inside a group such as "player_levels".
 // Each sub-achievement has a max_count representing the XP required to complete
 // that level. XP is applied in order, capping each level at its max_count so
 // overflow carries into the next level.
-func advanceLevelsFromXP(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, achievements hiro.AchievementsSystem, userID string, xp int64) error {
+func advanceLevels(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, achievements hiro.AchievementsSystem, userID, achievementID string, xp int64) error {
 	achMap, _, err := achievements.GetAchievements(ctx, logger, nk, userID)
 	if err != nil {
 		return err
 	}
 
-	playerLevels, ok := achMap["player_levels"]
+	playerLevels, ok := achMap[achievementID]
 	if !ok {
-		return errors.New("player_levels achievement not found")
+		return fmt.Errorf("%s achievement not found", achievementID)
 	}
 
 	// Build a single batch of level updates to apply in one database call.
@@ -190,7 +178,7 @@ func advanceLevelsFromXP(ctx context.Context, logger runtime.Logger, nk runtime.
 }
 
 // rpcGrantXP grants XP to the calling player. Level progression is handled
-// automatically by the XPLevelPublisher, which intercepts the currencyGranted
+// automatically by the RulesPublisher, which intercepts the currencyGranted
 // event emitted by Economy.Grant.
 func rpcGrantXP(systems hiro.Hiro) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	return func(ctx context.Context, logger runtime.Logger, _ *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
@@ -270,9 +258,11 @@ func rpcResetData(systems hiro.Hiro) func(ctx context.Context, logger runtime.Lo
 			}
 		}
 
-		// Delete the reward modifier storage object so active boosters are cleared.
+		// Delete the reward modifier storage object so active boosters are cleared,
+		// and the rule caps so capped rules can fire again.
 		if err := nk.StorageDelete(ctx, []*runtime.StorageDelete{
 			{Collection: "economy", Key: "reward_modifiers", UserID: userID},
+			{Collection: rulesStorageCollection, Key: rulesStorageKeyCaps, UserID: userID},
 		}); err != nil {
 			return "", err
 		}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// The live definitions are stored where hiro.StoragePersonalizer reads them, one object per system.
+	definitionsLiveCollection = hiro.StoragePersonalizerCollectionDefault
+
+	// Every applied definition is kept as a numbered version, alongside one head object per system naming the live
+	// version.
+	definitionsVersionsCollection = "hiro_definitions_versions"
+)
+
+// DefinitionsReloadConfig changes Hiro definitions on a running server. An upload replaces the definitions file of one
+// system through a storage personalizer overlay, which is merged onto the file the way hiro.StoragePersonalizer merges
+// it: fields and map entries in the upload replace the file's, anything not mentioned is kept from the file.
+//
+// This file is copied unchanged into every sample server that reloads definitions. Each server is built from its own
+// folder, so they cannot share a package; keep the copies identical.
+type DefinitionsReloadConfig struct {
+	// Each node caches the live definitions for CacheSec, so an upload is live on every node within this time.
+	CacheSec int `json:"cache_sec"`
+	// MaxVersions applied definitions are kept per system to roll back to.
+	MaxVersions int `json:"max_versions"`
+}
+
+func (c *DefinitionsReloadConfig) Validate() error {
+	var errs []error
+	if c.CacheSec <= 0 {
+		errs = append(errs, errors.New("cache_sec must be positive"))
+	}
+	if c.MaxVersions <= 0 {
+		errs = append(errs, errors.New("max_versions must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// reloadableSystem is a system whose definitions can be uploaded, keyed by the storage key hiro.StoragePersonalizer
+// reads its overlay from.
+type reloadableSystem struct {
+	newConfig func() any
+	system    func(systems hiro.Hiro) hiro.System
+}
+
+var reloadableSystems = map[string]*reloadableSystem{
+	"achievements": {
+		newConfig: func() any { return &hiro.AchievementsConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetAchievementsSystem() },
+	},
+	"auctions": {
+		newConfig: func() any { return &hiro.AuctionsConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetAuctionsSystem() },
+	},
+	"base": {
+		newConfig: func() any { return &hiro.BaseSystemConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetBaseSystem() },
+	},
+	"challenges": {
+		newConfig: func() any { return &hiro.ChallengesConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetChallengesSystem() },
+	},
+	"economy": {
+		newConfig: func() any { return &hiro.EconomyConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetEconomySystem() },
+	},
+	"energy": {
+		newConfig: func() any { return &hiro.EnergyConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetEnergySystem() },
+	},
+	"event_leaderboards": {
+		newConfig: func() any { return &hiro.EventLeaderboardsConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetEventLeaderboardsSystem() },
+	},
+	"incentives": {
+		newConfig: func() any { return &hiro.IncentivesConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetIncentivesSystem() },
+	},
+	"inventory": {
+		newConfig: func() any { return &hiro.InventoryConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetInventorySystem() },
+	},
+	"leaderboards": {
+		newConfig: func() any { return &hiro.LeaderboardConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetLeaderboardsSystem() },
+	},
+	"progression": {
+		newConfig: func() any { return &hiro.ProgressionConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetProgressionSystem() },
+	},
+	"reward_mailbox": {
+		newConfig: func() any { return &hiro.RewardMailboxConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetRewardMailboxSystem() },
+	},
+	"stats": {
+		newConfig: func() any { return &hiro.StatsConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetStatsSystem() },
+	},
+	"streaks": {
+		newConfig: func() any { return &hiro.StreaksConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetStreaksSystem() },
+	},
+	"teams": {
+		newConfig: func() any { return &hiro.TeamsConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetTeamsSystem() },
+	},
+	"tutorials": {
+		newConfig: func() any { return &hiro.TutorialsConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetTutorialsSystem() },
+	},
+	"unlockables": {
+		newConfig: func() any { return &hiro.UnlockablesConfig{} },
+		system:    func(systems hiro.Hiro) hiro.System { return systems.GetUnlockablesSystem() },
+	},
+}
+
+// DefinitionsHead names the live version of a system's definitions. Version 0 is the definitions file with no upload.
+type DefinitionsHead struct {
+	Version  int64   `json:"version"`
+	Versions []int64 `json:"versions"`
+}
+
+// DefinitionsVersion is one applied upload. A rollback to the definitions file has no config.
+type DefinitionsVersion struct {
+	System        string          `json:"system"`
+	Version       int64           `json:"version"`
+	Note          string          `json:"note,omitempty"`
+	CreateTimeSec int64           `json:"create_time_sec"`
+	Config        json.RawMessage `json:"config,omitempty"`
+}
+
+// DefinitionsChange is one leaf value that differs between the live and the proposed definitions. Live or proposed is
+// missing when the value is added or removed.
+type DefinitionsChange struct {
+	Path     string          `json:"path"`
+	Live     json.RawMessage `json:"live,omitempty"`
+	Proposed json.RawMessage `json:"proposed,omitempty"`
+}
+
+type definitionsRequest struct {
+	System string          `json:"system"`
+	Config json.RawMessage `json:"config"`
+	// LiveVersion is the version the preview was made against. Apply and rollback fail if it is no longer live, so
+	// what is applied is what was previewed.
+	LiveVersion int64  `json:"live_version"`
+	Version     int64  `json:"version"`
+	Note        string `json:"note"`
+}
+
+type definitionsResponse struct {
+	System      string                `json:"system"`
+	LiveVersion int64                 `json:"live_version"`
+	Changes     []*DefinitionsChange  `json:"changes,omitempty"`
+	Versions    []*DefinitionsVersion `json:"versions,omitempty"`
+}
+
+// Register adds the storage personalizer the uploads are applied through and the admin RPCs.
+func (c *DefinitionsReloadConfig) Register(logger runtime.Logger, initializer runtime.Initializer, systems hiro.Hiro) error {
+	// Hiro's own upload RPC is not registered, uploads are validated and versioned by these RPCs instead.
+	systems.AddPersonalizer(hiro.NewStoragePersonalizer(logger, c.CacheSec, definitionsLiveCollection, initializer, false))
+
+	if err := initializer.RegisterRpc("rpc_definitions_preview", c.rpcDefinitionsPreview(systems)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_definitions_apply", c.rpcDefinitionsApply(systems)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("rpc_definitions_rollback", c.rpcDefinitionsRollback(systems)); err != nil {
+		return err
+	}
+	return initializer.RegisterRpc("rpc_definitions_versions", c.rpcDefinitionsVersions())
+}
+
+// rpcDefinitionsPreview validates an upload and returns how it changes the live definitions, without applying it.
+func (c *DefinitionsReloadConfig) rpcDefinitionsPreview(systems hiro.Hiro) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		request, system, err := definitionsRequestDecode(ctx, systems, payload)
+		if err != nil {
+			return "", err
+		}
+		if err := definitionsValidate(request.System, request.Config); err != nil {
+			return "", err
+		}
+
+		head, _, err := definitionsHeadRead(ctx, nk, request.System)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read definitions head")
+			return "", err
+		}
+		changes, err := definitionsDiff(ctx, nk, request.System, system, request.Config)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to diff definitions")
+			return "", err
+		}
+
+		return definitionsResponseMarshal(&definitionsResponse{System: request.System, LiveVersion: head.Version, Changes: changes})
+	}
+}
+
+// rpcDefinitionsApply makes an upload the live definitions of its system, as a new version.
+func (c *DefinitionsReloadConfig) rpcDefinitionsApply(systems hiro.Hiro) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		request, system, err := definitionsRequestDecode(ctx, systems, payload)
+		if err != nil {
+			return "", err
+		}
+		if err := definitionsValidate(request.System, request.Config); err != nil {
+			return "", err
+		}
+
+		var config bytes.Buffer
+		if err := json.Compact(&config, request.Config); err != nil {
+			return "", runtime.NewError("config is not valid JSON", 3)
+		}
+		return c.apply(ctx, logger, nk, request, system, config.Bytes())
+	}
+}
+
+// rpcDefinitionsRollback makes an earlier version the live definitions again, as a new version. Version 0 rolls back to
+// the definitions file.
+func (c *DefinitionsReloadConfig) rpcDefinitionsRollback(systems hiro.Hiro) func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		request, system, err := definitionsRequestDecode(ctx, systems, payload)
+		if err != nil {
+			return "", err
+		}
+
+		var config json.RawMessage
+		if request.Version != 0 {
+			objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: definitionsVersionsCollection, Key: definitionsVersionKey(request.System, request.Version)}})
+			if err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to read definitions version")
+				return "", err
+			}
+			if len(objects) == 0 {
+				return "", runtime.NewError(fmt.Sprintf("version %d of %s definitions not found", request.Version, request.System), 5)
+			}
+			version := &DefinitionsVersion{}
+			if err := json.Unmarshal([]byte(objects[0].Value), version); err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to unmarshal definitions version")
+				return "", err
+			}
+			config = version.Config
+		}
+
+		if request.Note == "" {
+			request.Note = fmt.Sprintf("rollback to version %d", request.Version)
+		}
+		return c.apply(ctx, logger, nk, request, system, config)
+	}
+}
+
+// rpcDefinitionsVersions lists the retained versions of a system's definitions, newest first.
+func (c *DefinitionsReloadConfig) rpcDefinitionsVersions() func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		if _, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string); ok {
+			return "", runtime.NewError("definitions can only be read server to server", 7)
+		}
+		request := &definitionsRequest{}
+		if err := json.Unmarshal([]byte(payload), request); err != nil {
+			return "", runtime.NewError("invalid request", 3)
+		}
+		if _, found := reloadableSystems[request.System]; !found {
+			return "", runtime.NewError(fmt.Sprintf("unknown system %q", request.System), 3)
+		}
+
+		head, _, err := definitionsHeadRead(ctx, nk, request.System)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Failed to read definitions head")
+			return "", err
+		}
+		reads := make([]*runtime.StorageRead, 0, len(head.Versions))
+		for i := len(head.Versions) - 1; i >= 0; i-- {
+			reads = append(reads, &runtime.StorageRead{Collection: definitionsVersionsCollection, Key: definitionsVersionKey(request.System, head.Versions[i])})
+		}
+		response := &definitionsResponse{System: request.System, LiveVersion: head.Version, Versions: make([]*DefinitionsVersion, 0, len(reads))}
+		if len(reads) > 0 {
+			objects, err := nk.StorageRead(ctx, reads)
+			if err != nil {
+				logger.WithField("error", err.Error()).Error("Failed to read definitions versions")
+				return "", err
+			}
+			for _, object := range objects {
+				version := &DefinitionsVersion{}
+				if err := json.Unmarshal([]byte(object.Value), version); err != nil {
+					logger.WithField("error", err.Error()).Error("Failed to unmarshal definitions version")
+					continue
+				}
+				response.Versions = append(response.Versions, version)
+			}
+			sort.Slice(response.Versions, func(i, j int) bool {
+				return response.Versions[i].Version > response.Versions[j].Version
+			})
+		}
+
+		return definitionsResponseMarshal(response)
+	}
+}
+
+// apply writes config, or with no config removes the upload, as the next version. The live overlay, the version and the
+// head are written together, and the head's storage version guards against a concurrent apply.
+func (c *DefinitionsReloadConfig) apply(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, request *definitionsRequest, system hiro.System, config json.RawMessage) (string, error) {
+	head, headVersion, err := definitionsHeadRead(ctx, nk, request.System)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to read definitions head")
+		return "", err
+	}
+	if head.Version != request.LiveVersion {
+		return "", runtime.NewError(fmt.Sprintf("live %s definitions are version %d, not %d, preview again", request.System, head.Version, request.LiveVersion), 9)
+	}
+
+	changes, err := definitionsDiff(ctx, nk, request.System, system, config)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Failed to diff definitions")
+		return "", err
+	}
+
+	version := &DefinitionsVersion{
+		System:        request.System,
+		Version:       head.Version + 1,
+		Note:          request.Note,
+		CreateTimeSec: time.Now().Unix(),
+		Config:        config,
+	}
+	head.Version = version.Version
+	head.Versions = append(head.Versions, version.Version)
+
+	var deletes []*runtime.StorageDelete
+	for len(head.Versions) > c.MaxVersions {
+		deletes = append(deletes, &runtime.StorageDelete{Collection: definitionsVersionsCollection, Key: definitionsVersionKey(request.System, head.Versions[0])})
+		head.Versions = head.Versions[1:]
+	}
+
+	headValue, err := json.Marshal(head)
+	if err != nil {
+		return "", err
+	}
+	versionValue, err := json.Marshal(version)
+	if err != nil {
+		return "", err
+	}
+	writes := []*runtime.StorageWrite{
+		{Collection: definitionsVersionsCollection, Key: request.System, Value: string(headValue), Version: headVersion, PermissionRead: 0, PermissionWrite: 0},
+		{Collection: definitionsVersionsCollection, Key: definitionsVersionKey(request.System, version.Version), Value: string(versionValue), PermissionRead: 0, PermissionWrite: 0},
+	}
+	if config != nil {
+		writes = append(writes, &runtime.StorageWrite{Collection: definitionsLiveCollection, Key: request.System, Value: string(config), PermissionRead: 0, PermissionWrite: 0})
+	} else {
+		deletes = append(deletes, &runtime.StorageDelete{Collection: definitionsLiveCollection, Key: request.System})
+	}
+
+	if _, _, err := nk.MultiUpdate(ctx, nil, writes, deletes, nil, false); err != nil {
+		logger.WithField("error", err.Error()).Warn("Failed to apply definitions")
+		return "", runtime.NewError("live definitions changed while applying, preview again", 10)
+	}
+	logger.WithFields(map[string]any{"system": request.System, "version": version.Version, "changes": len(changes)}).Info("Applied definitions")
+
+	return definitionsResponseMarshal(&definitionsResponse{System: request.System, LiveVersion: version.Version, Changes: changes})
+}
+
+// definitionsRequestDecode checks the caller is a server, not a player, and that the system is known and enabled.
+func definitionsRequestDecode(ctx context.Context, systems hiro.Hiro, payload string) (*definitionsRequest, hiro.System, error) {
+	if _, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string); ok {
+		return nil, nil, runtime.NewError("definitions can only be changed server to server", 7)
+	}
+	request := &definitionsRequest{}
+	if err := json.Unmarshal([]byte(payload), request); err != nil {
+		return nil, nil, runtime.NewError("invalid request", 3)
+	}
+	reloadable, found := reloadableSystems[request.System]
+	if !found {
+		return nil, nil, runtime.NewError(fmt.Sprintf("unknown system %q", request.System), 3)
+	}
+	system := reloadable.system(systems)
+	if system == nil {
+		return nil, nil, runtime.NewError(fmt.Sprintf("system %q is not enabled", request.System), 9)
+	}
+	return request, system, nil
+}
+
+// definitionsValidate decodes an upload into the system's Hiro config struct, rejecting unknown fields and mistyped
+// values the same way hiro.StoragePersonalizer would when it reads the upload back.
+func definitionsValidate(systemName string, config json.RawMessage) error {
+	if len(config) == 0 {
+		return runtime.NewError("missing config", 3)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(config))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(reloadableSystems[systemName].newConfig()); err != nil {
+		return runtime.NewError(fmt.Sprintf("invalid %s definitions: %s", systemName, err.Error()), 3)
+	}
+	return nil
+}
+
+// definitionsDiff compares the live definitions, the file with the live overlay merged on, to the file with config
+// merged on instead.
+func definitionsDiff(ctx context.Context, nk runtime.NakamaModule, systemName string, system hiro.System, config json.RawMessage) ([]*DefinitionsChange, error) {
+	file, err := json.Marshal(system.GetConfig())
+	if err != nil {
+		return nil, err
+	}
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: definitionsLiveCollection, Key: systemName}})
+	if err != nil {
+		return nil, err
+	}
+	var overlay json.RawMessage
+	if len(objects) > 0 {
+		overlay = json.RawMessage(objects[0].Value)
+	}
+
+	live, err := definitionsMerge(systemName, file, overlay)
+	if err != nil {
+		return nil, err
+	}
+	proposed, err := definitionsMerge(systemName, file, config)
+	if err != nil {
+		return nil, err
+	}
+
+	liveLeaves := make(map[string]json.RawMessage)
+	definitionsFlatten("", live, liveLeaves)
+	proposedLeaves := make(map[string]json.RawMessage)
+	definitionsFlatten("", proposed, proposedLeaves)
+
+	changes := make([]*DefinitionsChange, 0)
+	for path, liveValue := range liveLeaves {
+		if proposedValue, found := proposedLeaves[path]; !found || !bytes.Equal(liveValue, proposedValue) {
+			changes = append(changes, &DefinitionsChange{Path: path, Live: liveValue, Proposed: proposedValue})
+		}
+	}
+	for path, proposedValue := range proposedLeaves {
+		if _, found := liveLeaves[path]; !found {
+			changes = append(changes, &DefinitionsChange{Path: path, Proposed: proposedValue})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// definitionsMerge decodes the file definitions, then the overlay on top, into the system's config struct and returns
+// the result as generic JSON values.
+func definitionsMerge(systemName string, file, overlay json.RawMessage) (any, error) {
+	config := reloadableSystems[systemName].newConfig()
+	if err := json.Unmarshal(file, config); err != nil {
+		return nil, err
+	}
+	if len(overlay) > 0 {
+		if err := json.Unmarshal(overlay, config); err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// definitionsFlatten collects the leaf values of value by their dotted path, with array elements indexed as
+// "path[0]".
+func definitionsFlatten(path string, value any, leaves map[string]json.RawMessage) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, child := range value {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			definitionsFlatten(childPath, child, leaves)
+		}
+	case []any:
+		for i, child := range value {
+			definitionsFlatten(path+"["+strconv.Itoa(i)+"]", child, leaves)
+		}
+	default:
+		data, _ := json.Marshal(value)
+		leaves[path] = data
+	}
+}
+
+func definitionsHeadRead(ctx context.Context, nk runtime.NakamaModule, systemName string) (*DefinitionsHead, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: definitionsVersionsCollection, Key: systemName}})
+	if err != nil {
+		return nil, "", err
+	}
+	head := &DefinitionsHead{}
+	if len(objects) == 0 {
+		return head, "*", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), head); err != nil {
+		return nil, "", err
+	}
+	return head, objects[0].Version, nil
+}
+
+func definitionsVersionKey(systemName string, version int64) string {
+	return fmt.Sprintf("%s_%06d", systemName, version)
+}
+
+func definitionsResponseMarshal(response *definitionsResponse) (string, error) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
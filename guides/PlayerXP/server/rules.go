@@ -0,0 +1,479 @@
+// This file implements a declarative rules engine as a Hiro Publisher. Instead of
+// writing Go code for every "when X happens, advance Y" rule, rules are loaded from
+// definitions/<env>/rules.json and matched against every event Hiro publishes.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/heroiclabs/hiro"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// Per-user counts of how often each capped rule has fired, kept in one storage
+	// object per player.
+	rulesStorageCollection = "rules"
+	rulesStorageKeyCaps    = "caps"
+
+	ruleActionAchievements = "achievements"
+	ruleActionLevels       = "levels"
+	ruleActionStats        = "stats"
+	ruleActionTeamStats    = "team_stats"
+	ruleActionReward       = "reward"
+
+	// Group membership states above this are join requests, not team members.
+	teamStateMember = 2
+)
+
+// rulesDepthKey marks the context of events raised by a rule's own actions, such as
+// the currencyGranted event of a reward grant, so chains of rules stay bounded.
+type rulesDepthKey struct{}
+
+// RulesConfig is the shape of definitions/<env>/rules.json.
+type RulesConfig struct {
+	// DryRun logs every rule that would fire, with its actions, without applying
+	// them or counting them against caps. Rules can also be dry-run one at a time.
+	DryRun bool `json:"dry_run"`
+	// MaxDepth is how many levels of events raised by rule actions are matched in
+	// turn. 0 means only events from outside the rules engine are matched.
+	MaxDepth int     `json:"max_depth"`
+	Rules    []*Rule `json:"rules"`
+}
+
+// Rule fires its actions for every event with a matching name, metadata and value.
+type Rule struct {
+	ID string `json:"id"`
+	// Rules are matched in ascending order, ties in the order they are listed.
+	Order int `json:"order"`
+	// Stop skips the rules after this one for an event this rule fired on.
+	Stop   bool   `json:"stop"`
+	DryRun bool   `json:"dry_run"`
+	Event  string `json:"event"`
+	// Metadata predicates must all match the event metadata value of the same key.
+	Metadata map[string]*RulePredicate `json:"metadata"`
+	Value    *RulePredicate            `json:"value"`
+	Cap      *RuleCap                  `json:"cap"`
+	Actions  []*RuleAction             `json:"actions"`
+}
+
+// RulePredicate matches a string value. Every set field must match. The ordering
+// comparisons treat the value as a number, and never match if it is not one.
+type RulePredicate struct {
+	Exists *bool    `json:"exists"`
+	Eq     *string  `json:"eq"`
+	Ne     *string  `json:"ne"`
+	In     []string `json:"in"`
+	Gt     *float64 `json:"gt"`
+	Gte    *float64 `json:"gte"`
+	Lt     *float64 `json:"lt"`
+	Lte    *float64 `json:"lte"`
+}
+
+// RuleCap limits how often a rule fires per player, over a rolling window or, with a
+// zero window, ever.
+type RuleCap struct {
+	Max       int64 `json:"max"`
+	WindowSec int64 `json:"window_sec"`
+}
+
+// RuleAction is one thing a rule does when it fires. Type picks which of the other
+// fields are used.
+type RuleAction struct {
+	// Type is one of "achievements", "levels", "stats", "team_stats" or "reward".
+	Type string `json:"type"`
+	// Amount is how much achievements and stats advance by. FromValue uses the
+	// event's numeric value instead.
+	Amount    int64 `json:"amount"`
+	FromValue bool  `json:"from_value"`
+	// Achievements are the IDs advanced by "achievements".
+	Achievements []string `json:"achievements"`
+	// Achievement is the achievement whose "level_1", "level_2", ... sub-achievements
+	// are advanced in turn by "levels", overflow carrying into the next level.
+	Achievement string `json:"achievement"`
+	// Stats are updated by "stats" for the player, and "team_stats" for their team.
+	Stats  []*RuleStat               `json:"stats"`
+	Reward *hiro.EconomyConfigReward `json:"reward"`
+}
+
+type RuleStat struct {
+	Name    string `json:"name"`
+	Private bool   `json:"private"`
+	// Operator is one of "set", "delta", "min" or "max".
+	Operator string `json:"operator"`
+}
+
+// RuleCaps records when each capped rule fired for a player, in unix seconds.
+type RuleCaps struct {
+	Fired map[string][]int64 `json:"fired"`
+}
+
+var ruleStatOperators = map[string]hiro.StatUpdateOperator{
+	"set":   hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_SET,
+	"delta": hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_DELTA,
+	"min":   hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_MIN,
+	"max":   hiro.StatUpdateOperator_STAT_UPDATE_OPERATOR_MAX,
+}
+
+// RulesPublisher applies the rules to the events Hiro publishes.
+type RulesPublisher struct {
+	config  *RulesConfig
+	systems hiro.Hiro
+}
+
+// Compile-time assertion to ensure that RulesPublisher implements hiro.Publisher.
+var _ hiro.Publisher = (*RulesPublisher)(nil)
+
+// NewRulesPublisher loads and checks the rules file. Rules are sorted once here so
+// Send only has to walk them.
+func NewRulesPublisher(nk runtime.NakamaModule, systems hiro.Hiro, path string) (*RulesPublisher, error) {
+	file, err := nk.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %w", path, err)
+	}
+	config := &RulesConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", path, err)
+	}
+	if err := config.Validate(systems); err != nil {
+		return nil, fmt.Errorf("invalid rules in %q: %w", path, err)
+	}
+
+	sort.SliceStable(config.Rules, func(i, j int) bool {
+		return config.Rules[i].Order < config.Rules[j].Order
+	})
+	return &RulesPublisher{config: config, systems: systems}, nil
+}
+
+// Validate checks every rule up front, so a typo in rules.json fails server startup
+// rather than silently never firing.
+func (c *RulesConfig) Validate(systems hiro.Hiro) error {
+	var errs []error
+	ids := make(map[string]bool, len(c.Rules))
+	for i, rule := range c.Rules {
+		if rule.ID == "" {
+			errs = append(errs, fmt.Errorf("rule %d: missing id", i))
+		} else if ids[rule.ID] {
+			errs = append(errs, fmt.Errorf("rule %q: duplicate id", rule.ID))
+		}
+		ids[rule.ID] = true
+		if rule.Event == "" {
+			errs = append(errs, fmt.Errorf("rule %q: missing event", rule.ID))
+		}
+		if rule.Cap != nil && (rule.Cap.Max <= 0 || rule.Cap.WindowSec < 0) {
+			errs = append(errs, fmt.Errorf("rule %q: cap max must be positive and window_sec not negative", rule.ID))
+		}
+		if len(rule.Actions) == 0 {
+			errs = append(errs, fmt.Errorf("rule %q: no actions", rule.ID))
+		}
+		for _, action := range rule.Actions {
+			if err := action.validate(systems); err != nil {
+				errs = append(errs, fmt.Errorf("rule %q: %w", rule.ID, err))
+			}
+		}
+	}
+	if c.MaxDepth < 0 {
+		errs = append(errs, errors.New("max_depth must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (a *RuleAction) validate(systems hiro.Hiro) error {
+	switch a.Type {
+	case ruleActionAchievements:
+		if len(a.Achievements) == 0 {
+			return errors.New("achievements action needs achievements")
+		}
+		if systems.GetAchievementsSystem() == nil {
+			return errors.New("achievements action needs the achievements system")
+		}
+	case ruleActionLevels:
+		if a.Achievement == "" {
+			return errors.New("levels action needs an achievement")
+		}
+		if systems.GetAchievementsSystem() == nil {
+			return errors.New("levels action needs the achievements system")
+		}
+	case ruleActionStats, ruleActionTeamStats:
+		if len(a.Stats) == 0 {
+			return fmt.Errorf("%s action needs stats", a.Type)
+		}
+		for _, stat := range a.Stats {
+			if _, found := ruleStatOperators[stat.Operator]; !found {
+				return fmt.Errorf("stat %q: operator must be one of set, delta, min, max, got %q", stat.Name, stat.Operator)
+			}
+		}
+		if a.Type == ruleActionStats && systems.GetStatsSystem() == nil {
+			return errors.New("stats action needs the stats system")
+		}
+		if a.Type == ruleActionTeamStats && systems.GetTeamsSystem() == nil {
+			return errors.New("team_stats action needs the teams system")
+		}
+	case ruleActionReward:
+		if a.Reward == nil {
+			return errors.New("reward action needs a reward")
+		}
+	default:
+		return fmt.Errorf("unknown action type %q", a.Type)
+	}
+	return nil
+}
+
+// The rules engine doesn't need to act on authentication, so it's a no-op.
+func (p *RulesPublisher) Authenticate(_ context.Context, _ runtime.Logger, _ runtime.NakamaModule, _ string, _ bool) {
+}
+
+// Send matches each event against the rules in order and fires the actions of every
+// rule that matches and is within its cap. Errors are logged, never returned: Hiro
+// does not retry publishers, and one failing rule should not stop the others.
+func (p *RulesPublisher) Send(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID string, events []*hiro.PublisherEvent) {
+	depth, _ := ctx.Value(rulesDepthKey{}).(int)
+	if depth > p.config.MaxDepth {
+		return
+	}
+	actionCtx := context.WithValue(ctx, rulesDepthKey{}, depth+1)
+
+	// Caps are only read if a capped rule matches, and written once for the batch.
+	var caps *RuleCaps
+	var capsVersion string
+	capsChanged := false
+
+	for _, event := range events {
+		for _, rule := range p.config.Rules {
+			if !rule.matches(event) {
+				continue
+			}
+			ruleLogger := logger.WithFields(map[string]interface{}{"rule": rule.ID, "event": event.Name, "user_id": userID})
+
+			now := time.Now().Unix()
+			if rule.Cap != nil {
+				if caps == nil {
+					var err error
+					if caps, capsVersion, err = readRuleCaps(ctx, nk, userID); err != nil {
+						ruleLogger.WithField("error", err.Error()).Error("Failed to read rule caps")
+						return
+					}
+				}
+				if rule.Cap.reached(caps.Fired[rule.ID], now) {
+					ruleLogger.Debug("Rule cap reached")
+					continue
+				}
+			}
+
+			if p.config.DryRun || rule.DryRun {
+				actions, _ := json.Marshal(rule.Actions)
+				ruleLogger.WithFields(map[string]interface{}{"value": event.Value, "metadata": event.Metadata, "actions": string(actions)}).Info("Rule would fire (dry run)")
+			} else {
+				for _, action := range rule.Actions {
+					if err := p.apply(actionCtx, logger, nk, userID, event, action); err != nil {
+						ruleLogger.WithFields(map[string]interface{}{"action": action.Type, "error": err.Error()}).Error("Failed to apply rule action")
+					}
+				}
+				if rule.Cap != nil {
+					caps.Fired[rule.ID] = append(rule.Cap.trim(caps.Fired[rule.ID], now), now)
+					capsChanged = true
+				}
+			}
+
+			if rule.Stop {
+				break
+			}
+		}
+	}
+
+	if capsChanged {
+		if err := writeRuleCaps(ctx, nk, userID, capsVersion, caps); err != nil {
+			// Another batch for the same player wrote first. The rules have fired, at
+			// worst a cap lets one extra firing through.
+			logger.WithFields(map[string]interface{}{"user_id": userID, "error": err.Error()}).Warn("Failed to write rule caps")
+		}
+	}
+}
+
+func (r *Rule) matches(event *hiro.PublisherEvent) bool {
+	if event.Name != r.Event {
+		return false
+	}
+	for key, predicate := range r.Metadata {
+		value, found := event.Metadata[key]
+		if !predicate.matches(value, found) {
+			return false
+		}
+	}
+	return r.Value == nil || r.Value.matches(event.Value, event.Value != "")
+}
+
+func (p *RulePredicate) matches(value string, found bool) bool {
+	if p.Exists != nil && *p.Exists != found {
+		return false
+	}
+	if p.Eq != nil && value != *p.Eq {
+		return false
+	}
+	if p.Ne != nil && value == *p.Ne {
+		return false
+	}
+	if len(p.In) > 0 {
+		in := false
+		for _, candidate := range p.In {
+			in = in || value == candidate
+		}
+		if !in {
+			return false
+		}
+	}
+	if p.Gt == nil && p.Gte == nil && p.Lt == nil && p.Lte == nil {
+		return true
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+	return (p.Gt == nil || number > *p.Gt) && (p.Gte == nil || number >= *p.Gte) &&
+		(p.Lt == nil || number < *p.Lt) && (p.Lte == nil || number <= *p.Lte)
+}
+
+// trim drops firings that have left the cap's window.
+func (c *RuleCap) trim(fired []int64, now int64) []int64 {
+	if c.WindowSec == 0 {
+		return fired
+	}
+	kept := fired[:0]
+	for _, at := range fired {
+		if now-at < c.WindowSec {
+			kept = append(kept, at)
+		}
+	}
+	return kept
+}
+
+func (c *RuleCap) reached(fired []int64, now int64) bool {
+	return int64(len(c.trim(append([]int64(nil), fired...), now))) >= c.Max
+}
+
+func (p *RulesPublisher) apply(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userID string, event *hiro.PublisherEvent, action *RuleAction) error {
+	amount := action.Amount
+	if action.FromValue {
+		value, err := strconv.ParseInt(event.Value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("event value %q is not an integer", event.Value)
+		}
+		amount = value
+	}
+
+	switch action.Type {
+	case ruleActionAchievements:
+		updates := make(map[string]int64, len(action.Achievements))
+		for _, id := range action.Achievements {
+			updates[id] = amount
+		}
+		_, _, err := p.systems.GetAchievementsSystem().UpdateAchievements(ctx, logger, nk, userID, updates)
+		return err
+	case ruleActionLevels:
+		if amount <= 0 {
+			return nil
+		}
+		return advanceLevels(ctx, logger, nk, p.systems.GetAchievementsSystem(), userID, action.Achievement, amount)
+	case ruleActionStats:
+		public, private := action.statUpdates(amount)
+		_, err := p.systems.GetStatsSystem().Update(ctx, logger, nk, userID, public, private)
+		return err
+	case ruleActionTeamStats:
+		teamID, err := userTeam(ctx, nk, userID)
+		if err != nil || teamID == "" {
+			// Players without a team have no team stats to update.
+			return err
+		}
+		public, private := action.statUpdates(amount)
+		_, err = p.systems.GetTeamsSystem().StatsUpdate(ctx, logger, nk, userID, teamID, public, private)
+		return err
+	case ruleActionReward:
+		// Rolling the reward applies the player's reward modifiers, as in rpc_grant_xp.
+		economy := p.systems.GetEconomySystem()
+		reward, err := economy.RewardRoll(ctx, logger, nk, userID, action.Reward)
+		if err != nil {
+			return err
+		}
+		_, _, _, err = economy.RewardGrant(ctx, logger, nk, userID, reward, nil, false)
+		return err
+	}
+	return nil
+}
+
+func (a *RuleAction) statUpdates(amount int64) (public, private []*hiro.StatUpdate) {
+	for _, stat := range a.Stats {
+		update := &hiro.StatUpdate{Name: stat.Name, Value: amount, Operator: ruleStatOperators[stat.Operator]}
+		if stat.Private {
+			private = append(private, update)
+		} else {
+			public = append(public, update)
+		}
+	}
+	return public, private
+}
+
+// userTeam returns the ID of the player's team, or "" if they are not in one.
+func userTeam(ctx context.Context, nk runtime.NakamaModule, userID string) (string, error) {
+	cursor := ""
+	for {
+		groups, nextCursor, err := nk.UserGroupsList(ctx, userID, 100, nil, cursor)
+		if err != nil {
+			return "", err
+		}
+		for _, group := range groups {
+			if group.GetState().GetValue() <= teamStateMember {
+				return group.GetGroup().GetId(), nil
+			}
+		}
+		if cursor = nextCursor; cursor == "" {
+			return "", nil
+		}
+	}
+}
+
+func readRuleCaps(ctx context.Context, nk runtime.NakamaModule, userID string) (*RuleCaps, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: rulesStorageCollection, Key: rulesStorageKeyCaps, UserID: userID}})
+	if err != nil {
+		return nil, "", err
+	}
+	caps := &RuleCaps{Fired: make(map[string][]int64)}
+	if len(objects) == 0 {
+		return caps, "*", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), caps); err != nil {
+		return nil, "", err
+	}
+	if caps.Fired == nil {
+		caps.Fired = make(map[string][]int64)
+	}
+	return caps, objects[0].Version, nil
+}
+
+func writeRuleCaps(ctx context.Context, nk runtime.NakamaModule, userID, version string, caps *RuleCaps) error {
+	value, err := json.Marshal(caps)
+	if err != nil {
+		return err
+	}
+	_, err = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      rulesStorageCollection,
+		Key:             rulesStorageKeyCaps,
+		UserID:          userID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}